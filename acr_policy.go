@@ -0,0 +1,268 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/authlete/authlete-go-gin/handler"
+	"github.com/authlete/authlete-go/api"
+	"github.com/authlete/authlete-go/dto"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Error code defined in OpenID Connect Core Unmet Authentication
+	// Requirements 1.0.
+	errorUnmetAuthenticationRequirements = `unmet_authentication_requirements`
+
+	errorDescriptionUnmetAcr = `The essential ACR has not been achieved.`
+)
+
+var (
+	acrPolicyInstance *AcrPolicy
+)
+
+func init() {
+	// This implementation uses the following fixed policy.
+	// Change this as necessary.
+	policy := AcrPolicy{}
+	policy.Levels = []AcrLevel{
+		AcrLevel{
+			Acr:     Acr_SINGLE_FACTOR,
+			Methods: [][]string{{Amr_PWD}, {Amr_EMAIL}, {Amr_FED}, {Amr_HWK}},
+		},
+		AcrLevel{
+			Acr:     Acr_MULTI_FACTOR,
+			Methods: [][]string{{Amr_PWD, Amr_OTP}, {Amr_HWK}},
+		},
+		AcrLevel{
+			Acr:     Acr_PHISHING_RESISTANT,
+			Methods: [][]string{{Amr_HWK}},
+		},
+	}
+
+	acrPolicyInstance = &policy
+}
+
+// AcrPolicy maps ACR values to the authentication methods which are
+// required to achieve them.
+type AcrPolicy struct {
+	// From the weakest to the strongest.
+	Levels []AcrLevel
+}
+
+type AcrLevel struct {
+	Acr string
+
+	// The level is achieved when all the methods of any one of the
+	// combinations have been used. The methods are values of "amr".
+	Methods [][]string
+}
+
+func AcrPolicy_Get() *AcrPolicy {
+	return acrPolicyInstance
+}
+
+func (self *AcrPolicy) getLevel(acr string) *AcrLevel {
+	for i := range self.Levels {
+		if self.Levels[i].Acr == acr {
+			return &self.Levels[i]
+		}
+	}
+
+	return nil
+}
+
+func (self *AcrPolicy) IsKnown(acr string) bool {
+	return self.getLevel(acr) != nil
+}
+
+// IsSatisfied returns true when the authentication methods achieve the ACR.
+func (self *AcrPolicy) IsSatisfied(acr string, amr []string) bool {
+	level := self.getLevel(acr)
+	if level == nil {
+		return false
+	}
+
+	for _, methods := range level.Methods {
+		if containsAllStrings(amr, methods) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Achieved returns the strongest ACR which the authentication methods achieve.
+func (self *AcrPolicy) Achieved(amr []string) string {
+	achieved := ``
+
+	for _, level := range self.Levels {
+		if self.IsSatisfied(level.Acr, amr) {
+			achieved = level.Acr
+		}
+	}
+
+	return achieved
+}
+
+// SelectAcr returns the first one of the requested ACRs which the
+// authentication methods achieve. If none is achieved, an empty string
+// is returned.
+func (self *AcrPolicy) SelectAcr(requested []string, amr []string) string {
+	for _, acr := range requested {
+		if self.IsSatisfied(acr, amr) {
+			return acr
+		}
+	}
+
+	return ``
+}
+
+// CanSatisfy returns true when the user has the authenticators which are
+// necessary to achieve any one of the requested ACRs. 'credentials' holds
+// the passkeys of the tenant of the user.
+func (self *AcrPolicy) CanSatisfy(requested []string, user *UserEntity, credentials *CredentialDatabase) bool {
+	available := availableMethods(user, credentials)
+
+	return self.SelectAcr(requested, available) != ``
+}
+
+func availableMethods(user *UserEntity, credentials *CredentialDatabase) []string {
+	// Every user has a password.
+	methods := []string{Amr_PWD}
+
+	if user.Email != `` {
+		methods = append(methods, Amr_EMAIL)
+	}
+
+	if user.IsTotpEnabled() {
+		methods = append(methods, Amr_OTP)
+	}
+
+	if len(credentials.GetBySubject(user.Subject)) != 0 {
+		methods = append(methods, Amr_HWK)
+	}
+
+	return methods
+}
+
+func containsAllStrings(values []string, required []string) bool {
+	for _, value := range required {
+		if containsString(values, value) == false {
+			return false
+		}
+	}
+
+	return true
+}
+
+func getRequestedAcrs(session sessions.Session) (acrs []string, essential bool) {
+	value := session.Get(`acrs`)
+	acrs, _ = value.([]string)
+
+	value = session.Get(`acrEssential`)
+	essential, _ = value.(bool)
+
+	return
+}
+
+func getSessionAmr(session sessions.Session) []string {
+	value := session.Get(`amr`)
+	amr, _ := value.([]string)
+
+	return amr
+}
+
+// isAcrUnmet returns true when the ACR is essential to the authorization
+// request but the user has not achieved any of the requested ones.
+func isAcrUnmet(acrs []string, essential bool, amr []string) bool {
+	if len(acrs) == 0 || essential == false {
+		return false
+	}
+
+	return AcrPolicy_Get().SelectAcr(acrs, amr) == ``
+}
+
+// failUnmetAcr makes the authorization request fail with the error
+// 'unmet_authentication_requirements'. Authlete reports the reason
+// ACR_NOT_SATISFIED as 'login_required', so the error code in the response
+// content is replaced. Authlete still takes care of the redirect URI, the
+// state and the response mode. A JARM response is sent as it is because
+// it is signed.
+func failUnmetAcr(ctx *gin.Context, instance api.AuthleteApi, ticket string) {
+	handler := handler.AuthReqBaseHandler{}
+	handler.Init(&unmetAcrApi{AuthleteApi: instance})
+	handler.AuthorizationFail(ctx, ticket, dto.AuthorizationFailReason_ACR_NOT_SATISFIED)
+}
+
+type unmetAcrApi struct {
+	api.AuthleteApi
+}
+
+func (self *unmetAcrApi) AuthorizationFail(request *dto.AuthorizationFailRequest) (*dto.AuthorizationFailResponse, *api.AuthleteError) {
+	res, err := self.AuthleteApi.AuthorizationFail(request)
+	if err != nil {
+		return res, err
+	}
+
+	switch res.Action {
+	case dto.AuthorizationFailAction_LOCATION:
+		res.ResponseContent = replaceErrorInLocation(res.ResponseContent)
+	case dto.AuthorizationFailAction_FORM:
+		res.ResponseContent = replaceErrorInForm(res.ResponseContent)
+	}
+
+	return res, nil
+}
+
+// replaceErrorInLocation replaces the error in the query or the fragment of
+// the redirect URI.
+func replaceErrorInLocation(location string) string {
+	index := strings.LastIndexAny(location, `?#`)
+	if index < 0 {
+		return location
+	}
+
+	params, err := url.ParseQuery(location[index+1:])
+	if err != nil || params.Get(`error`) == `` {
+		return location
+	}
+
+	params.Set(`error`, errorUnmetAuthenticationRequirements)
+	params.Set(`error_description`, errorDescriptionUnmetAcr)
+	params.Del(`error_uri`)
+
+	return location[:index+1] + params.Encode()
+}
+
+// Hidden fields of the page for 'response_mode=form_post'.
+var (
+	formErrorPattern            = regexp.MustCompile(`(name="error"\s+value=")[^"]*`)
+	formErrorDescriptionPattern = regexp.MustCompile(`(name="error_description"\s+value=")[^"]*`)
+)
+
+func replaceErrorInForm(form string) string {
+	form = formErrorPattern.ReplaceAllString(form, `${1}`+errorUnmetAuthenticationRequirements)
+	form = formErrorDescriptionPattern.ReplaceAllString(form, `${1}`+errorDescriptionUnmetAcr)
+
+	return form
+}
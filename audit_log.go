@@ -0,0 +1,452 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/authlete/authlete-go/api"
+	"github.com/authlete/authlete-go/dto"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Names of audit events.
+const (
+	AuditEvent_LOGIN            = `login`
+	AuditEvent_LOGOUT           = `logout`
+	AuditEvent_CONSENT          = `consent`
+	AuditEvent_TOKEN_ISSUED     = `token_issued`
+	AuditEvent_TOKEN_REVOKED    = `token_revoked`
+	AuditEvent_ACCOUNT_LOCKED   = `account_locked`
+	AuditEvent_ACCOUNT_UNLOCKED = `account_unlocked`
+	AuditEvent_USER_CREATED     = `user_created`
+	AuditEvent_USER_UPDATED     = `user_updated`
+	AuditEvent_USER_DELETED     = `user_deleted`
+
+	ConsentResult_GRANTED = `granted`
+	ConsentResult_DENIED  = `denied`
+)
+
+var (
+	auditLogInstance *AuditLog
+)
+
+func init() {
+	auditLogInstance = AuditLog_New()
+}
+
+// AuditEvent is a security-relevant event. Events are written as JSON
+// Lines to the sinks of AuditLog.
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Tenant string    `json:"tenant,omitempty"`
+	Result string    `json:"result,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+
+	// Authentication method references joined with "+", e.g. "pwd+otp".
+	Method string `json:"method,omitempty"`
+
+	// Administrator or client which performed an administrative action.
+	Actor string `json:"actor,omitempty"`
+
+	Subject   string `json:"subject,omitempty"`
+	LoginId   string `json:"loginId,omitempty"`
+	ClientId  string `json:"clientId,omitempty"`
+	Ip        string `json:"ip,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+
+	// Hash of the ticket issued by Authlete for an authorization request.
+	// It correlates the events of the same authorization request without
+	// revealing the ticket.
+	Ticket string `json:"ticket,omitempty"`
+
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// AuditSink is a destination of audit events. Write receives an event
+// serialized as a line of JSON without a line break.
+type AuditSink interface {
+	Write(line []byte) error
+	Close() error
+}
+
+// AuditLog writes audit events to sinks. Values of the fields listed in
+// AUDIT_LOG_REDACT are replaced with their keyed hashes so that events of
+// the same user can still be correlated.
+type AuditLog struct {
+	Sinks []AuditSink
+
+	// Names of fields to redact, e.g. "loginId" and "ip". Entries of
+	// Details are redacted by their keys as well.
+	Redact map[string]bool
+
+	// Key of HMAC-SHA256 used for redaction.
+	RedactKey []byte
+}
+
+func AuditLog_New() *AuditLog {
+	audit := AuditLog{}
+	audit.Redact = map[string]bool{}
+	audit.RedactKey = []byte(getConfiguration(`AUDIT_LOG_REDACT_KEY`, ``))
+
+	for _, name := range getConfigurationList(`AUDIT_LOG_REDACT`, ``) {
+		audit.Redact[name] = true
+	}
+
+	// Hashes without a secret key can be reversed by guessing the values.
+	if len(audit.Redact) != 0 && len(audit.RedactKey) == 0 {
+		msg := "audit_log: AUDIT_LOG_REDACT_KEY is not set. A random key is used, so redacted values cannot be correlated across restarts or servers."
+		log.Warn().Msg(msg)
+
+		audit.RedactKey = make([]byte, 32)
+		rand.Read(audit.RedactKey)
+	}
+
+	// Comma-separated list of "stdout", "file" and "webhook".
+	for _, name := range getConfigurationList(`AUDIT_LOG_SINKS`, `stdout`) {
+		switch name {
+		case `stdout`:
+			audit.Sinks = append(audit.Sinks, AuditWriterSink_New(os.Stdout))
+		case `file`:
+			audit.Sinks = append(audit.Sinks, AuditFileSink_New(getConfiguration(`AUDIT_LOG_FILE`, `audit.log`)))
+		case `webhook`:
+			audit.Sinks = append(audit.Sinks, AuditWebhookSink_New(
+				getConfiguration(`AUDIT_LOG_WEBHOOK_URL`, ``), getConfiguration(`AUDIT_LOG_WEBHOOK_TOKEN`, ``)))
+		default:
+			msg := fmt.Sprintf("audit_log: Unknown sink '%s' is ignored.", name)
+			log.Warn().Msg(msg)
+		}
+	}
+
+	return &audit
+}
+
+func AuditLog_Get() *AuditLog {
+	return auditLogInstance
+}
+
+// Record writes the event to the sinks. If 'ctx' is given, the IP address
+// and the user agent of the request are added to the event.
+func (self *AuditLog) Record(ctx *gin.Context, event *AuditEvent) {
+	event.Time = time.Now().UTC()
+
+	if ctx != nil {
+		if event.Ip == `` {
+			event.Ip = ctx.ClientIP()
+		}
+		event.UserAgent = ctx.Request.UserAgent()
+
+		if tenant := Tenant_Of(ctx); tenant != nil {
+			event.Tenant = tenant.Name
+		}
+	}
+
+	self.redact(event)
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	for _, sink := range self.Sinks {
+		if err := sink.Write(line); err != nil {
+			msg := fmt.Sprintf("audit_log: Failed to write an audit event '%s': %s", event.Event, err)
+			log.Warn().Msg(msg)
+		}
+	}
+}
+
+// Close flushes and closes the sinks.
+func (self *AuditLog) Close() {
+	for _, sink := range self.Sinks {
+		sink.Close()
+	}
+}
+
+func (self *AuditLog) redact(event *AuditEvent) {
+	fields := map[string]*string{
+		`actor`:     &event.Actor,
+		`subject`:   &event.Subject,
+		`loginId`:   &event.LoginId,
+		`clientId`:  &event.ClientId,
+		`ip`:        &event.Ip,
+		`userAgent`: &event.UserAgent,
+	}
+
+	for name, field := range fields {
+		if self.Redact[name] && *field != `` {
+			*field = self.hash(*field)
+		}
+	}
+
+	for name, value := range event.Details {
+		if self.Redact[name] && value != `` {
+			event.Details[name] = self.hash(value)
+		}
+	}
+}
+
+func (self *AuditLog) hash(value string) string {
+	mac := hmac.New(sha256.New, self.RedactKey)
+	mac.Write([]byte(value))
+
+	return `hmac:` + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// auditTicket returns the value which identifies the ticket in audit events.
+func auditTicket(ticket string) string {
+	if ticket == `` {
+		return ``
+	}
+
+	sum := sha256.Sum256([]byte(ticket))
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// AuditWriterSink writes audit events to a writer such as the standard
+// output.
+type AuditWriterSink struct {
+	Writer io.Writer
+	mutex  sync.Mutex
+}
+
+func AuditWriterSink_New(writer io.Writer) *AuditWriterSink {
+	return &AuditWriterSink{Writer: writer}
+}
+
+func (self *AuditWriterSink) Write(line []byte) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	_, err := self.Writer.Write(append(line, '\n'))
+
+	return err
+}
+
+func (self *AuditWriterSink) Close() error {
+	return nil
+}
+
+// AuditFileSink appends audit events to a file. The file is opened for
+// every event so that it can be rotated by an external tool.
+type AuditFileSink struct {
+	Path  string
+	mutex sync.Mutex
+}
+
+func AuditFileSink_New(path string) *AuditFileSink {
+	return &AuditFileSink{Path: path}
+}
+
+func (self *AuditFileSink) Write(line []byte) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	file, err := os.OpenFile(self.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+
+	return err
+}
+
+func (self *AuditFileSink) Close() error {
+	return nil
+}
+
+// AuditWebhookSink posts each audit event as a JSON object to a URL. Events
+// are sent in the background so that requests are not delayed by the
+// webhook. When the queue is full, new events are dropped.
+type AuditWebhookSink struct {
+	Url    string
+	Token  string
+	Client *http.Client
+	queue  chan []byte
+	done   chan struct{}
+	once   sync.Once
+}
+
+func AuditWebhookSink_New(url string, token string) *AuditWebhookSink {
+	sink := AuditWebhookSink{}
+	sink.Url = url
+	sink.Token = token
+	sink.Client = &http.Client{Timeout: 10 * time.Second}
+	sink.queue = make(chan []byte, 1000)
+	sink.done = make(chan struct{})
+
+	go sink.run()
+
+	return &sink
+}
+
+func (self *AuditWebhookSink) Write(line []byte) (err error) {
+	// Writing to the queue after Close() panics.
+	defer func() {
+		if recover() != nil {
+			err = errors.New("the webhook sink is closed")
+		}
+	}()
+
+	select {
+	case self.queue <- line:
+		return nil
+	default:
+		return errors.New("the queue of the webhook is full")
+	}
+}
+
+// Close waits until the queued events are sent.
+func (self *AuditWebhookSink) Close() error {
+	self.once.Do(func() { close(self.queue) })
+	<-self.done
+
+	return nil
+}
+
+func (self *AuditWebhookSink) run() {
+	defer close(self.done)
+
+	for line := range self.queue {
+		if err := self.post(line); err != nil {
+			msg := fmt.Sprintf("audit_log: Failed to send an audit event to the webhook: %s", err)
+			log.Warn().Msg(msg)
+		}
+	}
+}
+
+func (self *AuditWebhookSink) post(line []byte) error {
+	request, err := http.NewRequest(`POST`, self.Url, bytes.NewReader(line))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set(`Content-Type`, `application/json`)
+
+	if self.Token != `` {
+		request.Header.Set(`Authorization`, `Bearer `+self.Token)
+	}
+
+	response, err := self.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("the webhook responded with %s", strings.TrimSpace(response.Status))
+	}
+
+	return nil
+}
+
+// AuthleteApi_Audit returns the decorator which records issued and revoked
+// tokens as audit events.
+func AuthleteApi_Audit() AuthleteApiDecorator {
+	return func(ctx *gin.Context) AuthleteApiHook {
+		return (&auditApi{ctx: ctx}).hook
+	}
+}
+
+// auditApi is created per request. It remembers the client of a token
+// request until the token is issued by TokenIssue in the password flow.
+type auditApi struct {
+	ctx      *gin.Context
+	clientId string
+}
+
+func (self *auditApi) hook(call *AuthleteApiCall, next func() (interface{}, *api.AuthleteError)) (interface{}, *api.AuthleteError) {
+	response, err := next()
+
+	switch request := call.Request.(type) {
+	case *dto.TokenRequest:
+		if res, _ := response.(*dto.TokenResponse); res != nil {
+			self.token(request, res)
+		}
+	case *dto.TokenIssueRequest:
+		if res, _ := response.(*dto.TokenIssueResponse); res != nil && res.Action == dto.TokenIssueAction_OK {
+			AuditLog_Get().Record(self.ctx, &AuditEvent{
+				Event:    AuditEvent_TOKEN_ISSUED,
+				Subject:  request.Subject,
+				ClientId: self.clientId,
+				Details:  map[string]string{`grantType`: `password`},
+			})
+		}
+	case *dto.RevocationRequest:
+		if res, _ := response.(*dto.RevocationResponse); res != nil && res.Action == dto.RevocationAction_OK {
+			params, _ := url.ParseQuery(request.Parameters)
+
+			AuditLog_Get().Record(self.ctx, &AuditEvent{
+				Event:    AuditEvent_TOKEN_REVOKED,
+				ClientId: auditClientId(0, request.ClientId, params),
+				Details:  map[string]string{`tokenTypeHint`: params.Get(`token_type_hint`)},
+			})
+		}
+	}
+
+	return response, err
+}
+
+func (self *auditApi) token(request *dto.TokenRequest, res *dto.TokenResponse) {
+	params, _ := url.ParseQuery(request.Parameters)
+
+	self.clientId = auditClientId(res.ClientId, request.ClientId, params)
+
+	if res.Action == dto.TokenAction_OK {
+		AuditLog_Get().Record(self.ctx, &AuditEvent{
+			Event:    AuditEvent_TOKEN_ISSUED,
+			Subject:  res.Subject,
+			ClientId: self.clientId,
+			Details:  map[string]string{`grantType`: params.Get(`grant_type`)},
+		})
+	}
+}
+
+// auditClientId returns the client ID which Authlete reported, or the one
+// presented by the client in the Authorization header or in the parameters
+// when Authlete did not report any.
+func auditClientId(clientId uint64, presented string, params url.Values) string {
+	if clientId != 0 {
+		return strconv.FormatUint(clientId, 10)
+	}
+
+	if presented != `` {
+		return presented
+	}
+
+	return params.Get(`client_id`)
+}
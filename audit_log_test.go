@@ -0,0 +1,128 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testAuditEvents returns a buffer to which audit events are written.
+func testAuditEvents(redact ...string) *bytes.Buffer {
+	buffer := &bytes.Buffer{}
+
+	auditLogInstance.Sinks = []AuditSink{AuditWriterSink_New(buffer)}
+	for _, name := range redact {
+		auditLogInstance.Redact[name] = true
+	}
+
+	return buffer
+}
+
+func parseTestAuditEvents(t *testing.T, buffer *bytes.Buffer) []AuditEvent {
+	t.Helper()
+
+	events := []AuditEvent{}
+
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		event := AuditEvent{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("An audit event is not JSON: %s", line)
+		}
+		events = append(events, event)
+	}
+
+	return events
+}
+
+func TestAuditLogAuthorizationCodeFlow(t *testing.T) {
+	browser := testBrowser_New(t)
+	buffer := testAuditEvents()
+
+	form := browser.authorize(nil)
+	res := browser.submit(form, testDecision(`john`, `wrong`, true))
+	expectError(t, res, `login_required`)
+
+	form = browser.authorize(nil)
+	browser.token(expectCode(t, browser.submit(form, testDecision(`john`, `john`, true))))
+
+	events := parseTestAuditEvents(t, buffer)
+	expected := []string{`login/failure`, `login/success`, `consent/granted`, `token_issued/`}
+
+	if len(events) != len(expected) {
+		t.Fatalf("Unexpected audit events: %s", buffer)
+	}
+
+	for i, event := range events {
+		if event.Event+`/`+event.Result != expected[i] {
+			t.Errorf("The audit event #%d is %s/%s instead of %s.", i, event.Event, event.Result, expected[i])
+		}
+	}
+
+	login, consent, token := events[1], events[2], events[3]
+
+	if login.Subject != `1001` || login.LoginId != `john` || login.Method != Amr_PWD || login.Ip == `` {
+		t.Errorf("Unexpected login event: %+v", login)
+	}
+
+	if login.Ticket == `` || consent.Ticket != login.Ticket || consent.ClientId != `1` {
+		t.Errorf("The consent event is not correlated with the login event: %+v", consent)
+	}
+
+	if token.Subject != `1001` || token.Details[`grantType`] != `authorization_code` {
+		t.Errorf("Unexpected token event: %+v", token)
+	}
+}
+
+func TestAuditLogRedaction(t *testing.T) {
+	browser := testBrowser_New(t)
+	buffer := testAuditEvents(`loginId`, `ip`)
+
+	browser.post(`/api/token`, url.Values{`grant_type`: {`password`}, `username`: {`jane`}, `password`: {`wrong`}})
+
+	events := parseTestAuditEvents(t, buffer)
+	if len(events) != 1 || events[0].Reason != `invalid_credentials` {
+		t.Fatalf("Unexpected audit events: %s", buffer)
+	}
+
+	if strings.Contains(buffer.String(), `jane`) || strings.Contains(buffer.String(), `127.0.0.1`) {
+		t.Errorf("The login ID or the IP address is not redacted: %s", buffer)
+	}
+
+	if events[0].LoginId != auditLogInstance.hash(`jane`) {
+		t.Errorf("The login ID is not replaced with its hash: %s", events[0].LoginId)
+	}
+}
+
+func TestAuditLogRedactionWithoutKey(t *testing.T) {
+	t.Setenv(`AUDIT_LOG_REDACT`, `loginId`)
+	t.Setenv(`AUDIT_LOG_REDACT_KEY`, ``)
+
+	audit := AuditLog_New()
+
+	// An unkeyed hash could be reversed by hashing guesses.
+	if len(audit.RedactKey) == 0 {
+		t.Fatalf("Values are redacted without a key")
+	}
+
+	if audit.hash(`jane`) == AuditLog_New().hash(`jane`) {
+		t.Errorf("The random key is not random")
+	}
+}
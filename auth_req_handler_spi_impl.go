@@ -30,6 +30,12 @@ type AuthReqHandlerSpiImpl struct {
 	session sessions.Session
 	user    *UserEntity
 	tried   bool
+
+	// Preferred languages of claims ('claims_locales').
+	ClaimLocales []string
+
+	// The "verified_claims" element of the 'claims' request parameter.
+	VerifiedClaimsRequest interface{}
 }
 
 func (self *AuthReqHandlerSpiImpl) Init(ctx *gin.Context) {
@@ -39,12 +45,32 @@ func (self *AuthReqHandlerSpiImpl) Init(ctx *gin.Context) {
 
 func (self *AuthReqHandlerSpiImpl) GetUserClaimValue(
 	subject string, claimName string, languageTag string) interface{} {
+	// The authentication methods used when the user logged in (RFC 8176).
+	if claimName == `amr` {
+		return self.session.Get(`amr`)
+	}
+
 	user := self.getUserBySubject(subject)
 
 	if user == nil {
 		return nil
 	}
 
+	// OpenID Connect for Identity Assurance 1.0
+	if claimName == Claim_VERIFIED_CLAIMS {
+		return user.FilterVerifiedClaims(self.VerifiedClaimsRequest)
+	}
+
+	// If no language is specified for the claim, try the preferred
+	// languages in order and then the default value.
+	if languageTag == `` {
+		for _, locale := range self.ClaimLocales {
+			if value := user.GetClaim(claimName, locale); value != nil {
+				return value
+			}
+		}
+	}
+
 	return user.GetClaim(claimName, languageTag)
 }
 
@@ -59,6 +85,27 @@ func (self *AuthReqHandlerSpiImpl) GetUserAuthenticatedAt() uint64 {
 	return authAt
 }
 
+func (self *AuthReqHandlerSpiImpl) GetAcr() string {
+	if self.session.Get(`user`) == nil {
+		return ``
+	}
+
+	// If the authorization request includes 'acr_values' or an 'acr'
+	// claim request, report one of the requested ACRs which the user has
+	// achieved.
+	acrs, _ := getRequestedAcrs(self.session)
+	acr := AcrPolicy_Get().SelectAcr(acrs, getSessionAmr(self.session))
+	if acr != `` {
+		return acr
+	}
+
+	// The strongest ACR which the user has achieved.
+	value := self.session.Get(`acr`)
+	acr, _ = value.(string)
+
+	return acr
+}
+
 func (self *AuthReqHandlerSpiImpl) GetUserSubject() string {
 	value := self.session.Get(`user`)
 
@@ -76,7 +123,7 @@ func (self *AuthReqHandlerSpiImpl) GetUserSubject() string {
 
 func (self *AuthReqHandlerSpiImpl) getUserBySubject(subject string) *UserEntity {
 	if self.tried == false {
-		self.user = UserDatabase_Get().GetBySubject(subject)
+		self.user = UserStore_Of(self.Context).GetBySubject(subject)
 		self.tried = true
 	}
 
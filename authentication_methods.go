@@ -0,0 +1,69 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"github.com/gin-contrib/sessions"
+)
+
+// Values of the "amr" claim (RFC 8176) which this implementation reports.
+const (
+	Amr_PWD = `pwd`
+	Amr_OTP = `otp`
+	Amr_HWK = `hwk`
+
+	// Not registered in RFC 8176. Login by a link sent by email.
+	Amr_EMAIL = `email`
+
+	// Not registered in RFC 8176. Login with an external identity provider
+	// which did not tell how it authenticated the user.
+	Amr_FED = `fed`
+)
+
+// Values of the "acr" claim which this implementation reports. Register
+// them as "Supported ACRs" of the service if clients request them.
+const (
+	Acr_SINGLE_FACTOR = `urn:gin-oauth-server:acr:sfa`
+	Acr_MULTI_FACTOR  = `urn:gin-oauth-server:acr:mfa`
+
+	// Authentication by a passkey with user verification. It is not only
+	// multi-factor but also resistant to phishing.
+	Acr_PHISHING_RESISTANT = `urn:gin-oauth-server:acr:phr`
+)
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func appendAmrClaim(claimNames []string, session sessions.Session) []string {
+	// If no user has logged in or the claim is already included.
+	if session.Get(`amr`) == nil || containsString(claimNames, `amr`) {
+		return claimNames
+	}
+
+	// Copy the names not to modify the array stored in the session.
+	names := make([]string, 0, len(claimNames)+1)
+	names = append(names, claimNames...)
+
+	return append(names, `amr`)
+}
@@ -0,0 +1,217 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"reflect"
+
+	"github.com/authlete/authlete-go/api"
+	"github.com/authlete/authlete-go/dto"
+	"github.com/gin-gonic/gin"
+)
+
+// AuthleteApiCall is a call of one of the Authlete APIs which this server
+// uses.
+type AuthleteApiCall struct {
+	// Name of the method of api.AuthleteApi, e.g. "Token"
+	Name string
+
+	// The request, e.g. *dto.TokenRequest, or *AuthleteServiceRequest for
+	// GetServiceJwks and GetServiceConfiguration
+	Request interface{}
+}
+
+// AuthleteServiceRequest holds the arguments of GetServiceJwks and
+// GetServiceConfiguration.
+type AuthleteServiceRequest struct {
+	Pretty             bool `json:"pretty"`
+	IncludePrivateKeys bool `json:"includePrivateKeys,omitempty"`
+}
+
+// AuthleteApiHook is called instead of the API. It makes the call with
+// 'next', which returns the response, e.g. *dto.TokenResponse, or a string
+// for GetServiceJwks and GetServiceConfiguration. A hook may also return
+// without calling 'next', or call it more than once.
+type AuthleteApiHook func(call *AuthleteApiCall, next func() (interface{}, *api.AuthleteError)) (interface{}, *api.AuthleteError)
+
+// AuthleteApiDecorator creates the hook for a request to this server.
+type AuthleteApiDecorator func(ctx *gin.Context) AuthleteApiHook
+
+// AuthleteApi_Decorate returns middleware which replaces the instance of
+// api.AuthleteApi in gin contexts with one which passes the calls through
+// the hooks of the decorators. The first decorator is the closest to
+// Authlete. It has to be registered after the middleware which sets the
+// instance.
+func AuthleteApi_Decorate(decorators ...AuthleteApiDecorator) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		value, exists := ctx.Get(`AuthleteApi`)
+		if instance, _ := value.(api.AuthleteApi); exists && instance != nil {
+			for _, decorator := range decorators {
+				instance = decorateAuthleteApi(instance, decorator(ctx))
+			}
+			ctx.Set(`AuthleteApi`, instance)
+		}
+
+		ctx.Next()
+	}
+}
+
+func decorateAuthleteApi(instance api.AuthleteApi, hook AuthleteApiHook) api.AuthleteApi {
+	return &decoratedApi{AuthleteApi: instance, hook: hook}
+}
+
+// authleteApiAction returns the action of the response, e.g. "OK", or an
+// empty string if the response does not have any.
+func authleteApiAction(response interface{}) string {
+	value := reflect.ValueOf(response)
+	if value.Kind() != reflect.Pointer || value.IsNil() {
+		return ``
+	}
+
+	action := value.Elem().FieldByName(`Action`)
+	if action.Kind() != reflect.String {
+		return ``
+	}
+
+	return action.String()
+}
+
+// decoratedApi passes the calls of the APIs which this server uses through
+// the hook. Calls of other APIs are passed to the instance as they are.
+type decoratedApi struct {
+	api.AuthleteApi
+	hook AuthleteApiHook
+}
+
+func (self *decoratedApi) Authorization(request *dto.AuthorizationRequest) (*dto.AuthorizationResponse, *api.AuthleteError) {
+	response, err := self.hook(&AuthleteApiCall{Name: `Authorization`, Request: request}, func() (interface{}, *api.AuthleteError) {
+		return self.AuthleteApi.Authorization(request)
+	})
+	res, _ := response.(*dto.AuthorizationResponse)
+
+	return res, err
+}
+
+func (self *decoratedApi) AuthorizationIssue(request *dto.AuthorizationIssueRequest) (*dto.AuthorizationIssueResponse, *api.AuthleteError) {
+	response, err := self.hook(&AuthleteApiCall{Name: `AuthorizationIssue`, Request: request}, func() (interface{}, *api.AuthleteError) {
+		return self.AuthleteApi.AuthorizationIssue(request)
+	})
+	res, _ := response.(*dto.AuthorizationIssueResponse)
+
+	return res, err
+}
+
+func (self *decoratedApi) AuthorizationFail(request *dto.AuthorizationFailRequest) (*dto.AuthorizationFailResponse, *api.AuthleteError) {
+	response, err := self.hook(&AuthleteApiCall{Name: `AuthorizationFail`, Request: request}, func() (interface{}, *api.AuthleteError) {
+		return self.AuthleteApi.AuthorizationFail(request)
+	})
+	res, _ := response.(*dto.AuthorizationFailResponse)
+
+	return res, err
+}
+
+func (self *decoratedApi) Token(request *dto.TokenRequest) (*dto.TokenResponse, *api.AuthleteError) {
+	response, err := self.hook(&AuthleteApiCall{Name: `Token`, Request: request}, func() (interface{}, *api.AuthleteError) {
+		return self.AuthleteApi.Token(request)
+	})
+	res, _ := response.(*dto.TokenResponse)
+
+	return res, err
+}
+
+func (self *decoratedApi) TokenIssue(request *dto.TokenIssueRequest) (*dto.TokenIssueResponse, *api.AuthleteError) {
+	response, err := self.hook(&AuthleteApiCall{Name: `TokenIssue`, Request: request}, func() (interface{}, *api.AuthleteError) {
+		return self.AuthleteApi.TokenIssue(request)
+	})
+	res, _ := response.(*dto.TokenIssueResponse)
+
+	return res, err
+}
+
+func (self *decoratedApi) TokenFail(request *dto.TokenFailRequest) (*dto.TokenFailResponse, *api.AuthleteError) {
+	response, err := self.hook(&AuthleteApiCall{Name: `TokenFail`, Request: request}, func() (interface{}, *api.AuthleteError) {
+		return self.AuthleteApi.TokenFail(request)
+	})
+	res, _ := response.(*dto.TokenFailResponse)
+
+	return res, err
+}
+
+func (self *decoratedApi) Introspection(request *dto.IntrospectionRequest) (*dto.IntrospectionResponse, *api.AuthleteError) {
+	response, err := self.hook(&AuthleteApiCall{Name: `Introspection`, Request: request}, func() (interface{}, *api.AuthleteError) {
+		return self.AuthleteApi.Introspection(request)
+	})
+	res, _ := response.(*dto.IntrospectionResponse)
+
+	return res, err
+}
+
+func (self *decoratedApi) StandardIntrospection(request *dto.StandardIntrospectionRequest) (*dto.StandardIntrospectionResponse, *api.AuthleteError) {
+	response, err := self.hook(&AuthleteApiCall{Name: `StandardIntrospection`, Request: request}, func() (interface{}, *api.AuthleteError) {
+		return self.AuthleteApi.StandardIntrospection(request)
+	})
+	res, _ := response.(*dto.StandardIntrospectionResponse)
+
+	return res, err
+}
+
+func (self *decoratedApi) Revocation(request *dto.RevocationRequest) (*dto.RevocationResponse, *api.AuthleteError) {
+	response, err := self.hook(&AuthleteApiCall{Name: `Revocation`, Request: request}, func() (interface{}, *api.AuthleteError) {
+		return self.AuthleteApi.Revocation(request)
+	})
+	res, _ := response.(*dto.RevocationResponse)
+
+	return res, err
+}
+
+func (self *decoratedApi) UserInfo(request *dto.UserInfoRequest) (*dto.UserInfoResponse, *api.AuthleteError) {
+	response, err := self.hook(&AuthleteApiCall{Name: `UserInfo`, Request: request}, func() (interface{}, *api.AuthleteError) {
+		return self.AuthleteApi.UserInfo(request)
+	})
+	res, _ := response.(*dto.UserInfoResponse)
+
+	return res, err
+}
+
+func (self *decoratedApi) UserInfoIssue(request *dto.UserInfoIssueRequest) (*dto.UserInfoIssueResponse, *api.AuthleteError) {
+	response, err := self.hook(&AuthleteApiCall{Name: `UserInfoIssue`, Request: request}, func() (interface{}, *api.AuthleteError) {
+		return self.AuthleteApi.UserInfoIssue(request)
+	})
+	res, _ := response.(*dto.UserInfoIssueResponse)
+
+	return res, err
+}
+
+func (self *decoratedApi) GetServiceJwks(pretty bool, includePrivateKeys bool) (string, *api.AuthleteError) {
+	request := &AuthleteServiceRequest{Pretty: pretty, IncludePrivateKeys: includePrivateKeys}
+	response, err := self.hook(&AuthleteApiCall{Name: `GetServiceJwks`, Request: request}, func() (interface{}, *api.AuthleteError) {
+		return self.AuthleteApi.GetServiceJwks(pretty, includePrivateKeys)
+	})
+	jwks, _ := response.(string)
+
+	return jwks, err
+}
+
+func (self *decoratedApi) GetServiceConfiguration(pretty bool) (string, *api.AuthleteError) {
+	request := &AuthleteServiceRequest{Pretty: pretty}
+	response, err := self.hook(&AuthleteApiCall{Name: `GetServiceConfiguration`, Request: request}, func() (interface{}, *api.AuthleteError) {
+		return self.AuthleteApi.GetServiceConfiguration(pretty)
+	})
+	configuration, _ := response.(string)
+
+	return configuration, err
+}
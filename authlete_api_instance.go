@@ -0,0 +1,33 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"github.com/authlete/authlete-go/api"
+	"github.com/gin-gonic/gin"
+)
+
+// AuthleteApi_Instance returns middleware which sets the given instance of
+// api.AuthleteApi to gin contexts with the key `AuthleteApi`, in the same
+// way as middleware.AuthleteApi_Toml() and others do. It is used to inject
+// FakeAuthleteApi in tests.
+func AuthleteApi_Instance(instance api.AuthleteApi) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Set(`AuthleteApi`, instance)
+		ctx.Next()
+	}
+}
@@ -0,0 +1,269 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/authlete/authlete-go/api"
+	"github.com/authlete/authlete-go/dto"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const redactedValue = `REDACTED`
+
+var (
+	// Names of request parameters, JSON properties and form fields whose
+	// values are replaced with "REDACTED" in recordings.
+	redactedNames = map[string]bool{
+		`access_token`:      true,
+		`accessToken`:       true,
+		`apiSecret`:         true,
+		`authorizationCode`: true,
+		`client_assertion`:  true,
+		`client_secret`:     true,
+		`clientSecret`:      true,
+		`code`:              true,
+		`code_verifier`:     true,
+		`id_token`:          true,
+		`idToken`:           true,
+		`jwtAccessToken`:    true,
+		`password`:          true,
+		`refresh_token`:     true,
+		`refreshToken`:      true,
+		`ticket`:            true,
+		`token`:             true,
+	}
+
+	// Private members of JWKs (RFC 7518, 6.2.2, 6.3.2 and 6.4.1)
+	redactedJwkNames = map[string]bool{
+		`d`: true, `p`: true, `q`: true, `dp`: true, `dq`: true, `qi`: true, `k`: true,
+	}
+
+	// Hidden fields of the HTML forms of response_mode=form_post
+	redactedInputPattern = regexp.MustCompile(
+		`(<input[^>]*name="(?:code|access_token|id_token|refresh_token)"[^>]*value=")[^"]*`)
+)
+
+// AuthleteApiRecording is an exchange with Authlete. Recordings are written
+// to a file as JSON Lines.
+type AuthleteApiRecording struct {
+	Time     time.Time                  `json:"time"`
+	Method   string                     `json:"method"`
+	Request  json.RawMessage            `json:"request,omitempty"`
+	Response json.RawMessage            `json:"response,omitempty"`
+	Error    *AuthleteApiRecordingError `json:"error,omitempty"`
+}
+
+type AuthleteApiRecordingError struct {
+	StatusCode int              `json:"statusCode,omitempty"`
+	Cause      string           `json:"cause,omitempty"`
+	Response   *dto.ApiResponse `json:"response,omitempty"`
+}
+
+// AuthleteApiRecordingFile is a file to which recordings are appended.
+type AuthleteApiRecordingFile struct {
+	Path  string
+	mutex sync.Mutex
+}
+
+func AuthleteApiRecordingFile_New(path string) *AuthleteApiRecordingFile {
+	file := AuthleteApiRecordingFile{}
+	file.Path = path
+
+	return &file
+}
+
+func (self *AuthleteApiRecordingFile) Write(recording *AuthleteApiRecording) error {
+	bytes, err := json.Marshal(recording)
+	if err != nil {
+		return err
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	file, err := os.OpenFile(self.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.WriteString(file, string(bytes)+"\n")
+
+	return err
+}
+
+// AuthleteApi_Record returns the decorator which records the exchanges with
+// Authlete to the file.
+func AuthleteApi_Record(path string) AuthleteApiDecorator {
+	recorder := &AuthleteApiRecorder{File: AuthleteApiRecordingFile_New(path)}
+
+	return func(*gin.Context) AuthleteApiHook {
+		return recorder.hook
+	}
+}
+
+// AuthleteApiRecorder records the requests to the APIs which this server
+// uses and the responses from them. Secrets such as client secrets,
+// passwords and tokens are redacted.
+type AuthleteApiRecorder struct {
+	File *AuthleteApiRecordingFile
+}
+
+func (self *AuthleteApiRecorder) hook(call *AuthleteApiCall, next func() (interface{}, *api.AuthleteError)) (interface{}, *api.AuthleteError) {
+	response, err := next()
+
+	if call.Name != `GetServiceJwks` {
+		self.record(call.Name, call.Request, response, err)
+		return response, err
+	}
+
+	// Private keys are redacted as well.
+	names := map[string]bool{}
+	for name := range redactedNames {
+		names[name] = true
+	}
+	for name := range redactedJwkNames {
+		names[name] = true
+	}
+
+	self.recordWithNames(call.Name, call.Request, response, err, names)
+
+	return response, err
+}
+
+func (self *AuthleteApiRecorder) record(method string, request interface{}, response interface{}, err *api.AuthleteError) {
+	self.recordWithNames(method, request, response, err, redactedNames)
+}
+
+func (self *AuthleteApiRecorder) recordWithNames(method string, request interface{}, response interface{},
+	err *api.AuthleteError, names map[string]bool) {
+	recording := AuthleteApiRecording{}
+	recording.Time = time.Now().UTC()
+	recording.Method = method
+	recording.Request = redactJson(request, names)
+
+	if err == nil {
+		recording.Response = redactJson(response, names)
+	} else {
+		recording.Error = &AuthleteApiRecordingError{StatusCode: err.StatusCode, Response: err.Response}
+		if err.Cause != nil {
+			recording.Error.Cause = err.Cause.Error()
+		}
+	}
+
+	if e := self.File.Write(&recording); e != nil {
+		msg := fmt.Sprintf("authlete_api_recorder: Failed to record a call of %s: %s", method, e)
+		log.Warn().Msg(msg)
+	}
+}
+
+// redactJson converts the value into JSON in which the values of the given
+// names are redacted.
+func redactJson(value interface{}, names map[string]bool) json.RawMessage {
+	bytes, _ := json.Marshal(value)
+
+	var generic interface{}
+	if json.Unmarshal(bytes, &generic) != nil {
+		return bytes
+	}
+
+	bytes, _ = json.Marshal(redactValue(generic, names))
+
+	return bytes
+}
+
+func redactValue(value interface{}, names map[string]bool) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, member := range value {
+			switch {
+			case names[name] && member != nil && member != ``:
+				value[name] = redactedValue
+			case name == `parameters`:
+				// Parameters of the request to this server in the form format.
+				value[name] = redactForm(member, names)
+			default:
+				value[name] = redactValue(member, names)
+			}
+		}
+	case []interface{}:
+		for i, element := range value {
+			value[i] = redactValue(element, names)
+		}
+	case string:
+		return redactString(value, names)
+	}
+
+	return value
+}
+
+// redactString redacts secrets in strings such as 'responseContent', which
+// may be JSON, a URL with parameters or an HTML form.
+func redactString(value string, names map[string]bool) string {
+	trimmed := strings.TrimSpace(value)
+
+	if strings.HasPrefix(trimmed, `{`) || strings.HasPrefix(trimmed, `[`) {
+		var generic interface{}
+		if json.Unmarshal([]byte(trimmed), &generic) == nil {
+			bytes, _ := json.Marshal(redactValue(generic, names))
+			return string(bytes)
+		}
+	}
+
+	if strings.Contains(value, `<input`) {
+		return redactedInputPattern.ReplaceAllString(value, `${1}`+redactedValue)
+	}
+
+	if location, err := url.Parse(trimmed); err == nil && location.Scheme != `` && location.Host != `` {
+		location.RawQuery = redactForm(location.RawQuery, names).(string)
+		location.Fragment = redactForm(location.Fragment, names).(string)
+		return location.String()
+	}
+
+	return value
+}
+
+func redactForm(value interface{}, names map[string]bool) interface{} {
+	form, _ := value.(string)
+	if form == `` {
+		return value
+	}
+
+	params, err := url.ParseQuery(form)
+	if err != nil {
+		return value
+	}
+
+	for name := range params {
+		if names[name] {
+			params.Set(name, redactedValue)
+		}
+	}
+
+	return params.Encode()
+}
@@ -0,0 +1,251 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/authlete/authlete-go/api"
+	"github.com/authlete/authlete-go/dto"
+)
+
+// AuthleteApiReplayer serves recordings made by AuthleteApiRecorder as the
+// responses from Authlete so that exchanges can be reproduced without
+// Authlete. Calls of each API get its recorded responses in the recorded
+// order regardless of the requests, whose secrets have been redacted. When
+// the recordings of an API run out, an error is returned.
+//
+// Methods of api.AuthleteApi which AuthleteApiRecorder does not record
+// panic.
+type AuthleteApiReplayer struct {
+	api.AuthleteApi
+
+	recordings map[string][]*AuthleteApiRecording
+	mutex      sync.Mutex
+}
+
+func AuthleteApiReplayer_New(recordings []*AuthleteApiRecording) *AuthleteApiReplayer {
+	replayer := AuthleteApiReplayer{}
+	replayer.recordings = map[string][]*AuthleteApiRecording{}
+
+	for _, recording := range recordings {
+		replayer.recordings[recording.Method] = append(replayer.recordings[recording.Method], recording)
+	}
+
+	return &replayer
+}
+
+// AuthleteApiReplayer_Load reads recordings from a file written by
+// AuthleteApiRecorder.
+func AuthleteApiReplayer_Load(path string) (*AuthleteApiReplayer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	recordings := []*AuthleteApiRecording{}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		recording := AuthleteApiRecording{}
+		if err := json.Unmarshal(scanner.Bytes(), &recording); err != nil {
+			return nil, fmt.Errorf("line %d of %s: %w", line, path, err)
+		}
+
+		recordings = append(recordings, &recording)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return AuthleteApiReplayer_New(recordings), nil
+}
+
+// Remaining returns the number of recordings which have not been replayed.
+func (self *AuthleteApiReplayer) Remaining() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	count := 0
+	for _, recordings := range self.recordings {
+		count += len(recordings)
+	}
+
+	return count
+}
+
+// replay sets the next recorded response of the method to 'response' or
+// returns the recorded error.
+func (self *AuthleteApiReplayer) replay(method string, response interface{}) *api.AuthleteError {
+	self.mutex.Lock()
+	recordings := self.recordings[method]
+	if len(recordings) != 0 {
+		self.recordings[method] = recordings[1:]
+	}
+	self.mutex.Unlock()
+
+	if len(recordings) == 0 {
+		cause := fmt.Errorf("no recording of %s is left", method)
+		return &api.AuthleteError{Cause: cause}
+	}
+
+	recording := recordings[0]
+
+	if recording.Error != nil {
+		err := api.AuthleteError{StatusCode: recording.Error.StatusCode, Response: recording.Error.Response}
+		if recording.Error.Cause != `` {
+			err.Cause = errors.New(recording.Error.Cause)
+		}
+		return &err
+	}
+
+	if err := json.Unmarshal(recording.Response, response); err != nil {
+		return &api.AuthleteError{Cause: err}
+	}
+
+	return nil
+}
+
+func (self *AuthleteApiReplayer) Authorization(request *dto.AuthorizationRequest) (*dto.AuthorizationResponse, *api.AuthleteError) {
+	res := dto.AuthorizationResponse{}
+	if err := self.replay(`Authorization`, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (self *AuthleteApiReplayer) AuthorizationIssue(request *dto.AuthorizationIssueRequest) (*dto.AuthorizationIssueResponse, *api.AuthleteError) {
+	res := dto.AuthorizationIssueResponse{}
+	if err := self.replay(`AuthorizationIssue`, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (self *AuthleteApiReplayer) AuthorizationFail(request *dto.AuthorizationFailRequest) (*dto.AuthorizationFailResponse, *api.AuthleteError) {
+	res := dto.AuthorizationFailResponse{}
+	if err := self.replay(`AuthorizationFail`, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (self *AuthleteApiReplayer) Token(request *dto.TokenRequest) (*dto.TokenResponse, *api.AuthleteError) {
+	res := dto.TokenResponse{}
+	if err := self.replay(`Token`, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (self *AuthleteApiReplayer) TokenIssue(request *dto.TokenIssueRequest) (*dto.TokenIssueResponse, *api.AuthleteError) {
+	res := dto.TokenIssueResponse{}
+	if err := self.replay(`TokenIssue`, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (self *AuthleteApiReplayer) TokenFail(request *dto.TokenFailRequest) (*dto.TokenFailResponse, *api.AuthleteError) {
+	res := dto.TokenFailResponse{}
+	if err := self.replay(`TokenFail`, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (self *AuthleteApiReplayer) Introspection(request *dto.IntrospectionRequest) (*dto.IntrospectionResponse, *api.AuthleteError) {
+	res := dto.IntrospectionResponse{}
+	if err := self.replay(`Introspection`, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (self *AuthleteApiReplayer) StandardIntrospection(request *dto.StandardIntrospectionRequest) (*dto.StandardIntrospectionResponse, *api.AuthleteError) {
+	res := dto.StandardIntrospectionResponse{}
+	if err := self.replay(`StandardIntrospection`, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (self *AuthleteApiReplayer) Revocation(request *dto.RevocationRequest) (*dto.RevocationResponse, *api.AuthleteError) {
+	res := dto.RevocationResponse{}
+	if err := self.replay(`Revocation`, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (self *AuthleteApiReplayer) UserInfo(request *dto.UserInfoRequest) (*dto.UserInfoResponse, *api.AuthleteError) {
+	res := dto.UserInfoResponse{}
+	if err := self.replay(`UserInfo`, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (self *AuthleteApiReplayer) UserInfoIssue(request *dto.UserInfoIssueRequest) (*dto.UserInfoIssueResponse, *api.AuthleteError) {
+	res := dto.UserInfoIssueResponse{}
+	if err := self.replay(`UserInfoIssue`, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (self *AuthleteApiReplayer) GetServiceJwks(pretty bool, includePrivateKeys bool) (string, *api.AuthleteError) {
+	jwks := ``
+	if err := self.replay(`GetServiceJwks`, &jwks); err != nil {
+		return ``, err
+	}
+
+	return jwks, nil
+}
+
+func (self *AuthleteApiReplayer) GetServiceConfiguration(pretty bool) (string, *api.AuthleteError) {
+	configuration := ``
+	if err := self.replay(`GetServiceConfiguration`, &configuration); err != nil {
+		return ``, err
+	}
+
+	return configuration, nil
+}
@@ -0,0 +1,421 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/authlete/authlete-go/api"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrAuthleteUnavailable = errors.New("Authlete is unavailable")
+)
+
+// AuthleteApiPolicy tells how calls of Authlete APIs are made.
+type AuthleteApiPolicy struct {
+	// Time to wait for the response of a call.
+	Timeout time.Duration
+
+	// Timeouts of specific APIs, e.g. "Introspection".
+	Timeouts map[string]time.Duration
+
+	// Number of retries of safe calls which failed transiently.
+	Retries int
+
+	// Delay before the first retry. It doubles with every further retry up
+	// to MaxBackoff, and a random part of it is used.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+func AuthleteApiPolicy_New() *AuthleteApiPolicy {
+	policy := AuthleteApiPolicy{}
+	policy.Timeout = getConfigurationSeconds(`AUTHLETE_API_TIMEOUT`, 10)
+	policy.Timeouts = map[string]time.Duration{}
+	policy.Backoff = 100 * time.Millisecond
+	policy.MaxBackoff = 2 * time.Second
+
+	policy.Retries = getConfigurationNumber(`AUTHLETE_API_RETRIES`, 2, 0)
+
+	// Comma-separated list of "API=seconds", e.g. "Introspection=2".
+	for _, entry := range getConfigurationList(`AUTHLETE_API_TIMEOUTS`, ``) {
+		name, value, _ := strings.Cut(entry, `=`)
+		seconds, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			msg := fmt.Sprintf("authlete_api_resilience: The timeout '%s' is ignored.", entry)
+			log.Warn().Msg(msg)
+			continue
+		}
+		policy.Timeouts[strings.TrimSpace(name)] = time.Duration(seconds) * time.Second
+	}
+
+	return &policy
+}
+
+func (self *AuthleteApiPolicy) timeout(name string) time.Duration {
+	if timeout, ok := self.Timeouts[name]; ok {
+		return timeout
+	}
+
+	return self.Timeout
+}
+
+// backoff returns the delay before the retry. Full jitter is used so that
+// retries of many requests do not hit Authlete at the same time.
+func (self *AuthleteApiPolicy) backoff(retry int) time.Duration {
+	delay := self.Backoff
+	for i := 0; i < retry && delay < self.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > self.MaxBackoff {
+		delay = self.MaxBackoff
+	}
+
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+const (
+	CircuitState_CLOSED    = `closed`
+	CircuitState_OPEN      = `open`
+	CircuitState_HALF_OPEN = `half_open`
+)
+
+// CircuitBreaker stops calling Authlete after consecutive transient
+// failures. While it is open, calls fail immediately. After the cooldown,
+// one call is let through, and the result of it closes or opens the breaker
+// again.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mutex    sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+func CircuitBreaker_New() *CircuitBreaker {
+	breaker := CircuitBreaker{}
+	breaker.Threshold = getConfigurationNumber(`AUTHLETE_API_BREAKER_THRESHOLD`, 5, 1)
+	breaker.Cooldown = getConfigurationSeconds(`AUTHLETE_API_BREAKER_COOLDOWN`, 30)
+	breaker.state = CircuitState_CLOSED
+
+	return &breaker
+}
+
+// Allow tells whether a call can be made now.
+func (self *CircuitBreaker) Allow() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	switch self.state {
+	case CircuitState_OPEN:
+		if time.Since(self.openedAt) < self.Cooldown {
+			return false
+		}
+		// Let one call through to see if Authlete has recovered.
+		self.state = CircuitState_HALF_OPEN
+		return true
+	case CircuitState_HALF_OPEN:
+		return false
+	default:
+		return true
+	}
+}
+
+// IsOpen tells whether Allow would reject a call now, i.e. the breaker is
+// open and cooling down, or the call which probes Authlete is in progress.
+func (self *CircuitBreaker) IsOpen() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	switch self.state {
+	case CircuitState_OPEN:
+		return time.Since(self.openedAt) < self.Cooldown
+	case CircuitState_HALF_OPEN:
+		return true
+	default:
+		return false
+	}
+}
+
+// RetryAfter returns the time until the breaker lets a call through. It is
+// zero while the probe is in progress.
+func (self *CircuitBreaker) RetryAfter() time.Duration {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.state != CircuitState_OPEN {
+		return 0
+	}
+
+	if remaining := self.Cooldown - time.Since(self.openedAt); remaining > 0 {
+		return remaining
+	}
+
+	return 0
+}
+
+// Record records the result of a call. Only transient failures count.
+func (self *CircuitBreaker) Record(failed bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if failed == false {
+		if self.state != CircuitState_CLOSED {
+			msg := "authlete_api_resilience: Authlete has recovered. The circuit breaker is closed."
+			log.Warn().Msg(msg)
+		}
+		self.state = CircuitState_CLOSED
+		self.failures = 0
+		return
+	}
+
+	self.failures++
+
+	if self.state == CircuitState_HALF_OPEN || self.failures >= self.Threshold {
+		if self.state != CircuitState_OPEN {
+			msg := fmt.Sprintf("authlete_api_resilience: The circuit breaker is open after %d failures.", self.failures)
+			log.Warn().Msg(msg)
+		}
+		self.state = CircuitState_OPEN
+		self.openedAt = time.Now()
+	}
+}
+
+// isTransientAuthleteError tells whether the call may succeed if it is made
+// again: network errors, timeouts, 429 and 5xx.
+func isTransientAuthleteError(err *api.AuthleteError) bool {
+	if err == nil {
+		return false
+	}
+
+	return err.StatusCode == 0 || err.StatusCode == 429 || err.StatusCode >= 500
+}
+
+// AuthleteApi_Resilience returns the decorator which applies timeouts,
+// retries and the circuit breaker to the calls.
+func AuthleteApi_Resilience(policy *AuthleteApiPolicy, breaker *CircuitBreaker) AuthleteApiDecorator {
+	resilience := &resilientApi{policy: policy, breaker: breaker}
+
+	return func(ctx *gin.Context) AuthleteApiHook {
+		return func(call *AuthleteApiCall, next func() (interface{}, *api.AuthleteError)) (interface{}, *api.AuthleteError) {
+			value, err := resilience.hook(call, next)
+
+			// Tell AuthleteAvailability_Handler to respond as it does
+			// while the breaker is open.
+			if err != nil && err.Cause == ErrAuthleteUnavailable {
+				ctx.Set(`authleteUnavailable`, true)
+			}
+
+			return value, err
+		}
+	}
+}
+
+// AuthleteAvailability_Handler returns middleware which rejects requests
+// to endpoints which depend on Authlete while the circuit breaker is open.
+// Browsers get an error page, and other clients get an OAuth error. When
+// the breaker rejects a call made by the endpoint, e.g. because it has
+// opened during the request, the response of the endpoint is replaced with
+// the same one.
+func AuthleteAvailability_Handler(breaker *CircuitBreaker) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if breaker.IsOpen() {
+			msg := fmt.Sprintf("authlete_api_resilience: The request to %s was rejected because Authlete is unavailable.", ctx.FullPath())
+			log.Debug().Msg(msg)
+
+			respondAuthleteUnavailable(ctx, breaker)
+			ctx.Abort()
+			return
+		}
+
+		writer := &authleteAvailabilityWriter{ResponseWriter: ctx.Writer, ctx: ctx, breaker: breaker}
+		ctx.Writer = writer
+		ctx.Next()
+
+		// The endpoint has not responded to the failure.
+		if writer.Written() == false {
+			writer.replace()
+		}
+
+		ctx.Writer = writer.ResponseWriter
+	}
+}
+
+func respondAuthleteUnavailable(ctx *gin.Context, breaker *CircuitBreaker) {
+	seconds := int(breaker.RetryAfter().Seconds()) + 1
+	ctx.Header(`Retry-After`, strconv.Itoa(seconds))
+
+	if ctx.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML {
+		renderMessagePage(ctx, 503, `Service Unavailable`,
+			`The service is temporarily unavailable. Please try again later.`)
+	} else {
+		ctx.JSON(503, gin.H{
+			"error":             "temporarily_unavailable",
+			"error_description": "The authorization server is temporarily unavailable.",
+		})
+	}
+}
+
+// authleteAvailabilityWriter discards the response of the endpoint and
+// responds as AuthleteAvailability_Handler does once the circuit breaker
+// has rejected a call made by the endpoint.
+type authleteAvailabilityWriter struct {
+	gin.ResponseWriter
+	ctx      *gin.Context
+	breaker  *CircuitBreaker
+	replaced bool
+}
+
+// replace responds to the rejection if any, and returns true if the
+// response of the endpoint has to be discarded.
+func (self *authleteAvailabilityWriter) replace() bool {
+	if self.replaced {
+		return true
+	}
+
+	if self.ctx.GetBool(`authleteUnavailable`) == false {
+		return false
+	}
+
+	msg := fmt.Sprintf("authlete_api_resilience: The response of %s was replaced because Authlete is unavailable.", self.ctx.FullPath())
+	log.Debug().Msg(msg)
+
+	self.replaced = true
+
+	// Headers of the response of the endpoint
+	header := self.ResponseWriter.Header()
+	header.Del(`Content-Type`)
+	header.Del(`Location`)
+	header.Del(`WWW-Authenticate`)
+
+	writer := self.ctx.Writer
+	self.ctx.Writer = self.ResponseWriter
+	respondAuthleteUnavailable(self.ctx, self.breaker)
+	self.ctx.Writer = writer
+
+	return true
+}
+
+func (self *authleteAvailabilityWriter) WriteHeader(code int) {
+	if self.replace() == false {
+		self.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (self *authleteAvailabilityWriter) WriteHeaderNow() {
+	if self.replace() == false {
+		self.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (self *authleteAvailabilityWriter) Write(data []byte) (int, error) {
+	if self.replace() {
+		return len(data), nil
+	}
+
+	return self.ResponseWriter.Write(data)
+}
+
+func (self *authleteAvailabilityWriter) WriteString(data string) (int, error) {
+	if self.replace() {
+		return len(data), nil
+	}
+
+	return self.ResponseWriter.WriteString(data)
+}
+
+// Calls which do not change anything at Authlete, and so can be retried
+var safeAuthleteApis = map[string]bool{
+	`Introspection`:           true,
+	`StandardIntrospection`:   true,
+	`GetServiceJwks`:          true,
+	`GetServiceConfiguration`: true,
+}
+
+// resilientApi applies the policy and the circuit breaker to the calls of
+// the APIs which this server uses. Only safe calls are retried.
+type resilientApi struct {
+	policy  *AuthleteApiPolicy
+	breaker *CircuitBreaker
+}
+
+// hook makes the call with the policy and returns the result of the last
+// attempt.
+func (self *resilientApi) hook(call *AuthleteApiCall, next func() (interface{}, *api.AuthleteError)) (interface{}, *api.AuthleteError) {
+	retries := 0
+	if safeAuthleteApis[call.Name] {
+		retries = self.policy.Retries
+	}
+
+	for attempt := 0; ; attempt++ {
+		if self.breaker.Allow() == false {
+			return nil, &api.AuthleteError{Cause: ErrAuthleteUnavailable}
+		}
+
+		value, err := self.callWithTimeout(call.Name, next)
+		transient := isTransientAuthleteError(err)
+		self.breaker.Record(transient)
+
+		if transient == false || attempt >= retries {
+			return value, err
+		}
+
+		msg := fmt.Sprintf("authlete_api_resilience: Retrying %s after a transient failure (status %d).", call.Name, err.StatusCode)
+		log.Debug().Msg(msg)
+
+		time.Sleep(self.policy.backoff(attempt))
+	}
+}
+
+// callWithTimeout waits for the call for up to the timeout of the API. The
+// client of Authlete does not accept a context, so a call which timed out
+// keeps running in the background and its result is discarded. Every
+// attempt has its own channel so that the result of an attempt which timed
+// out cannot be mistaken for that of the retry.
+func (self *resilientApi) callWithTimeout(name string, fn func() (interface{}, *api.AuthleteError)) (interface{}, *api.AuthleteError) {
+	type result struct {
+		value interface{}
+		err   *api.AuthleteError
+	}
+
+	timeout := self.policy.timeout(name)
+	done := make(chan result, 1)
+
+	go func() {
+		value, err := fn()
+		done <- result{value, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-time.After(timeout):
+		return nil, &api.AuthleteError{Cause: fmt.Errorf("%s timed out after %s", name, timeout)}
+	}
+}
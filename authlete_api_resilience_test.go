@@ -0,0 +1,264 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/authlete/authlete-go/api"
+	"github.com/authlete/authlete-go/dto"
+)
+
+func testResilientApi(instance api.AuthleteApi, threshold int) (api.AuthleteApi, *resilientApi) {
+	policy := &AuthleteApiPolicy{
+		Timeout:    time.Second,
+		Timeouts:   map[string]time.Duration{},
+		Retries:    2,
+		Backoff:    time.Millisecond,
+		MaxBackoff: 5 * time.Millisecond,
+	}
+
+	breaker := &CircuitBreaker{Threshold: threshold, Cooldown: time.Minute, state: CircuitState_CLOSED}
+
+	resilient := &resilientApi{policy: policy, breaker: breaker}
+
+	return decorateAuthleteApi(instance, resilient.hook), resilient
+}
+
+func TestResilienceRetriesSafeCalls(t *testing.T) {
+	calls := int32(0)
+
+	fake := FakeAuthleteApi_New()
+	fake.GetServiceJwksFunc = func(bool, bool) (string, *api.AuthleteError) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			return ``, &api.AuthleteError{StatusCode: 503}
+		}
+		return `{"keys":[]}`, nil
+	}
+
+	instance, _ := testResilientApi(fake, 5)
+	jwks, err := instance.GetServiceJwks(false, false)
+	if err != nil || jwks != `{"keys":[]}` {
+		t.Fatalf("The call failed after retries: %v", err)
+	}
+
+	if calls != 3 {
+		t.Errorf("GetServiceJwks was called %d times, not 3", calls)
+	}
+}
+
+func TestResilienceDoesNotRetryUnsafeCalls(t *testing.T) {
+	calls := int32(0)
+
+	fake := FakeAuthleteApi_New()
+	fake.TokenFunc = func(*dto.TokenRequest) (*dto.TokenResponse, *api.AuthleteError) {
+		atomic.AddInt32(&calls, 1)
+		return nil, &api.AuthleteError{StatusCode: 502}
+	}
+
+	instance, _ := testResilientApi(fake, 5)
+	if _, err := instance.Token(&dto.TokenRequest{}); err == nil || err.StatusCode != 502 {
+		t.Fatalf("The error of Authlete was not returned: %v", err)
+	}
+
+	if calls != 1 {
+		t.Errorf("Token was called %d times, not once", calls)
+	}
+}
+
+func TestResilienceTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	fake := FakeAuthleteApi_New()
+	fake.IntrospectionFunc = func(*dto.IntrospectionRequest) (*dto.IntrospectionResponse, *api.AuthleteError) {
+		<-release
+		return &dto.IntrospectionResponse{}, nil
+	}
+
+	instance, resilient := testResilientApi(fake, 5)
+	resilient.policy.Retries = 0
+	resilient.policy.Timeouts[`Introspection`] = 20 * time.Millisecond
+
+	start := time.Now()
+	res, err := instance.Introspection(&dto.IntrospectionRequest{})
+
+	if res != nil || err == nil || err.StatusCode != 0 {
+		t.Fatalf("The call did not time out: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("The call took %s in spite of the timeout", elapsed)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	calls := int32(0)
+	status := int32(500)
+
+	fake := FakeAuthleteApi_New()
+	fake.RevocationFunc = func(*dto.RevocationRequest) (*dto.RevocationResponse, *api.AuthleteError) {
+		atomic.AddInt32(&calls, 1)
+		if code := atomic.LoadInt32(&status); code != 200 {
+			return nil, &api.AuthleteError{StatusCode: int(code), Cause: errors.New("failed")}
+		}
+		return &dto.RevocationResponse{}, nil
+	}
+
+	instance, resilient := testResilientApi(fake, 2)
+	breaker := resilient.breaker
+
+	// Errors of requests do not mean that Authlete is unavailable.
+	atomic.StoreInt32(&status, 400)
+	for i := 0; i < 3; i++ {
+		instance.Revocation(&dto.RevocationRequest{})
+	}
+	if breaker.IsOpen() {
+		t.Fatalf("The circuit breaker was opened by client errors")
+	}
+
+	atomic.StoreInt32(&status, 500)
+	instance.Revocation(&dto.RevocationRequest{})
+	instance.Revocation(&dto.RevocationRequest{})
+	if breaker.IsOpen() == false {
+		t.Fatalf("The circuit breaker was not opened by consecutive failures")
+	}
+
+	// Calls fail fast while the breaker is open.
+	before := atomic.LoadInt32(&calls)
+	if _, err := instance.Revocation(&dto.RevocationRequest{}); err == nil || err.Cause != ErrAuthleteUnavailable {
+		t.Fatalf("The call did not fail fast: %v", err)
+	}
+	if atomic.LoadInt32(&calls) != before {
+		t.Errorf("Authlete was called while the circuit breaker was open")
+	}
+
+	// After the cooldown, a successful call closes the breaker.
+	breaker.Cooldown = 0
+	atomic.StoreInt32(&status, 200)
+	if _, err := instance.Revocation(&dto.RevocationRequest{}); err != nil {
+		t.Fatalf("The probe call failed: %v", err)
+	}
+	if breaker.state != CircuitState_CLOSED {
+		t.Errorf("The circuit breaker is %s after a successful probe", breaker.state)
+	}
+}
+
+func TestAuthleteUnavailable(t *testing.T) {
+	fake := FakeAuthleteApi_New()
+	fake.GetServiceConfigurationFunc = func(bool) (string, *api.AuthleteError) {
+		return ``, &api.AuthleteError{Cause: errors.New("connection refused")}
+	}
+
+	server := AuthorizationServer_NewWithApi(fake)
+	server.breaker.Threshold = 1
+	browser := testBrowser_NewWithHandler(t, server.Engine)
+
+	// The first request opens the circuit breaker, which rejects the
+	// retry. The response is the same as that of the following requests.
+	for i := 0; i < 2; i++ {
+		res := browser.get(`/.well-known/openid-configuration`, nil)
+		if res.Status != 503 || res.Header.Get(`Retry-After`) == `` {
+			t.Fatalf("The request %d was not rejected: %d %s", i, res.Status, res.Body)
+		}
+	}
+
+	// Clients get an OAuth error.
+	res := browser.get(`/.well-known/openid-configuration`, nil)
+
+	content := map[string]string{}
+	json.Unmarshal([]byte(res.Body), &content)
+	if content[`error`] != `temporarily_unavailable` {
+		t.Errorf("Unexpected error response: %s", res.Body)
+	}
+
+	// Browsers get an error page.
+	request, _ := http.NewRequest(`GET`, browser.server.URL+`/api/authorization`, nil)
+	request.Header.Set(`Accept`, `text/html,application/xhtml+xml`)
+
+	res = browser.do(request)
+	if res.Status != 503 || strings.Contains(res.Header.Get(`Content-Type`), `text/html`) == false {
+		t.Fatalf("No error page was rendered: %d %s", res.Status, res.Body)
+	}
+}
+
+func TestResilienceRetryAfterTimeout(t *testing.T) {
+	calls := int32(0)
+	release := make(chan struct{})
+
+	fake := FakeAuthleteApi_New()
+	fake.GetServiceJwksFunc = func(bool, bool) (string, *api.AuthleteError) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// The first attempt times out and finishes during the retry.
+			<-release
+			return `{"keys":["stale"]}`, nil
+		}
+		close(release)
+		time.Sleep(10 * time.Millisecond)
+		return `{"keys":[]}`, nil
+	}
+
+	instance, resilient := testResilientApi(fake, 5)
+	resilient.policy.Timeouts[`GetServiceJwks`] = 20 * time.Millisecond
+
+	jwks, err := instance.GetServiceJwks(false, false)
+	if err != nil || jwks != `{"keys":[]}` {
+		t.Fatalf("The result of the retry was not returned: %s %v", jwks, err)
+	}
+}
+
+func TestAuthleteUnavailableWhileProbing(t *testing.T) {
+	server := AuthorizationServer_NewWithApi(FakeAuthleteApi_New())
+	browser := testBrowser_NewWithHandler(t, server.Engine)
+
+	// Another request is probing Authlete, so calls are rejected.
+	server.breaker.state = CircuitState_HALF_OPEN
+	if server.breaker.Allow() {
+		t.Fatalf("The circuit breaker let a second probe through")
+	}
+
+	res := browser.get(`/.well-known/openid-configuration`, nil)
+	if res.Status != 503 || res.Header.Get(`Retry-After`) == `` {
+		t.Fatalf("The request was not rejected as unavailable: %d %s", res.Status, res.Body)
+	}
+
+	// A successful probe closes the breaker.
+	server.breaker.Record(false)
+	if res := browser.get(`/.well-known/openid-configuration`, nil); res.Status != 200 {
+		t.Errorf("The request was rejected after Authlete recovered: %d %s", res.Status, res.Body)
+	}
+}
+
+func TestResilienceIgnoresInvalidSettings(t *testing.T) {
+	t.Setenv(`AUTHLETE_API_RETRIES`, `two`)
+	t.Setenv(`AUTHLETE_API_BREAKER_THRESHOLD`, `0`)
+
+	if retries := AuthleteApiPolicy_New().Retries; retries != 2 {
+		t.Errorf("An invalid number of retries became %d", retries)
+	}
+
+	// A threshold of zero would open the breaker on the first failure.
+	if threshold := CircuitBreaker_New().Threshold; threshold != 5 {
+		t.Errorf("An invalid threshold became %d", threshold)
+	}
+}
@@ -19,10 +19,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/authlete/authlete-go-gin/endpoint"
 	"github.com/authlete/authlete-go-gin/handler"
+	"github.com/authlete/authlete-go/dto"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
@@ -50,46 +52,117 @@ func (self *AuthorizationDecisionEndpoint) Handle(ctx *gin.Context) {
 	// Session
 	session := sessions.Default(ctx)
 
-	// Authenticate the user if necessary.
-	authenticateUserIfNecessary(ctx, session)
-
 	// Flag which indicates whether the user has given authorization
 	// to the client application or not.
 	authorized := isClientAuthorized(ctx)
 
+	// Authenticate the user if necessary.
+	pending := authenticateUserIfNecessary(ctx, session)
+
+	if pending != nil {
+		// The user has to present a second factor before logging in.
+		requestSecondFactor(ctx, session, pending, authorized)
+		return
+	}
+
+	// If the ACR is essential but the user has not achieved it.
+	if authorized && isEssentialAcrUnmet(session) {
+		msg := "authorization_decision_endpoint: The request fails because the user has not achieved the essential ACR."
+		log.Debug().Msg(msg)
+		self.authorizationFail(ctx, session, dto.AuthorizationFailReason_ACR_NOT_SATISFIED)
+		return
+	}
+
 	// Process the authorization request according to the user's decision.
 	self.handleDecision(ctx, session, authorized)
 }
 
-func authenticateUserIfNecessary(ctx *gin.Context, session sessions.Session) {
+// authenticateUserIfNecessary returns a user who has presented a correct
+// password but still has to present a second factor. Otherwise it returns nil.
+func authenticateUserIfNecessary(ctx *gin.Context, session sessions.Session) *UserEntity {
+	// The user may have been deleted or disabled since logging in.
+	validateSessionUser(ctx, session)
+
 	if session.Get(`user`) != nil {
 		// The user has already logged in.
-		return
+		return nil
 	}
 
 	// Credentials that the user input in the login form.
 	loginId := ctx.PostForm(`loginId`)
 	password := ctx.PostForm(`password`)
 
+	// No login is attempted, e.g. the user has denied the request without
+	// logging in. It must not count against the limits of the IP address.
+	if loginId == `` || password == `` {
+		return nil
+	}
+
+	// Reject the attempt without checking the password if the account or
+	// the IP address has failed too many times recently.
+	throttle := LoginThrottle_Of(ctx)
+	if throttle.Attempt(loginId, ctx.ClientIP()) > 0 {
+		msg := fmt.Sprintf("authorization_decision_endpoint: User authentication was throttled. The presented login ID is '%s'.", loginId)
+		log.Debug().Msg(msg)
+		Metrics_Get().LoginAttempted(Amr_PWD, LoginResult_THROTTLED)
+		auditLoginFailure(ctx, session, Amr_PWD, loginId, LoginResult_THROTTLED, ``)
+		return nil
+	}
+
 	// Authenticate the user.
-	user := UserDatabase_Get().GetByCredentials(loginId, password)
+	user := UserStore_Of(ctx).GetByCredentials(loginId, password)
 
 	if user == nil {
 		// User authentication failed.
 		msg := fmt.Sprintf("authorization_decision_endpoint: User authentication failed. The presented login ID is '%s'.", loginId)
 		log.Debug().Msg(msg)
-		return
+		throttle.Failed(ctx, loginId, ctx.ClientIP())
+		Metrics_Get().LoginAttempted(Amr_PWD, LoginResult_FAILURE)
+		auditLoginFailure(ctx, session, Amr_PWD, loginId, LoginResult_FAILURE, `invalid_credentials`)
+		return nil
+	}
+
+	// If the authorization request requires a specific subject.
+	value := session.Get(`requiredSubject`)
+	if required, _ := value.(string); required != `` && required != user.Subject {
+		msg := fmt.Sprintf("authorization_decision_endpoint: The user does not have the required subject. The presented login ID is '%s'.", loginId)
+		log.Debug().Msg(msg)
+		throttle.Released(loginId, ctx.ClientIP())
+		Metrics_Get().LoginAttempted(Amr_PWD, LoginResult_FAILURE)
+		auditLoginFailure(ctx, session, Amr_PWD, loginId, LoginResult_FAILURE, `subject_mismatch`)
+		return nil
+	}
+
+	// If the user has to verify the email address before logging in.
+	if isEmailVerificationPending(user) {
+		msg := fmt.Sprintf("authorization_decision_endpoint: The email address has not been verified. The presented login ID is '%s'.", loginId)
+		log.Debug().Msg(msg)
+		throttle.Released(loginId, ctx.ClientIP())
+		Metrics_Get().LoginAttempted(Amr_PWD, LoginResult_FAILURE)
+		auditLoginFailure(ctx, session, Amr_PWD, loginId, LoginResult_FAILURE, `email_not_verified`)
+		return nil
+	}
+
+	// If the user has enrolled a second factor.
+	if user.IsTotpEnabled() {
+		msg := fmt.Sprintf("authorization_decision_endpoint: Password verification succeeded. A second factor is required. The presented login ID is '%s'.", loginId)
+		log.Debug().Msg(msg)
+		throttle.Released(loginId, ctx.ClientIP())
+		return user
 	}
 
 	// User authentication succeeded.
 	msg := fmt.Sprintf("authorization_decision_endpoint: User authentication succeeded. The presented login ID is '%s'.", loginId)
 	log.Debug().Msg(msg)
+	throttle.Succeeded(loginId, ctx.ClientIP())
 
 	// Let the user log in.
-	loginUser(session, user)
+	loginUser(ctx, session, user, []string{Amr_PWD})
+
+	return nil
 }
 
-func loginUser(session sessions.Session, user *UserEntity) {
+func loginUser(ctx *gin.Context, session sessions.Session, user *UserEntity, amr []string) {
 	// The current time.
 	current := uint64(time.Now().Unix())
 
@@ -98,7 +171,57 @@ func loginUser(session sessions.Session, user *UserEntity) {
 
 	session.Set(`user`, bytes)
 	session.Set(`authenticatedAt`, current)
+	session.Set(`amr`, amr)
+	session.Set(`acr`, AcrPolicy_Get().Achieved(amr))
 	session.Save()
+
+	Metrics_Get().LoginAttempted(strings.Join(amr, `+`), LoginResult_SUCCESS)
+
+	AuditLog_Get().Record(ctx, &AuditEvent{
+		Event:   AuditEvent_LOGIN,
+		Result:  LoginResult_SUCCESS,
+		Method:  strings.Join(amr, `+`),
+		Subject: user.Subject,
+		LoginId: user.LoginId,
+		Ticket:  getSessionTicket(session),
+	})
+}
+
+// auditLoginFailure records a failed or throttled authentication attempt.
+func auditLoginFailure(ctx *gin.Context, session sessions.Session,
+	method string, loginId string, result string, reason string) {
+	AuditLog_Get().Record(ctx, &AuditEvent{
+		Event:   AuditEvent_LOGIN,
+		Result:  result,
+		Reason:  reason,
+		Method:  method,
+		LoginId: loginId,
+		Ticket:  getSessionTicket(session),
+	})
+}
+
+// getSessionTicket returns the value which identifies the ticket of the
+// pending authorization request in audit events.
+func getSessionTicket(session sessions.Session) string {
+	if session == nil {
+		return ``
+	}
+
+	value := session.Get(`ticket`)
+	ticket, _ := value.(string)
+
+	return auditTicket(ticket)
+}
+
+func isEssentialAcrUnmet(session sessions.Session) bool {
+	// If no user has logged in, the authorization request fails anyway.
+	if session.Get(`user`) == nil {
+		return false
+	}
+
+	acrs, essential := getRequestedAcrs(session)
+
+	return isAcrUnmet(acrs, essential, getSessionAmr(session))
 }
 
 func isClientAuthorized(ctx *gin.Context) bool {
@@ -109,18 +232,94 @@ func isClientAuthorized(ctx *gin.Context) bool {
 
 func (self *AuthorizationDecisionEndpoint) handleDecision(
 	ctx *gin.Context, session sessions.Session, authorized bool) {
-	spi := AuthReqDecisionHandlerSpiImpl_New(ctx, authorized)
-	handler := handler.AuthReqDecisionHandler_New(self.Api, spi)
-
 	// Parameters contained in the response from /api/auth/authorization API.
-	value := session.Get(`ticket`)
-	ticket, _ := value.(string)
+	ticket := takeTicket(session)
+	if ticket == `` {
+		renderRequestFinished(ctx)
+		return
+	}
 
-	value = session.Get(`claimNames`)
+	value := session.Get(`claimNames`)
 	claimNames, _ := value.([]string)
 
 	value = session.Get(`claimLocales`)
 	claimLocales, _ := value.([]string)
 
+	value = session.Get(`idTokenClaims`)
+	idTokenClaims, _ := value.(string)
+
+	// Verified claims requested for the ID token.
+	verifiedClaims := getVerifiedClaimsRequest(idTokenClaims)
+
+	spi := AuthReqDecisionHandlerSpiImpl_New(ctx, authorized)
+	spi.ClaimLocales = claimLocales
+	spi.VerifiedClaimsRequest = verifiedClaims
+	handler := handler.AuthReqDecisionHandler_New(self.Api, spi)
+
+	// Record the decision of the user. A user who has not logged in cannot
+	// authorize the client.
+	if subject := spi.GetUserSubject(); subject != `` || authorized == false {
+		value = session.Get(`clientId`)
+		clientId, _ := value.(string)
+
+		result := ConsentResult_DENIED
+		if authorized {
+			result = ConsentResult_GRANTED
+		}
+
+		AuditLog_Get().Record(ctx, &AuditEvent{
+			Event:    AuditEvent_CONSENT,
+			Result:   result,
+			Subject:  subject,
+			ClientId: clientId,
+			Ticket:   auditTicket(ticket),
+		})
+	}
+
+	// Let the ID token carry the authentication methods of the user.
+	claimNames = appendAmrClaim(claimNames, session)
+	claimNames = appendVerifiedClaims(claimNames, verifiedClaims)
+
 	handler.Handle(ctx, ticket, claimNames, claimLocales)
 }
+
+func (self *AuthorizationDecisionEndpoint) authorizationFail(
+	ctx *gin.Context, session sessions.Session, reason dto.AuthorizationFailReason) {
+	ticket := takeTicket(session)
+	if ticket == `` {
+		renderRequestFinished(ctx)
+		return
+	}
+
+	if reason == dto.AuthorizationFailReason_ACR_NOT_SATISFIED {
+		failUnmetAcr(ctx, self.Api, ticket)
+		return
+	}
+
+	handler := handler.AuthReqBaseHandler{}
+	handler.Init(self.Api)
+	handler.AuthorizationFail(ctx, ticket, reason)
+}
+
+// takeTicket returns the ticket of the pending authorization request and
+// removes the request from the session. Otherwise, a stale authorization
+// page or a form submitted again with the back button could continue the
+// request after it has been finished.
+func takeTicket(session sessions.Session) string {
+	value := session.Get(`ticket`)
+	ticket, _ := value.(string)
+
+	session.Delete(`ticket`)
+	session.Delete(`model`)
+	session.Save()
+
+	return ticket
+}
+
+func renderRequestFinished(ctx *gin.Context) {
+	msg := "authorization_decision_endpoint: There is no pending authorization request."
+	log.Debug().Msg(msg)
+
+	renderMessagePage(ctx, 400, `Authorization`,
+		`The authorization request has already been processed or has expired.`)
+}
@@ -54,6 +54,9 @@ func (self *AuthorizationEndpoint) Handle(ctx *gin.Context) {
 	// the authorization endpoint support both GET and POST methods.
 	params := self.ReqUtil.ExtractParams(ctx)
 
+	// The user who has logged in may have been deleted or disabled since.
+	validateSessionUser(ctx, sessions.Default(ctx))
+
 	// Call Authlete's /api/auth/authorization API.
 	res, err := self.callAuthorizationApi(ctx, params)
 	if err != nil {
@@ -102,9 +105,35 @@ func (self *AuthorizationEndpoint) handleNoInteraction(
 	msg := "authorization_endpoint: Processing the request without user interaction."
 	log.Debug().Msg(msg)
 
+	// Session
+	session := sessions.Default(ctx)
+
+	// If the ACR is essential but the user who has logged in has not
+	// achieved it.
+	if session.Get(`user`) != nil && isAcrUnmet(res.Acrs, res.AcrEssential, getSessionAmr(session)) {
+		msg := "authorization_endpoint: The request fails because the user has not achieved the essential ACR."
+		log.Debug().Msg(msg)
+		self.authorizationFail(ctx, res.Ticket, dto.AuthorizationFailReason_ACR_NOT_SATISFIED)
+		return
+	}
+
+	// Let the ID token carry the authentication methods of the user.
+	res.Claims = appendAmrClaim(res.Claims, session)
+
+	// Verified claims requested for the ID token.
+	verifiedClaims := getVerifiedClaimsRequest(res.IdTokenClaims)
+	res.Claims = appendVerifiedClaims(res.Claims, verifiedClaims)
+
+	// The ACRs referred to by NoInteractionHandlerSpiImpl.GetAcr().
+	session.Set(`acrs`, res.Acrs)
+	session.Set(`acrEssential`, res.AcrEssential)
+	session.Save()
+
 	// Let NoInteractionHandler handle the case of 'prompt=none'
 	spi := NoInteractionHandlerSpiImpl{}
 	spi.Init(ctx)
+	spi.ClaimLocales = res.ClaimsLocales
+	spi.VerifiedClaimsRequest = verifiedClaims
 	handler := handler.NoInteractionHandler_New(self.Api, &spi)
 	handler.Handle(ctx, res)
 }
@@ -129,6 +158,14 @@ func (self *AuthorizationEndpoint) handleInteraction(
 	// Session
 	session := sessions.Default(ctx)
 
+	// If the ACR is essential but no user can achieve it.
+	if isAcrUnachievable(ctx, res) {
+		msg := "authorization_endpoint: The request fails because the essential ACR cannot be achieved."
+		log.Debug().Msg(msg)
+		self.authorizationFail(ctx, res.Ticket, dto.AuthorizationFailReason_ACR_NOT_SATISFIED)
+		return
+	}
+
 	// Prepare a model object which is used to render the authorization page.
 	model := prepareModel(ctx, res, session)
 
@@ -142,10 +179,24 @@ func (self *AuthorizationEndpoint) handleInteraction(
 	// Store some variables into the session so that they can be referred to
 	// later in authorization_decision_endpoint.go.
 	session.Set(`ticket`, res.Ticket)
+	session.Set(`clientId`, getClientId(res))
+	session.Set(`requiredSubject`, res.Subject)
 	session.Set(`claimNames`, res.Claims)
 	session.Set(`claimLocales`, res.ClaimsLocales)
+	session.Set(`idTokenClaims`, res.IdTokenClaims)
+	session.Set(`acrs`, res.Acrs)
+	session.Set(`acrEssential`, res.AcrEssential)
+	saveModel(session, model)
 	session.Save()
 
+	// If the client asks to show the registration page (prompt=create).
+	if isCreateIncludedInPrompt(res) {
+		msg := "authorization_endpoint: Showing the registration page because 'prompt' includes 'create'."
+		log.Debug().Msg(msg)
+		renderRegistrationPage(ctx, RegistrationPageModel{})
+		return
+	}
+
 	// Render the authorization page.
 	ctx.HTML(200, `authorization.html`, gin.H{"model": model})
 }
@@ -168,20 +219,21 @@ func prepareModel(ctx *gin.Context, res *dto.AuthorizationResponse,
 	}
 
 	// Logout the user.
-	logoutUser(session)
+	logoutUser(ctx, session)
 
 	// If the authorization request does not require a specific 'subject'.
 	if res.Subject == `` {
 		// This simple implementation uses 'login_hint' as the initial value
 		// of the login ID.
 		model.LoginId = res.LoginHint
+		model.IdentityProviders = Federation_Get().Links()
 		return model
 	}
 
 	// The authorization request requires a specific 'subject' be used.
 
 	// Try to find a user whose subject is equal to the required subject.
-	user = UserDatabase_Get().GetBySubject(res.Subject)
+	user = UserStore_Of(ctx).GetBySubject(res.Subject)
 
 	if user == nil {
 		// There is no user who has the required subject.
@@ -212,9 +264,49 @@ func getUserFromSession(session sessions.Session) *UserEntity {
 	return &user
 }
 
-func logoutUser(session sessions.Session) {
+// validateSessionUser logs out the user in the session if the account has
+// been deleted or disabled after the user logged in.
+func validateSessionUser(ctx *gin.Context, session sessions.Session) {
+	user := getUserFromSession(session)
+	if user == nil {
+		return
+	}
+
+	current := UserStore_Of(ctx).GetBySubject(user.Subject)
+	if current != nil && current.Disabled == false {
+		return
+	}
+
+	msg := fmt.Sprintf("authorization_endpoint: The user in the session no longer exists or is disabled. The subject is '%s'.", user.Subject)
+	log.Debug().Msg(msg)
+
+	logoutUser(ctx, session)
+	session.Save()
+}
+
+func logoutUser(ctx *gin.Context, session sessions.Session) {
+	if user := getUserFromSession(session); user != nil {
+		AuditLog_Get().Record(ctx, &AuditEvent{
+			Event:   AuditEvent_LOGOUT,
+			Subject: user.Subject,
+			LoginId: user.LoginId,
+		})
+	}
+
 	session.Delete(`user`)
-	session.Delete(`authenciatedAt`)
+	session.Delete(`authenticatedAt`)
+	session.Delete(`amr`)
+	session.Delete(`acr`)
+}
+
+// getClientId returns the client ID of the authorization request, which is
+// recorded in audit events.
+func getClientId(res *dto.AuthorizationResponse) string {
+	if res.Client == nil {
+		return ``
+	}
+
+	return auditClientId(res.Client.ClientId, res.Client.ClientIdAlias, nil)
 }
 
 func isLoginRequired(ctx *gin.Context, res *dto.AuthorizationResponse,
@@ -254,6 +346,15 @@ func isLoginRequired(ctx *gin.Context, res *dto.AuthorizationResponse,
 		return true
 	}
 
+	// Check if the user has to authenticate again to achieve the requested ACR.
+	stepUp := isStepUpRequired(ctx, res, session, user)
+	if stepUp {
+		// The user has to re-login with stronger authentication methods.
+		msg := "authorization_endpoint: Login is required because the user has not achieved any of the requested ACRs."
+		log.Debug().Msg(msg)
+		return true
+	}
+
 	// Login is not required.
 	return false
 }
@@ -276,6 +377,19 @@ func isLoginIncludedInPrompt(res *dto.AuthorizationResponse) bool {
 	return false
 }
 
+func isCreateIncludedInPrompt(res *dto.AuthorizationResponse) bool {
+	// For each value in the 'prompt' parameter.
+	for _, prompt := range res.Prompts {
+		if prompt == Prompt_CREATE {
+			// 'create' is included in the 'prompt' parameter.
+			return true
+		}
+	}
+
+	// The 'prompt' parameter does not include 'create'.
+	return false
+}
+
 func isMaxAgeExceeded(res *dto.AuthorizationResponse, session sessions.Session) bool {
 	maxAge := uint64(res.MaxAge)
 
@@ -308,8 +422,68 @@ func isMaxAgeExceeded(res *dto.AuthorizationResponse, session sessions.Session)
 	return true
 }
 
+func isStepUpRequired(ctx *gin.Context, res *dto.AuthorizationResponse,
+	session sessions.Session, user *UserEntity) bool {
+	// If the authorization request does not include 'acr_values' or
+	// an 'acr' claim request, and the 'default_acr_values' metadata
+	// of the client is not set.
+	if len(res.Acrs) == 0 {
+		return false
+	}
+
+	policy := AcrPolicy_Get()
+
+	// If the user has already achieved one of the requested ACRs.
+	if policy.SelectAcr(res.Acrs, getSessionAmr(session)) != `` {
+		return false
+	}
+
+	// The user has to re-login only when the user has the authenticators
+	// which achieve one of the requested ACRs. Note that the user in the
+	// session does not carry the information about the authenticators.
+	entity := UserStore_Of(ctx).GetBySubject(user.Subject)
+	if entity == nil {
+		return false
+	}
+
+	return policy.CanSatisfy(res.Acrs, entity, CredentialDatabase_Of(ctx))
+}
+
+func isAcrUnachievable(ctx *gin.Context, res *dto.AuthorizationResponse) bool {
+	// If the ACR is not essential, the authorization request does not
+	// fail even when none of the requested ACRs is achieved.
+	if len(res.Acrs) == 0 || res.AcrEssential == false {
+		return false
+	}
+
+	policy := AcrPolicy_Get()
+
+	// If the authorization request requires a specific subject, the user
+	// has to achieve the ACR with the user's own authenticators.
+	if res.Subject != `` {
+		user := UserStore_Of(ctx).GetBySubject(res.Subject)
+		if user != nil {
+			return policy.CanSatisfy(res.Acrs, user, CredentialDatabase_Of(ctx)) == false
+		}
+	}
+
+	// Check if this implementation knows any of the requested ACRs.
+	for _, acr := range res.Acrs {
+		if policy.IsKnown(acr) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (self *AuthorizationEndpoint) authorizationFail(
 	ctx *gin.Context, ticket string, reason dto.AuthorizationFailReason) {
+	if reason == dto.AuthorizationFailReason_ACR_NOT_SATISFIED {
+		failUnmetAcr(ctx, self.Api, ticket)
+		return
+	}
+
 	handler := handler.AuthReqBaseHandler{}
 	handler.Init(self.Api)
 	handler.AuthorizationFail(ctx, ticket, reason)
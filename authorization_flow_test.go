@@ -0,0 +1,554 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/authlete/authlete-go/api"
+	"github.com/authlete/authlete-go/dto"
+	"github.com/gin-gonic/gin"
+)
+
+const testRedirectUri = `https://client.example.com/callback`
+
+var (
+	testFormPattern  = regexp.MustCompile(`(?s)<form id="([^"]*)" action="([^"]*)"[^>]*>(.*?)</form>`)
+	testInputPattern = regexp.MustCompile(`(?s)<input\b(.*?)>`)
+	testAttrPattern  = regexp.MustCompile(`([\w-]+)(?:="([^"]*)")?`)
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// testBrowser drives the authorization server like a browser against
+// FakeAuthleteApi. It carries cookies but does not follow redirects so that
+// the redirections to the client can be inspected.
+type testBrowser struct {
+	t      *testing.T
+	fake   *FakeAuthleteApi
+	server *httptest.Server
+	client *http.Client
+}
+
+type testResponse struct {
+	Status int
+	Header http.Header
+	Body   string
+}
+
+// testForm is the authorization form in the rendered authorization page.
+type testForm struct {
+	Action        string
+	Fields        url.Values
+	LoginRequired bool
+	ReadOnly      bool
+}
+
+func testBrowser_New(t *testing.T) *testBrowser {
+	fake := FakeAuthleteApi_New()
+	fake.RedirectUri = testRedirectUri
+
+	browser := testBrowser_NewWithApi(t, fake)
+	browser.fake = fake
+
+	return browser
+}
+
+func testBrowser_NewWithApi(t *testing.T, instance api.AuthleteApi) *testBrowser {
+	return testBrowser_NewWithHandler(t, AuthorizationServer_NewWithApi(instance).Engine)
+}
+
+func testBrowser_NewWithHandler(t *testing.T, handler http.Handler) *testBrowser {
+	// Failures in other tests must not throttle logins.
+	loginThrottleInstance = LoginThrottle_New(MemoryThrottleStore_New())
+
+	// Audit events are not written unless a test adds a sink.
+	auditLogInstance = &AuditLog{Redact: map[string]bool{}}
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return &testBrowser{t: t, server: server, client: client}
+}
+
+func (self *testBrowser) do(request *http.Request) *testResponse {
+	self.t.Helper()
+
+	response, err := self.client.Do(request)
+	if err != nil {
+		self.t.Fatalf("%s %s failed: %s", request.Method, request.URL.Path, err)
+	}
+	defer response.Body.Close()
+
+	body, _ := io.ReadAll(response.Body)
+
+	return &testResponse{Status: response.StatusCode, Header: response.Header, Body: string(body)}
+}
+
+func (self *testBrowser) get(path string, params url.Values) *testResponse {
+	self.t.Helper()
+
+	request, _ := http.NewRequest(`GET`, self.server.URL+path+`?`+params.Encode(), nil)
+
+	return self.do(request)
+}
+
+func (self *testBrowser) post(path string, params url.Values) *testResponse {
+	self.t.Helper()
+
+	request, _ := http.NewRequest(`POST`, self.server.URL+path, strings.NewReader(params.Encode()))
+	request.Header.Set(`Content-Type`, `application/x-www-form-urlencoded`)
+
+	return self.do(request)
+}
+
+// authorize sends an authorization request and returns the authorization
+// form. 'params' is added to a request of the authorization code flow.
+func (self *testBrowser) authorize(params url.Values) *testForm {
+	self.t.Helper()
+
+	res := self.get(`/api/authorization`, testAuthorizationParams(params))
+	if res.Status != 200 {
+		self.t.Fatalf("The authorization endpoint returned %d instead of the authorization page: %s", res.Status, res.Body)
+	}
+
+	return parseTestForm(self.t, res.Body, `authorization-form`)
+}
+
+// submit posts the form with the given values added to its fields.
+func (self *testBrowser) submit(form *testForm, values url.Values) *testResponse {
+	self.t.Helper()
+
+	params := url.Values{}
+	for name, value := range form.Fields {
+		params[name] = value
+	}
+	for name, value := range values {
+		params[name] = value
+	}
+
+	return self.post(form.Action, params)
+}
+
+// login lets the user log in by the authorization code flow and returns the
+// authorization code.
+func (self *testBrowser) login(loginId string, password string) string {
+	self.t.Helper()
+
+	form := self.authorize(nil)
+	res := self.submit(form, testDecision(loginId, password, true))
+
+	return expectCode(self.t, res)
+}
+
+// token exchanges the authorization code for an access token.
+func (self *testBrowser) token(code string) string {
+	self.t.Helper()
+
+	res := self.post(`/api/token`, url.Values{
+		`grant_type`:   {`authorization_code`},
+		`code`:         {code},
+		`redirect_uri`: {testRedirectUri},
+		`client_id`:    {`1`},
+	})
+	if res.Status != 200 {
+		self.t.Fatalf("The token endpoint returned %d: %s", res.Status, res.Body)
+	}
+
+	content := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	json.Unmarshal([]byte(res.Body), &content)
+
+	if content.AccessToken == `` {
+		self.t.Fatalf("The token response does not contain an access token: %s", res.Body)
+	}
+
+	return content.AccessToken
+}
+
+func (self *testBrowser) userInfo(accessToken string) map[string]interface{} {
+	self.t.Helper()
+
+	request, _ := http.NewRequest(`GET`, self.server.URL+`/api/userinfo`, nil)
+	request.Header.Set(`Authorization`, `Bearer `+accessToken)
+
+	res := self.do(request)
+	if res.Status != 200 {
+		self.t.Fatalf("The userinfo endpoint returned %d: %s", res.Status, res.Body)
+	}
+
+	claims := map[string]interface{}{}
+	json.Unmarshal([]byte(res.Body), &claims)
+
+	return claims
+}
+
+// issuedSubject returns the subject of the last authorization issued.
+func (self *testBrowser) issuedSubject() string {
+	request, _ := self.fake.LastRequest(`AuthorizationIssue`).(*dto.AuthorizationIssueRequest)
+	if request == nil {
+		return ``
+	}
+
+	return request.Subject
+}
+
+func testAuthorizationParams(params url.Values) url.Values {
+	values := url.Values{
+		`response_type`: {`code`},
+		`client_id`:     {`1`},
+		`redirect_uri`:  {testRedirectUri},
+		`scope`:         {`openid email`},
+		`state`:         {`test-state`},
+	}
+
+	for name, value := range params {
+		values[name] = value
+	}
+
+	return values
+}
+
+func testDecision(loginId string, password string, authorized bool) url.Values {
+	values := url.Values{}
+
+	if loginId != `` {
+		values.Set(`loginId`, loginId)
+		values.Set(`password`, password)
+	}
+
+	if authorized {
+		values.Set(`authorized`, `Authorize`)
+	} else {
+		values.Set(`denied`, `Deny`)
+	}
+
+	return values
+}
+
+func parseTestForm(t *testing.T, body string, id string) *testForm {
+	t.Helper()
+
+	for _, match := range testFormPattern.FindAllStringSubmatch(body, -1) {
+		if match[1] != id {
+			continue
+		}
+
+		form := testForm{Action: html.UnescapeString(match[2]), Fields: url.Values{}}
+
+		for _, input := range testInputPattern.FindAllStringSubmatch(match[3], -1) {
+			attrs := map[string]string{}
+			for _, attr := range testAttrPattern.FindAllStringSubmatch(input[1], -1) {
+				attrs[attr[1]] = html.UnescapeString(attr[2])
+			}
+
+			// Submit buttons are chosen by the caller.
+			if attrs[`type`] == `submit` {
+				continue
+			}
+
+			if attrs[`name`] == `password` {
+				form.LoginRequired = true
+			}
+
+			if _, ok := attrs[`readonly`]; ok && attrs[`name`] == `loginId` {
+				form.ReadOnly = true
+			}
+
+			if attrs[`name`] != `` && attrs[`value`] != `` {
+				form.Fields.Set(attrs[`name`], attrs[`value`])
+			}
+		}
+
+		return &form
+	}
+
+	t.Fatalf("The page does not contain the form '%s': %s", id, body)
+
+	return nil
+}
+
+// expectRedirect checks that the response redirects the browser to the
+// client and returns the parameters of the redirection.
+func expectRedirect(t *testing.T, res *testResponse) url.Values {
+	t.Helper()
+
+	location := res.Header.Get(`Location`)
+	if res.Status != 302 || strings.HasPrefix(location, testRedirectUri+`?`) == false {
+		t.Fatalf("The response is not a redirection to the client: %d %s %s", res.Status, location, res.Body)
+	}
+
+	parsed, _ := url.Parse(location)
+	query := parsed.Query()
+
+	if query.Get(`state`) != `test-state` {
+		t.Errorf("The state is '%s' instead of 'test-state'.", query.Get(`state`))
+	}
+
+	return query
+}
+
+func expectCode(t *testing.T, res *testResponse) string {
+	t.Helper()
+
+	query := expectRedirect(t, res)
+	if query.Get(`code`) == `` {
+		t.Fatalf("The client did not receive an authorization code: %s", query.Encode())
+	}
+
+	return query.Get(`code`)
+}
+
+func expectError(t *testing.T, res *testResponse, errorCode string) {
+	t.Helper()
+
+	query := expectRedirect(t, res)
+	if query.Get(`error`) != errorCode || query.Get(`code`) != `` {
+		t.Fatalf("The client received '%s' instead of the error '%s'.", query.Encode(), errorCode)
+	}
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	browser := testBrowser_New(t)
+
+	form := browser.authorize(nil)
+	if form.LoginRequired == false {
+		t.Fatal("The authorization page does not ask for login.")
+	}
+
+	res := browser.submit(form, testDecision(`john`, `john`, true))
+	code := expectCode(t, res)
+
+	if browser.issuedSubject() != `1001` {
+		t.Errorf("The authorization was issued for '%s' instead of '1001'.", browser.issuedSubject())
+	}
+
+	claims := browser.userInfo(browser.token(code))
+	if claims[`sub`] != `1001` || claims[`email`] != `john@example.com` {
+		t.Errorf("The userinfo endpoint returned unexpected claims: %v", claims)
+	}
+}
+
+func TestAuthorizationWithLoggedInUser(t *testing.T) {
+	browser := testBrowser_New(t)
+	browser.login(`john`, `john`)
+
+	// The user does not have to log in again.
+	form := browser.authorize(nil)
+	if form.LoginRequired {
+		t.Fatal("The authorization page asks the user who has logged in for login.")
+	}
+
+	res := browser.submit(form, testDecision(``, ``, true))
+	expectCode(t, res)
+}
+
+func TestAuthorizationPromptLogin(t *testing.T) {
+	browser := testBrowser_New(t)
+	browser.login(`john`, `john`)
+
+	form := browser.authorize(url.Values{`prompt`: {`login`}})
+	if form.LoginRequired == false {
+		t.Fatal("The authorization page does not ask for login though 'prompt' includes 'login'.")
+	}
+
+	// The user has been logged out, so authorization without login fails.
+	res := browser.submit(form, testDecision(``, ``, true))
+	expectError(t, res, `login_required`)
+
+	form = browser.authorize(url.Values{`prompt`: {`login`}})
+	res = browser.submit(form, testDecision(`john`, `john`, true))
+	expectCode(t, res)
+}
+
+func TestAuthorizationMaxAge(t *testing.T) {
+	browser := testBrowser_New(t)
+	browser.login(`john`, `john`)
+
+	form := browser.authorize(url.Values{`max_age`: {`3600`}})
+	if form.LoginRequired {
+		t.Fatal("The authorization page asks for login though the max age has not passed.")
+	}
+
+	// Let the authentication get older than 'max_age'.
+	time.Sleep(2 * time.Second)
+
+	form = browser.authorize(url.Values{`max_age`: {`1`}})
+	if form.LoginRequired == false {
+		t.Fatal("The authorization page does not ask for login though the max age has passed.")
+	}
+
+	res := browser.submit(form, testDecision(``, ``, true))
+	expectError(t, res, `login_required`)
+
+	form = browser.authorize(url.Values{`max_age`: {`1`}})
+	res = browser.submit(form, testDecision(`john`, `john`, true))
+	expectCode(t, res)
+}
+
+func TestAuthorizationSubjectMismatch(t *testing.T) {
+	browser := testBrowser_New(t)
+	browser.login(`john`, `john`)
+
+	// The client requires the subject of 'jane'.
+	claims := url.Values{`claims`: {`{"id_token":{"sub":{"value":"1002"}}}`}}
+
+	form := browser.authorize(claims)
+	if form.LoginRequired == false || form.ReadOnly == false || form.Fields.Get(`loginId`) != `jane` {
+		t.Fatalf("The authorization page does not ask for login as 'jane': %v", form)
+	}
+
+	// Another user cannot log in instead.
+	res := browser.submit(form, testDecision(`john`, `john`, true))
+	expectError(t, res, `login_required`)
+
+	form = browser.authorize(claims)
+	res = browser.submit(form, testDecision(`jane`, `jane`, true))
+	expectCode(t, res)
+
+	if browser.issuedSubject() != `1002` {
+		t.Errorf("The authorization was issued for '%s' instead of '1002'.", browser.issuedSubject())
+	}
+}
+
+func TestAuthorizationUnknownSubject(t *testing.T) {
+	browser := testBrowser_New(t)
+
+	params := testAuthorizationParams(url.Values{`claims`: {`{"id_token":{"sub":{"value":"9999"}}}`}})
+	res := browser.get(`/api/authorization`, params)
+	expectError(t, res, `login_required`)
+}
+
+func TestAuthorizationDenied(t *testing.T) {
+	browser := testBrowser_New(t)
+
+	form := browser.authorize(nil)
+	res := browser.submit(form, testDecision(`john`, `john`, false))
+	expectError(t, res, `access_denied`)
+
+	if browser.fake.LastRequest(`AuthorizationIssue`) != nil {
+		t.Error("Authorization was issued though the user denied it.")
+	}
+}
+
+func TestTokenPasswordFlow(t *testing.T) {
+	browser := testBrowser_New(t)
+
+	params := url.Values{`grant_type`: {`password`}, `username`: {`jane`}, `password`: {`wrong`}}
+	res := browser.post(`/api/token`, params)
+	if res.Status != 400 || strings.Contains(res.Body, `invalid_grant`) == false {
+		t.Fatalf("The token endpoint returned %d for a wrong password: %s", res.Status, res.Body)
+	}
+
+	params.Set(`password`, `jane`)
+	res = browser.post(`/api/token`, params)
+	if res.Status != 200 || strings.Contains(res.Body, `access_token`) == false {
+		t.Fatalf("The token endpoint returned %d for the right password: %s", res.Status, res.Body)
+	}
+}
+
+func TestTokenPasswordFlowRequiresSecondFactor(t *testing.T) {
+	testUserStore_Install(t, UserEntity{Subject: `1`, LoginId: `alice`, Password: `alice`, TotpSecret: `JBSWY3DPEHPK3PXP`})
+	browser := testBrowser_New(t)
+
+	params := url.Values{`grant_type`: {`password`}, `username`: {`alice`}, `password`: {`alice`}}
+	res := browser.post(`/api/token`, params)
+	if res.Status != 400 || strings.Contains(res.Body, `invalid_grant`) == false {
+		t.Fatalf("The token endpoint returned %d without the second factor: %s", res.Status, res.Body)
+	}
+}
+
+func TestAuthorizationEssentialAcrUnmet(t *testing.T) {
+	browser := testBrowser_New(t)
+
+	// No user can achieve an unknown ACR.
+	params := testAuthorizationParams(url.Values{
+		`claims`: {`{"id_token":{"acr":{"essential":true,"values":["urn:example:unknown"]}}}`},
+	})
+	expectError(t, browser.get(`/api/authorization`, params), `unmet_authentication_requirements`)
+
+	// John has no passkey, so the ACR is not achieved with a password.
+	form := browser.authorize(url.Values{
+		`claims`: {`{"id_token":{"acr":{"essential":true,"values":["` + Acr_PHISHING_RESISTANT + `","` + Acr_SINGLE_FACTOR + `"]}}}`},
+	})
+	expectCode(t, browser.submit(form, testDecision(`john`, `john`, true)))
+
+	form = browser.authorize(url.Values{
+		`claims`: {`{"id_token":{"acr":{"essential":true,"values":["` + Acr_MULTI_FACTOR + `"]}}}`},
+		`prompt`: {`login`},
+	})
+	expectError(t, browser.submit(form, testDecision(`john`, `john`, true)), `unmet_authentication_requirements`)
+}
+
+func TestReplaceErrorInForm(t *testing.T) {
+	form := `<input type="hidden" name="error" value="login_required"/>` +
+		`<input type="hidden" name="error_description" value="Login is required."/>` +
+		`<input type="hidden" name="state" value="xyz"/>`
+
+	replaced := replaceErrorInForm(form)
+	if strings.Contains(replaced, `value="unmet_authentication_requirements"`) == false ||
+		strings.Contains(replaced, `login_required`) || strings.Contains(replaced, `value="xyz"`) == false {
+		t.Errorf("Unexpected form: %s", replaced)
+	}
+}
+
+func TestAuthorizationFormSubmittedAgain(t *testing.T) {
+	browser := testBrowser_New(t)
+
+	form := browser.authorize(nil)
+	expectCode(t, browser.submit(form, testDecision(`john`, `john`, true)))
+	calls := len(browser.fake.Calls())
+
+	// e.g. the back button and the form submitted again.
+	res := browser.submit(form, testDecision(``, ``, true))
+	if res.Status != 400 || len(browser.fake.Calls()) != calls {
+		t.Fatalf("The finished authorization request continued: %d %s", res.Status, res.Body)
+	}
+
+	// A failed request is finished as well.
+	form = browser.authorize(nil)
+	expectError(t, browser.submit(form, testDecision(``, ``, false)), `access_denied`)
+	calls = len(browser.fake.Calls())
+
+	res = browser.submit(form, testDecision(``, ``, true))
+	if res.Status != 400 || len(browser.fake.Calls()) != calls {
+		t.Fatalf("The denied authorization request continued: %d %s", res.Status, res.Body)
+	}
+}
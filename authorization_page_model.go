@@ -17,7 +17,10 @@
 package main
 
 import (
+	"encoding/json"
+
 	"github.com/authlete/authlete-go/dto"
+	"github.com/gin-contrib/sessions"
 )
 
 type AuthorizationPageModel struct {
@@ -33,6 +36,9 @@ type AuthorizationPageModel struct {
 	LoginIdReadOnly string
 	LoginRequired   bool
 	UserName        string
+
+	// External identity providers the user can log in with.
+	IdentityProviders []IdentityProviderLink
 }
 
 func AuthorizationPageModel_New(res *dto.AuthorizationResponse) *AuthorizationPageModel {
@@ -49,3 +55,28 @@ func AuthorizationPageModel_New(res *dto.AuthorizationResponse) *AuthorizationPa
 
 	return &model
 }
+
+// saveModel stores the model into the session so that the authorization
+// page can be rendered again after the user logs in by other means than
+// the login form, e.g. after registration.
+func saveModel(session sessions.Session, model *AuthorizationPageModel) {
+	bytes, _ := json.Marshal(model)
+
+	session.Set(`model`, bytes)
+}
+
+func loadModel(session sessions.Session) *AuthorizationPageModel {
+	value := session.Get(`model`)
+	if value == nil {
+		return nil
+	}
+
+	bytes, _ := value.([]byte)
+
+	model := AuthorizationPageModel{}
+	if json.Unmarshal(bytes, &model) != nil {
+		return nil
+	}
+
+	return &model
+}
@@ -0,0 +1,59 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// resumeAuthorization renders the authorization page of the pending
+// authorization request again for the user who has just logged in by other
+// means than the login form. The ticket stored in the session is used as
+// is. It returns false when there is no pending authorization request.
+func resumeAuthorization(ctx *gin.Context, session sessions.Session, user *UserEntity) bool {
+	model := loadModel(session)
+
+	if model == nil || session.Get(`ticket`) == nil {
+		return false
+	}
+
+	// If the authorization request requires a specific subject.
+	value := session.Get(`requiredSubject`)
+	required, _ := value.(string)
+
+	if required != `` && required != user.Subject {
+		// The user has to login with another user account.
+		msg := "authorization_resumption: Login is required because the user's subject does not match the required one."
+		log.Debug().Msg(msg)
+
+		logoutUser(ctx, session)
+		session.Save()
+
+		model.LoginRequired = true
+		model.UserName = ``
+	} else {
+		model.LoginRequired = false
+		model.UserName = user.GivenName
+	}
+
+	// Render the authorization page.
+	ctx.HTML(200, `authorization.html`, gin.H{"model": model})
+
+	return true
+}
@@ -17,54 +17,334 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/authlete/authlete-go-gin/endpoint"
 	"github.com/authlete/authlete-go-gin/middleware"
 	"github.com/authlete/authlete-go-gin/web"
+	"github.com/authlete/authlete-go/api"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/memstore"
 	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 type AuthorizationServer struct {
 	Engine *gin.Engine
+
+	// Middleware which sets an instance of api.AuthleteApi to gin contexts.
+	// When nil, the instance is created from `authlete.toml`.
+	ApiMiddleware gin.HandlerFunc
+
+	// Time to keep accepting requests after the readiness probe starts to
+	// fail, so that load balancers stop sending new requests.
+	ShutdownDelay time.Duration
+
+	// Time to wait for requests in flight to finish before connections are
+	// closed forcibly.
+	ShutdownTimeout time.Duration
+
+	// Tenant served by this server, or nil for the default server.
+	Tenant *Tenant
+
+	// Store of sessions, which is checked by the readiness probe.
+	sessionStore sessions.Store
+
+	readiness *Readiness
+
+	// Circuit breaker of the calls of Authlete APIs.
+	breaker *CircuitBreaker
+
+	// Servers of the tenants and the router which dispatches requests to
+	// them. They are used only by the default server.
+	tenants []*AuthorizationServer
+	router  *TenantRouter
 }
 
 func AuthorizationServer_New() *AuthorizationServer {
 	server := AuthorizationServer{}
 	server.init()
 
+	// Authlete services hosted in addition to the one of `authlete.toml`.
+	if file := getConfiguration(`TENANTS_CONFIG`, ``); file != `` {
+		config := TenantConfiguration_Load(file)
+		for i := range config.Tenants {
+			server.AddTenant(AuthorizationServer_NewForTenant(Tenant_New(&config.Tenants[i]), nil))
+		}
+	}
+
+	return &server
+}
+
+// AuthorizationServer_NewWithApi creates a server which uses the given
+// instance of api.AuthleteApi, e.g. FakeAuthleteApi for tests, instead of
+// the one configured by `authlete.toml`.
+func AuthorizationServer_NewWithApi(instance api.AuthleteApi) *AuthorizationServer {
+	server := AuthorizationServer{}
+	server.ApiMiddleware = AuthleteApi_Instance(instance)
+	server.init()
+
+	return &server
+}
+
+// AuthorizationServer_NewForTenant creates a server of the tenant. When
+// 'apiMiddleware' is nil, the instance of api.AuthleteApi is created from
+// the TOML file of the tenant.
+func AuthorizationServer_NewForTenant(tenant *Tenant, apiMiddleware gin.HandlerFunc) *AuthorizationServer {
+	server := AuthorizationServer{}
+	server.Tenant = tenant
+	server.ApiMiddleware = apiMiddleware
+
+	if tenant.Credentials == nil {
+		tenant.Credentials = CredentialDatabase_New()
+	}
+
+	if server.ApiMiddleware == nil {
+		server.ApiMiddleware = middleware.AuthleteApi_Toml(tenant.Authlete)
+	}
+
+	server.init()
+
 	return &server
 }
 
+// AddTenant lets the server dispatch the requests to the tenant to its
+// server.
+func (self *AuthorizationServer) AddTenant(server *AuthorizationServer) {
+	if self.router == nil {
+		self.router = TenantRouter_New(self)
+	}
+
+	self.router.Add(server)
+	self.tenants = append(self.tenants, server)
+
+	msg := fmt.Sprintf("authorization_server: The tenant '%s' was added.", server.Tenant.Name)
+	log.Debug().Msg(msg)
+}
+
+// Handler returns the handler of all requests to the server, including
+// those to the tenants.
+func (self *AuthorizationServer) Handler() http.Handler {
+	if self.router != nil {
+		return self.router
+	}
+
+	return self.Engine
+}
+
+// Run serves requests on the address (":8080" or ":$PORT" by default)
+// until SIGINT or SIGTERM is received, and then shuts down gracefully.
 func (self *AuthorizationServer) Run(addr ...string) error {
-	return self.Engine.Run(addr...)
+	address := `:` + getConfiguration(`PORT`, `8080`)
+	if len(addr) > 0 {
+		address = addr[0]
+	}
+
+	listener, err := net.Listen(`tcp`, address)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Metrics on a port of their own, which is not exposed to the public.
+	if addr := getConfiguration(`METRICS_ADDR`, ``); addr != `` {
+		metrics := MetricsServer_New(addr)
+		go func() {
+			if err := metrics.ListenAndServe(); err != nil && errors.Is(err, http.ErrServerClosed) == false {
+				msg := fmt.Sprintf("authorization_server: Failed to serve metrics: %s", err)
+				log.Warn().Msg(msg)
+			}
+		}()
+		defer metrics.Close()
+	}
+
+	msg := fmt.Sprintf("authorization_server: Listening on %s.", listener.Addr())
+	log.Info().Msg(msg)
+
+	return self.Serve(ctx, listener)
+}
+
+// Serve serves requests on the listener until the context is done. Then
+// the readiness probe starts to fail, and after ShutdownDelay the server
+// stops accepting connections and waits for requests in flight to finish
+// for up to ShutdownTimeout. Finally the stores and exporters are closed.
+func (self *AuthorizationServer) Serve(ctx context.Context, listener net.Listener) error {
+	server := &http.Server{Handler: self.Handler()}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errs:
+		// The server failed before being asked to stop.
+		self.Close(context.Background())
+		return err
+	case <-ctx.Done():
+	}
+
+	msg := "authorization_server: Shutting down. The readiness probe fails from now on."
+	log.Info().Msg(msg)
+
+	self.readiness.SetDraining()
+	for _, tenant := range self.tenants {
+		tenant.readiness.SetDraining()
+	}
+	time.Sleep(self.ShutdownDelay)
+
+	drain, cancel := context.WithTimeout(context.Background(), self.ShutdownTimeout)
+	defer cancel()
+
+	err := server.Shutdown(drain)
+	if err != nil {
+		msg := fmt.Sprintf("authorization_server: Requests in flight did not finish in time: %s", err)
+		log.Warn().Msg(msg)
+		server.Close()
+	}
+
+	if e := <-errs; e != nil && errors.Is(e, http.ErrServerClosed) == false {
+		err = e
+	}
+
+	// The exporters get time of their own to flush.
+	closing, cancelClosing := context.WithTimeout(context.Background(), self.ShutdownTimeout)
+	defer cancelClosing()
+
+	self.Close(closing)
+
+	msg = "authorization_server: The server has shut down."
+	log.Info().Msg(msg)
+
+	return err
+}
+
+// Close flushes and closes the audit log, the exporter of traces and the
+// stores which hold connections to external services.
+func (self *AuthorizationServer) Close(ctx context.Context) {
+	AuditLog_Get().Close()
+
+	if err := Tracing_Shutdown(ctx); err != nil {
+		msg := fmt.Sprintf("authorization_server: Failed to export spans: %s", err)
+		log.Warn().Msg(msg)
+	}
+
+	stores := []interface{}{UserStore_Get(), LoginThrottle_Get().Store}
+	for _, tenant := range self.tenants {
+		stores = append(stores, tenant.Tenant.UserStore)
+	}
+
+	for _, store := range stores {
+		if closer, ok := store.(io.Closer); ok {
+			closer.Close()
+		}
+	}
 }
 
 func (self *AuthorizationServer) init() {
 	self.Engine = gin.Default()
+	self.ShutdownDelay = getConfigurationSeconds(`SHUTDOWN_DELAY`, 0)
+	self.ShutdownTimeout = getConfigurationSeconds(`SHUTDOWN_TIMEOUT`, 30)
 
+	self.setupTenant()
 	self.setupStatic()
 	self.setupTemplates()
+	self.setupTracing()
+	self.setupMetrics(`/metrics`)
 	self.setupSession()
 	self.setupAuthleteApi()
+	self.setupHealthEndpoints(`/healthz`, `/readyz`)
 	self.setupAuthorizationEndpoint(`/api/authorization`)
 	self.setupAuthorizationDecisionEndpoint(`/api/authorization/decision`)
+	self.setupMfaEndpoint(`/api/authorization/mfa`)
+	self.setupMfaEnrollmentEndpoint(`/mfa/enrollment`)
+	self.setupWebAuthnEndpoints(`/api/webauthn`)
+	self.setupPasskeyPage(`/passkeys`)
+	self.setupRegistrationEndpoint(`/registration`)
+	self.setupEmailVerificationEndpoint(`/email/verification`)
+	self.setupPasswordResetEndpoints(`/password`)
+	self.setupMagicLinkEndpoints(`/magic-link`)
+	self.setupFederationEndpoints(`/federation`)
+	self.setupSamlEndpoints(`/saml`)
 	self.setupDiscoveryEndpoint(`/.well-known/openid-configuration`)
 	self.setupIntrospectionEndpoint(`/api/introspection`)
 	self.setupJwksEndpoint(`/api/jwks`)
 	self.setupRevocationEndpoint(`/api/revocation`)
 	self.setupTokenEndpoint(`/api/token`)
+	self.setupUserInfoEndpoint(`/api/userinfo`)
+	self.setupUnlockEndpoint(`/api/admin/unlock`)
+	self.setupScimEndpoint(`/scim/v2`)
+}
+
+func (self *AuthorizationServer) setupTenant() {
+	// Tell the endpoints the tenant, e.g. to use its user store.
+	if self.Tenant != nil {
+		self.Engine.Use(Tenant_Handler(self.Tenant))
+	}
 }
 
 func (self *AuthorizationServer) setupStatic() {
 	self.Engine.Static(`css`, `./css`)
+	self.Engine.Static(`js`, `./js`)
 }
 
 func (self *AuthorizationServer) setupTemplates() {
-	self.Engine.LoadHTMLGlob("templates/*")
+	prefix := ``
+	if self.Tenant != nil {
+		prefix = self.Tenant.PathPrefix
+	}
+
+	// Links in templates are written as {{ path "/registration" }} so that
+	// they carry the path prefix of the tenant.
+	functions := template.FuncMap{
+		"path": func(path string) string { return prefix + path },
+	}
+
+	templates := template.Must(template.New(``).Funcs(functions).ParseGlob("templates/*"))
+
+	// Templates of the tenant replace the default ones of the same names.
+	if self.Tenant != nil && self.Tenant.Templates != `` {
+		templates = template.Must(templates.ParseGlob(self.Tenant.Templates + "/*"))
+	}
+
+	self.Engine.SetHTMLTemplate(templates)
+}
+
+func (self *AuthorizationServer) setupTracing() {
+	// A span for each request. The trace context in the request is used
+	// as the parent.
+	self.Engine.Use(otelgin.Middleware(tracerName))
+}
+
+func (self *AuthorizationServer) setupMetrics(path string) {
+	// Measure the requests to the endpoints registered after this.
+	self.Engine.Use(RequestMetrics_Handler())
+
+	// When METRICS_ADDR is set, metrics are served there by Run() and not
+	// on the public listener.
+	if getConfiguration(`METRICS_ADDR`, ``) != `` {
+		return
+	}
+
+	// Metrics in the Prometheus text format, which are served only to
+	// those who present METRICS_TOKEN.
+	if token := getConfiguration(`METRICS_TOKEN`, ``); token != `` {
+		self.Engine.GET(path, MetricsAuthentication_Handler(token), MetricsEndpoint_Handler())
+	}
 }
 
 func (self *AuthorizationServer) setupSession() {
@@ -79,7 +359,13 @@ func (self *AuthorizationServer) setupSession() {
 	store := memstore.NewStore(key)
 
 	// Session for gin
-	self.Engine.Use(sessions.Sessions("AuthorizationServerSession", store))
+	name := "AuthorizationServerSession"
+	if self.Tenant != nil {
+		name = self.Tenant.SessionCookie
+	}
+
+	self.Engine.Use(sessions.Sessions(name, store))
+	self.sessionStore = store
 }
 
 func (self *AuthorizationServer) setupAuthleteApi() {
@@ -91,26 +377,169 @@ func (self *AuthorizationServer) setupAuthleteApi() {
 	// middleware.AuthleteApi_Conf(conf.AuthleteConfiguration) reads settings
 	// from a given AuthleteConfiguration.
 	//
-	// The following code loads `authlete.toml`.
-	self.Engine.Use(middleware.AuthleteApi_Toml(`authlete.toml`))
+	// AuthleteApi_Instance(api.AuthleteApi) uses a given instance as is.
+	if self.ApiMiddleware != nil {
+		self.Engine.Use(self.ApiMiddleware)
+	} else if path := getConfiguration(`AUTHLETE_API_REPLAY`, ``); path != `` {
+		// Serve the exchanges recorded with AUTHLETE_API_RECORD instead of
+		// calling Authlete.
+		replayer, err := AuthleteApiReplayer_Load(path)
+		if err != nil {
+			panic(fmt.Sprintf("authorization_server: Failed to load recordings: %s", err))
+		}
+		self.Engine.Use(AuthleteApi_Instance(replayer))
+	} else {
+		// The following code loads `authlete.toml`.
+		self.Engine.Use(middleware.AuthleteApi_Toml(`authlete.toml`))
+	}
+
+	// Decorate the calls of Authlete APIs. The first decorator is the
+	// closest to Authlete, so the others see one call per call of this
+	// server however many times it is retried.
+	//
+	// AuthleteApi_Resilience applies timeouts, retries and the circuit
+	// breaker. AuthleteApi_Record records the exchanges with Authlete to a
+	// file if requested. AuthleteApi_Metrics measures the calls and their
+	// outcomes. AuthleteApi_Audit records issued and revoked tokens in the
+	// audit log. AuthleteApi_Tracing wraps the calls in spans.
+	self.breaker = CircuitBreaker_New()
+	decorators := []AuthleteApiDecorator{
+		AuthleteApi_Resilience(AuthleteApiPolicy_New(), self.breaker),
+	}
+	if path := getConfiguration(`AUTHLETE_API_RECORD`, ``); path != `` {
+		decorators = append(decorators, AuthleteApi_Record(path))
+	}
+	decorators = append(decorators,
+		AuthleteApi_Metrics(),
+		AuthleteApi_Audit(),
+		AuthleteApi_Tracing(),
+	)
+	self.Engine.Use(AuthleteApi_Decorate(decorators...))
+}
+
+// authleteGuard returns middleware which rejects requests quickly while
+// Authlete is unavailable. It is registered to endpoints which cannot work
+// without Authlete.
+func (self *AuthorizationServer) authleteGuard() gin.HandlerFunc {
+	return AuthleteAvailability_Handler(self.breaker)
+}
+
+func (self *AuthorizationServer) setupHealthEndpoints(livenessPath string, readinessPath string) {
+	// Dependencies checked by the readiness probe
+	readiness := Readiness_New()
+	readiness.Add(`session`, func(api.AuthleteApi) error {
+		return checkStoreHealth(self.sessionStore)
+	})
+	readiness.Add(`userStore`, func(api.AuthleteApi) error {
+		if self.Tenant != nil && self.Tenant.UserStore != nil {
+			return checkStoreHealth(self.Tenant.UserStore)
+		}
+		return checkStoreHealth(UserStore_Get())
+	})
+	readiness.Add(`throttleStore`, func(api.AuthleteApi) error {
+		return checkStoreHealth(LoginThrottle_Get().Store)
+	})
+	readiness.Add(`authlete`, AuthleteHealthCheck)
+
+	self.Engine.GET(livenessPath, LivenessEndpoint_Handler())
+	self.Engine.GET(readinessPath, ReadinessEndpoint_Handler(readiness))
+	self.readiness = readiness
 }
 
 func (self *AuthorizationServer) setupAuthorizationEndpoint(path string) {
 	handler := AuthorizationEndpoint_Handler()
+	guard := self.authleteGuard()
 
 	// Authorization endpoint (RFC 6749)
-	self.Engine.GET(path, handler)
-	self.Engine.POST(path, handler)
+	self.Engine.GET(path, guard, handler)
+	self.Engine.POST(path, guard, handler)
 }
 
 func (self *AuthorizationServer) setupAuthorizationDecisionEndpoint(path string) {
 	// Authorization decision endpoint
-	self.Engine.POST(path, AuthorizationDecisionEndpoint_Handler())
+	self.Engine.POST(path, self.authleteGuard(), AuthorizationDecisionEndpoint_Handler())
+}
+
+func (self *AuthorizationServer) setupMfaEndpoint(path string) {
+	// Endpoint to which the second factor is presented
+	self.Engine.POST(path, self.authleteGuard(), MfaEndpoint_Handler())
+}
+
+func (self *AuthorizationServer) setupMfaEnrollmentEndpoint(path string) {
+	handler := MfaEnrollmentEndpoint_Handler()
+
+	// Endpoint to enroll a second factor (RFC 6238 TOTP)
+	self.Engine.GET(path, handler)
+	self.Engine.POST(path, handler)
+}
+
+func (self *AuthorizationServer) setupWebAuthnEndpoints(path string) {
+	endpoint := WebAuthnEndpoint_New(self.Tenant)
+
+	// Registration and authentication ceremonies of WebAuthn (passkeys)
+	self.Engine.POST(path+`/registration/options`, endpoint.RegistrationOptionsHandler())
+	self.Engine.POST(path+`/registration`, endpoint.RegistrationHandler())
+	self.Engine.POST(path+`/login/options`, endpoint.LoginOptionsHandler())
+	self.Engine.POST(path+`/login`, endpoint.LoginHandler())
+}
+
+func (self *AuthorizationServer) setupPasskeyPage(path string) {
+	// Page to register a passkey
+	self.Engine.GET(path, PasskeyPage_Handler())
+}
+
+func (self *AuthorizationServer) setupRegistrationEndpoint(path string) {
+	handler := RegistrationEndpoint_Handler()
+
+	// Self-service user registration
+	self.Engine.GET(path, handler)
+	self.Engine.POST(path, handler)
+}
+
+func (self *AuthorizationServer) setupEmailVerificationEndpoint(path string) {
+	// Endpoint which the link in a verification mail points to. The link
+	// is used when the page is posted.
+	verification := EmailVerificationEndpoint_Handler()
+	self.Engine.GET(path, verification)
+	self.Engine.POST(path, verification)
+}
+
+func (self *AuthorizationServer) setupPasswordResetEndpoints(path string) {
+	forgot := PasswordForgotEndpoint_Handler()
+	reset := PasswordResetEndpoint_Handler()
+
+	// Pages to ask for a password reset mail and to set a new password
+	self.Engine.GET(path+`/forgot`, forgot)
+	self.Engine.POST(path+`/forgot`, forgot)
+	self.Engine.GET(path+`/reset`, reset)
+	self.Engine.POST(path+`/reset`, reset)
+}
+
+func (self *AuthorizationServer) setupMagicLinkEndpoints(path string) {
+	// Endpoints to send a login link and to log in by the link. The link
+	// is used when the page is posted.
+	login := MagicLinkLoginEndpoint_Handler()
+	self.Engine.POST(path, MagicLinkEndpoint_Handler())
+	self.Engine.GET(path+`/login`, login)
+	self.Engine.POST(path+`/login`, login)
+}
+
+func (self *AuthorizationServer) setupFederationEndpoints(path string) {
+	// Endpoints to log in with external identity providers
+	self.Engine.GET(path+`/login/:name`, FederationLoginEndpoint_Handler())
+	self.Engine.GET(path+`/callback/:name`, FederationCallbackEndpoint_Handler())
+}
+
+func (self *AuthorizationServer) setupSamlEndpoints(path string) {
+	// Endpoints to log in with SAML 2.0 identity providers
+	self.Engine.GET(path+`/login/:name`, SamlLoginEndpoint_Handler())
+	self.Engine.POST(path+`/acs/:name`, SamlAcsEndpoint_Handler())
+	self.Engine.GET(path+`/metadata/:name`, SamlMetadataEndpoint_Handler())
 }
 
 func (self *AuthorizationServer) setupDiscoveryEndpoint(path string) {
 	// Discovery endpoint (OpenID Connect Discovery 1.0)
-	self.Engine.GET(path, endpoint.DiscoveryEndpoint_Handler())
+	self.Engine.GET(path, self.authleteGuard(), endpoint.DiscoveryEndpoint_Handler())
 }
 
 func (self *AuthorizationServer) setupIntrospectionEndpoint(path string) {
@@ -125,23 +554,55 @@ func (self *AuthorizationServer) setupIntrospectionEndpoint(path string) {
 	handler := endpoint.IntrospectionEndpoint_Handler(authenticate, reject)
 
 	// Introspection endpoint (RFC 7662)
-	self.Engine.POST(path, handler)
+	self.Engine.POST(path, self.authleteGuard(), handler)
 }
 
 func (self *AuthorizationServer) setupJwksEndpoint(path string) {
 	// JWK Set Document (RFC 7517)
-	self.Engine.GET(path, endpoint.JwksEndpoint_Handler())
+	self.Engine.GET(path, self.authleteGuard(), endpoint.JwksEndpoint_Handler())
 }
 
 func (self *AuthorizationServer) setupRevocationEndpoint(path string) {
 	// Revocation endpoint (RFC 7009)
-	self.Engine.POST(path, endpoint.RevocationEndpoint_Handler())
+	self.Engine.POST(path, self.authleteGuard(), endpoint.RevocationEndpoint_Handler())
 }
 
 func (self *AuthorizationServer) setupTokenEndpoint(path string) {
 	// Token endpoint (RFC 6749)
-	spi := TokenReqHandlerSpiImpl{}
-	self.Engine.POST(path, endpoint.TokenEndpoint_Handler(&spi))
+	self.Engine.POST(path, self.authleteGuard(), func(ctx *gin.Context) {
+		// The SPI implementation needs the IP address of the client
+		// to throttle password grants.
+		spi := TokenReqHandlerSpiImpl_New(ctx)
+		endpoint.TokenEndpoint_Handler(spi)(ctx)
+	})
+}
+
+func (self *AuthorizationServer) setupUserInfoEndpoint(path string) {
+	// UserInfo endpoint (OpenID Connect Core 1.0, 5.3)
+	self.Engine.GET(path, self.authleteGuard(), UserInfoEndpoint_Handler())
+	self.Engine.POST(path, self.authleteGuard(), UserInfoEndpoint_Handler())
+}
+
+func (self *AuthorizationServer) setupUnlockEndpoint(path string) {
+	endpoint := UnlockEndpoint_New()
+
+	// Administrative endpoint to lift a lockout of an account or an
+	// IP address. Requests are authorized by access tokens.
+	self.Engine.POST(path, self.authleteGuard(), endpoint.Authenticate(), endpoint.Unlock())
+}
+
+func (self *AuthorizationServer) setupScimEndpoint(path string) {
+	endpoint := ScimEndpoint_New()
+
+	// SCIM 2.0 endpoint to provision users. Requests are authorized by
+	// access tokens.
+	users := self.Engine.Group(path+`/Users`, self.authleteGuard(), endpoint.Authenticate())
+	users.GET(``, endpoint.List())
+	users.POST(``, endpoint.Create())
+	users.GET(`/:id`, endpoint.Get())
+	users.PUT(`/:id`, endpoint.Replace())
+	users.PATCH(`/:id`, endpoint.Patch())
+	users.DELETE(`/:id`, endpoint.Delete())
 }
 
 // NOTE: The following functions are for demonstration purposes only.
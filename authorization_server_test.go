@@ -0,0 +1,96 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/authlete/authlete-go/api"
+	"github.com/authlete/authlete-go/dto"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	// A token request which is in flight when the server is asked to stop.
+	fake := FakeAuthleteApi_New()
+	started := make(chan struct{})
+	fake.TokenFunc = func(request *dto.TokenRequest) (*dto.TokenResponse, *api.AuthleteError) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		return &dto.TokenResponse{Action: dto.TokenAction_OK, ResponseContent: `{"access_token":"x"}`}, nil
+	}
+
+	loginThrottleInstance = LoginThrottle_New(MemoryThrottleStore_New())
+	auditLogInstance = &AuditLog{Redact: map[string]bool{}}
+
+	server := AuthorizationServer_NewWithApi(fake)
+	server.ShutdownDelay = 200 * time.Millisecond
+	server.ShutdownTimeout = 5 * time.Second
+
+	listener, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := `http://` + listener.Addr().String()
+
+	ctx, stop := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ctx, listener)
+	}()
+
+	tokens := make(chan int, 1)
+	go func() {
+		res, err := http.PostForm(base+`/api/token`, url.Values{`grant_type`: {`client_credentials`}})
+		if err != nil {
+			tokens <- 0
+			return
+		}
+		res.Body.Close()
+		tokens <- res.StatusCode
+	}()
+
+	<-started
+	stop()
+	time.Sleep(50 * time.Millisecond)
+
+	// The readiness probe fails while requests are drained.
+	res, err := http.Get(base + `/readyz`)
+	if err != nil {
+		t.Fatalf("The server stopped accepting requests before the delay: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 503 {
+		t.Errorf("The readiness probe returned %d during the shutdown.", res.StatusCode)
+	}
+
+	if status := <-tokens; status != 200 {
+		t.Errorf("The token request in flight ended with %d.", status)
+	}
+
+	if err := <-served; err != nil {
+		t.Errorf("Serve() returned an error: %s", err)
+	}
+
+	if _, err := http.Get(base + `/healthz`); err == nil {
+		t.Error("The server still accepts requests after the shutdown.")
+	}
+}
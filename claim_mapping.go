@@ -0,0 +1,263 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/BurntSushi/toml"
+	"github.com/authlete/authlete-go/dto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	claimMappingInstance *ClaimMapping
+)
+
+func init() {
+	// Custom claims are defined in `claims.toml`. The file is optional.
+	claimMappingInstance = ClaimMapping_Load(getConfiguration(`CLAIMS_CONFIG`, `claims.toml`))
+}
+
+// ClaimRule tells how the value of a claim is computed. Exactly one of
+// Attribute, Constant and Template is used.
+type ClaimRule struct {
+	// Name of a custom attribute of the user, or a standard claim.
+	Attribute string `toml:"attribute"`
+
+	// Fixed value of any type.
+	Constant interface{} `toml:"constant"`
+
+	// text/template over the claims of the user, e.g.
+	// "{{ .LoginId }}@example.com". See claimTemplateView.
+	Template string `toml:"template"`
+
+	// Type of the value: "string", "number", "boolean", "array" or "json".
+	// If empty, the value is used as is.
+	Type string `toml:"type"`
+
+	template *template.Template
+}
+
+type ClaimMapping struct {
+	Claims map[string]*ClaimRule `toml:"claims"`
+}
+
+// Functions available in templates
+var claimTemplateFuncs = template.FuncMap{
+	`lower`: strings.ToLower,
+	`upper`: strings.ToUpper,
+	`join`: func(separator string, values interface{}) string {
+		return strings.Join(toStrings(values), separator)
+	},
+	`json`: func(value interface{}) (string, error) {
+		bytes, err := json.Marshal(value)
+		return string(bytes), err
+	},
+}
+
+func ClaimMapping_Load(file string) *ClaimMapping {
+	mapping := ClaimMapping{}
+
+	if _, err := os.Stat(file); err != nil {
+		return &mapping
+	}
+
+	if _, err := toml.DecodeFile(file, &mapping); err != nil {
+		panic(fmt.Sprintf("claim_mapping: Failed to load %s: %s", file, err))
+	}
+
+	// Parse templates in advance so that errors are found at startup.
+	for name, rule := range mapping.Claims {
+		if rule.Template == `` {
+			continue
+		}
+
+		t, err := template.New(name).Funcs(claimTemplateFuncs).Option(`missingkey=zero`).Parse(rule.Template)
+		if err != nil {
+			panic(fmt.Sprintf("claim_mapping: The template of '%s' is invalid: %s", name, err))
+		}
+
+		rule.template = t
+	}
+
+	return &mapping
+}
+
+func ClaimMapping_Get() *ClaimMapping {
+	return claimMappingInstance
+}
+
+// Has returns true if the claim is defined in the mapping.
+func (self *ClaimMapping) Has(claimName string) bool {
+	_, ok := self.Claims[claimName]
+
+	return ok
+}
+
+// Get computes the value of the claim for the user. nil is returned if the
+// claim is not defined or the user does not have a value for it.
+func (self *ClaimMapping) Get(user *UserEntity, claimName string) interface{} {
+	rule := self.Claims[claimName]
+	if rule == nil {
+		return nil
+	}
+
+	var value interface{}
+
+	switch {
+	case rule.Constant != nil:
+		value = rule.Constant
+	case rule.template != nil:
+		buffer := bytes.Buffer{}
+		if err := rule.template.Execute(&buffer, claimTemplateView_Of(user)); err != nil {
+			msg := fmt.Sprintf("claim_mapping: Failed to compute '%s': %s", claimName, err)
+			log.Warn().Msg(msg)
+			return nil
+		}
+		value = buffer.String()
+	case rule.Attribute != ``:
+		value = user.Attributes[rule.Attribute]
+		if value == nil {
+			value = user.standardClaim(rule.Attribute)
+		}
+	}
+
+	if value == nil || value == `` {
+		return nil
+	}
+
+	converted, err := convertClaimValue(value, rule.Type)
+	if err != nil {
+		msg := fmt.Sprintf("claim_mapping: The value of '%s' is not of type '%s': %s", claimName, rule.Type, err)
+		log.Warn().Msg(msg)
+		return nil
+	}
+
+	return converted
+}
+
+// claimTemplateView is what templates in `claims.toml` can read. Secrets of
+// the user, e.g. the password and the TOTP secret, are deliberately not in
+// it so that a template cannot copy them into tokens.
+type claimTemplateView struct {
+	Subject             string
+	LoginId             string
+	GivenName           string
+	FamilyName          string
+	MiddleName          string
+	Nickname            string
+	PreferredUsername   string
+	Profile             string
+	Picture             string
+	Website             string
+	Email               string
+	EmailVerified       bool
+	Gender              string
+	Birthdate           string
+	Zoneinfo            string
+	Locale              string
+	PhoneNumber         string
+	PhoneNumberVerified bool
+	Address             dto.Address
+	UpdatedAt           int64
+	Attributes          map[string]interface{}
+}
+
+func claimTemplateView_Of(user *UserEntity) *claimTemplateView {
+	return &claimTemplateView{
+		Subject:             user.Subject,
+		LoginId:             user.LoginId,
+		GivenName:           user.GivenName,
+		FamilyName:          user.FamilyName,
+		MiddleName:          user.MiddleName,
+		Nickname:            user.Nickname,
+		PreferredUsername:   user.PreferredUsername,
+		Profile:             user.Profile,
+		Picture:             user.Picture,
+		Website:             user.Website,
+		Email:               user.Email,
+		EmailVerified:       user.EmailVerified,
+		Gender:              user.Gender,
+		Birthdate:           user.Birthdate,
+		Zoneinfo:            user.Zoneinfo,
+		Locale:              user.Locale,
+		PhoneNumber:         user.PhoneNumber,
+		PhoneNumberVerified: user.PhoneNumberVerified,
+		Address:             user.Address,
+		UpdatedAt:           user.UpdatedAt,
+		Attributes:          user.Attributes,
+	}
+}
+
+func convertClaimValue(value interface{}, kind string) (interface{}, error) {
+	switch kind {
+	case ``:
+		return value, nil
+	case `string`:
+		values := toStrings(value)
+		if len(values) == 0 {
+			return nil, nil
+		}
+		return values[0], nil
+	case `array`:
+		return toStrings(value), nil
+	case `number`:
+		if s, ok := value.(string); ok {
+			return strconv.ParseFloat(strings.TrimSpace(s), 64)
+		}
+		return value, nil
+	case `boolean`:
+		if s, ok := value.(string); ok {
+			return strconv.ParseBool(strings.TrimSpace(s))
+		}
+		return value, nil
+	case `json`:
+		if s, ok := value.(string); ok {
+			var parsed interface{}
+			err := json.Unmarshal([]byte(s), &parsed)
+			return parsed, err
+		}
+		return value, nil
+	default:
+		return nil, fmt.Errorf("unknown type")
+	}
+}
+
+// toStrings converts a value or a list of values into strings.
+func toStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return []string{}
+	case []string:
+		return v
+	case []interface{}:
+		values := []string{}
+		for _, e := range v {
+			values = append(values, fmt.Sprint(e))
+		}
+		return values
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
@@ -0,0 +1,66 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testClaimMapping_Load(t *testing.T, content string) *ClaimMapping {
+	file := filepath.Join(t.TempDir(), `claims.toml`)
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return ClaimMapping_Load(file)
+}
+
+func TestClaimTemplates(t *testing.T) {
+	mapping := testClaimMapping_Load(t, `
+[claims.upn]
+template = "{{ .LoginId }}@{{ .Attributes.tenant_id }}.example.com"
+
+[claims.password]
+template = "{{ .Password }}"
+
+[claims.totp]
+template = "{{ .TotpSecret }}"
+
+[claims.recovery]
+template = "{{ .RecoveryCodes }}"
+`)
+
+	user := &UserEntity{
+		LoginId:       `john`,
+		Password:      `john`,
+		TotpSecret:    `JBSWY3DPEHPK3PXP`,
+		RecoveryCodes: []string{`recovery`},
+		Attributes:    map[string]interface{}{`tenant_id`: `acme`},
+	}
+
+	if value := mapping.Get(user, `upn`); value != `john@acme.example.com` {
+		t.Errorf("upn = %v", value)
+	}
+
+	for _, name := range []string{`password`, `totp`, `recovery`} {
+		if value := mapping.Get(user, name); value != nil {
+			t.Errorf("%s = %v; secrets must not be readable by templates", name, value)
+		}
+	}
+}
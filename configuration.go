@@ -0,0 +1,85 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// NOTE: Settings of this implementation are read from environment variables.
+// Change this as necessary.
+
+func getConfiguration(key string, defaultValue string) string {
+	value, ok := os.LookupEnv(key)
+
+	if ok == false || value == `` {
+		return defaultValue
+	}
+
+	return value
+}
+
+func getConfigurationList(key string, defaultValue string) []string {
+	values := []string{}
+
+	// Comma-separated list
+	for _, value := range strings.Split(getConfiguration(key, defaultValue), `,`) {
+		value = strings.TrimSpace(value)
+
+		if value != `` {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+// getConfigurationNumber returns the value of the key if it is a number not
+// less than 'minimum'. Otherwise, it returns the default value.
+func getConfigurationNumber(key string, defaultValue int, minimum int) int {
+	number, err := strconv.Atoi(getConfiguration(key, strconv.Itoa(defaultValue)))
+	if err != nil || number < minimum {
+		msg := fmt.Sprintf("configuration: The value of %s is not a number of %d or more. %d is used.", key, minimum, defaultValue)
+		log.Warn().Msg(msg)
+		return defaultValue
+	}
+
+	return number
+}
+
+func getConfigurationSeconds(key string, defaultValue int) time.Duration {
+	seconds, err := strconv.Atoi(getConfiguration(key, strconv.Itoa(defaultValue)))
+	if err != nil {
+		msg := fmt.Sprintf("configuration: The value of %s is not a number of seconds.", key)
+		log.Warn().Msg(msg)
+		seconds = defaultValue
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+func getServerBaseUrl() string {
+	// Used to build links sent by mail. It is not derived from the Host
+	// header of requests, which can be forged.
+	return strings.TrimSuffix(getConfiguration(`SERVER_BASE_URL`, `http://localhost:8080`), `/`)
+}
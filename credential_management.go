@@ -0,0 +1,117 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+// NOTE: THIS IS A DUMMY IMPLEMENTATION JUST FOR DEMONSTRATION
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/authlete/authlete-go/types"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+var (
+	credentialDatabaseInstance *CredentialDatabase
+)
+
+func init() {
+	credentialDatabaseInstance = CredentialDatabase_New()
+}
+
+// CredentialDatabase holds WebAuthn credentials (passkeys) keyed by the
+// subject of the user who registered them.
+type CredentialDatabase struct {
+	Credentials map[string][]webauthn.Credential
+	mutex       sync.Mutex
+}
+
+func CredentialDatabase_New() *CredentialDatabase {
+	db := CredentialDatabase{}
+	db.Credentials = map[string][]webauthn.Credential{}
+
+	return &db
+}
+
+func CredentialDatabase_Get() *CredentialDatabase {
+	return credentialDatabaseInstance
+}
+
+func (self *CredentialDatabase) GetBySubject(subject string) []webauthn.Credential {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	// Return a copy not to let the caller modify the database.
+	return append([]webauthn.Credential{}, self.Credentials[subject]...)
+}
+
+func (self *CredentialDatabase) Add(subject string, credential *webauthn.Credential) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.Credentials[subject] = append(self.Credentials[subject], *credential)
+}
+
+func (self *CredentialDatabase) Update(subject string, credential *webauthn.Credential) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	credentials := self.Credentials[subject]
+
+	for i := range credentials {
+		if bytes.Equal(credentials[i].ID, credential.ID) {
+			// e.g. the signature counter
+			credentials[i].Authenticator = credential.Authenticator
+			return
+		}
+	}
+}
+
+// WebAuthnUser adapts UserEntity to the user model of the WebAuthn library.
+type WebAuthnUser struct {
+	Entity      *UserEntity
+	credentials []webauthn.Credential
+}
+
+func WebAuthnUser_New(entity *UserEntity, db *CredentialDatabase) *WebAuthnUser {
+	user := WebAuthnUser{}
+	user.Entity = entity
+	user.credentials = db.GetBySubject(entity.Subject)
+
+	return &user
+}
+
+func (self *WebAuthnUser) WebAuthnID() []byte {
+	// The user handle. It is returned by authenticators on usernameless
+	// login and used to find the user.
+	return []byte(self.Entity.Subject)
+}
+
+func (self *WebAuthnUser) WebAuthnName() string {
+	return self.Entity.LoginId
+}
+
+func (self *WebAuthnUser) WebAuthnDisplayName() string {
+	name, _ := self.Entity.GetClaim(types.CLAIM_NAME, ``).(string)
+
+	return name
+}
+
+func (self *WebAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return self.credentials
+}
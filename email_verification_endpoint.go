@@ -0,0 +1,124 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	linkPurposeEmailVerification = `email_verification`
+
+	// Lifetime of links to verify email addresses.
+	emailVerificationLifetime = 24 * time.Hour
+)
+
+func sendVerificationMail(ctx *gin.Context, user *UserEntity) error {
+	token := LinkTokenIssuer_Get().Issue(tenantNameOf(ctx), linkPurposeEmailVerification, user, emailVerificationLifetime)
+	link := getServerBaseUrlOf(ctx) + `/email/verification?token=` + url.QueryEscape(token)
+
+	body := fmt.Sprintf("Hello %s,\r\n\r\n"+
+		"Open the following link to verify your email address.\r\n\r\n%s\r\n\r\n"+
+		"The link expires in 24 hours.\r\n", user.GivenName, link)
+
+	return MailSender_Get().Send(user.Email, `Verify your email address`, body)
+}
+
+func EmailVerificationEndpoint_Handler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		// Session
+		session := sessions.Default(ctx)
+
+		issuer := LinkTokenIssuer_Get()
+
+		if ctx.Request.Method != `POST` {
+			// Check the link before asking for the confirmation, but
+			// leave it usable.
+			token := ctx.Query(`token`)
+			if _, err := issuer.Verify(token, tenantNameOf(ctx), linkPurposeEmailVerification); err != nil {
+				renderMessagePage(ctx, 400, `Email Verification`,
+					`The link is invalid or has expired.`)
+				return
+			}
+
+			renderConfirmationPage(ctx, `Email Verification`, `Confirm your email address.`,
+				`/email/verification`, token, `Confirm`)
+			return
+		}
+
+		// The link can be used only once.
+		link, err := issuer.Consume(ctx.PostForm(`token`), tenantNameOf(ctx), linkPurposeEmailVerification)
+		if err != nil {
+			renderMessagePage(ctx, 400, `Email Verification`,
+				`The link is invalid or has expired.`)
+			return
+		}
+
+		subject := link.Subject
+
+		// The link verifies only the address to which it was sent.
+		db := UserStore_Of(ctx)
+		if link.IsFor(db.GetBySubject(subject)) == false {
+			renderMessagePage(ctx, 400, `Email Verification`,
+				`The link is invalid or has expired.`)
+			return
+		}
+
+		if db.UpdateEmailVerified(subject, true) == false {
+			renderMessagePage(ctx, 400, `Email Verification`, `The account does not exist.`)
+			return
+		}
+
+		msg := fmt.Sprintf("email_verification_endpoint: An email address was verified. The subject is '%s'.", subject)
+		log.Debug().Msg(msg)
+
+		// If the user has just registered in this browser and has waited
+		// for the verification to log in.
+		value := session.Get(`pendingRegistration`)
+		if pending, _ := value.(string); pending == subject {
+			session.Delete(`pendingRegistration`)
+
+			user := db.GetBySubject(subject)
+			loginUser(ctx, session, user, []string{Amr_PWD})
+
+			// Continue the pending authorization request if any.
+			if resumeAuthorization(ctx, session, user) {
+				return
+			}
+		}
+
+		renderMessagePage(ctx, 200, `Email Verification`, `Your email address has been verified.`)
+	}
+}
+
+func renderMessagePage(ctx *gin.Context, status int, title string, message string) {
+	model := MessagePageModel{Title: title, Message: message}
+	ctx.HTML(status, `message.html`, gin.H{"model": model})
+}
+
+// renderConfirmationPage renders a page with a button which posts the token
+// of a link to 'action'.
+func renderConfirmationPage(ctx *gin.Context, title string, message string, action string, token string, button string) {
+	model := MessagePageModel{Title: title, Message: message, Action: action, Token: token, Button: button}
+	ctx.HTML(200, `message.html`, gin.H{"model": model})
+}
@@ -0,0 +1,675 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/authlete/authlete-go/api"
+	"github.com/authlete/authlete-go/dto"
+	"github.com/authlete/authlete-go/types"
+)
+
+// FakeAuthleteApi is an in-process stand-in for Authlete which enables the
+// endpoints to be tested without network.
+//
+// By default, it behaves like a minimal Authlete service which supports the
+// authorization code flow, the resource owner password credentials flow and
+// the client credentials flow. Tickets, authorization codes and access tokens
+// are kept in memory. Any client is accepted.
+//
+// A response can be scripted by setting the corresponding function, e.g.
+//
+//	fake := FakeAuthleteApi_New()
+//	fake.TokenFunc = func(req *dto.TokenRequest) (*dto.TokenResponse, *api.AuthleteError) {
+//	    return &dto.TokenResponse{Action: dto.TokenAction_INVALID_CLIENT}, nil
+//	}
+//
+// Methods of api.AuthleteApi which are not implemented here panic.
+type FakeAuthleteApi struct {
+	api.AuthleteApi
+
+	// Issuer identifier written in the discovery document.
+	Issuer string
+
+	// Default redirect URI used when an authorization request does not
+	// contain 'redirect_uri'.
+	RedirectUri string
+
+	AuthorizationFunc           func(*dto.AuthorizationRequest) (*dto.AuthorizationResponse, *api.AuthleteError)
+	AuthorizationIssueFunc      func(*dto.AuthorizationIssueRequest) (*dto.AuthorizationIssueResponse, *api.AuthleteError)
+	AuthorizationFailFunc       func(*dto.AuthorizationFailRequest) (*dto.AuthorizationFailResponse, *api.AuthleteError)
+	TokenFunc                   func(*dto.TokenRequest) (*dto.TokenResponse, *api.AuthleteError)
+	TokenIssueFunc              func(*dto.TokenIssueRequest) (*dto.TokenIssueResponse, *api.AuthleteError)
+	TokenFailFunc               func(*dto.TokenFailRequest) (*dto.TokenFailResponse, *api.AuthleteError)
+	IntrospectionFunc           func(*dto.IntrospectionRequest) (*dto.IntrospectionResponse, *api.AuthleteError)
+	StandardIntrospectionFunc   func(*dto.StandardIntrospectionRequest) (*dto.StandardIntrospectionResponse, *api.AuthleteError)
+	RevocationFunc              func(*dto.RevocationRequest) (*dto.RevocationResponse, *api.AuthleteError)
+	UserInfoFunc                func(*dto.UserInfoRequest) (*dto.UserInfoResponse, *api.AuthleteError)
+	UserInfoIssueFunc           func(*dto.UserInfoIssueRequest) (*dto.UserInfoIssueResponse, *api.AuthleteError)
+	GetServiceJwksFunc          func(pretty bool, includePrivateKeys bool) (string, *api.AuthleteError)
+	GetServiceConfigurationFunc func(pretty bool) (string, *api.AuthleteError)
+
+	calls   []FakeAuthleteApiCall
+	tickets map[string]*fakeGrant
+	codes   map[string]*fakeGrant
+	tokens  map[string]*fakeGrant
+	mutex   sync.Mutex
+}
+
+// FakeAuthleteApiCall records a call of FakeAuthleteApi.
+type FakeAuthleteApiCall struct {
+	Method  string
+	Request interface{}
+}
+
+// fakeGrant holds what an authorization request, a code or a token is for.
+type fakeGrant struct {
+	ClientId       string
+	RedirectUri    string
+	State          string
+	Subject        string
+	Scopes         []string
+	IdTokenClaims  string
+	UserInfoClaims string
+}
+
+func FakeAuthleteApi_New() *FakeAuthleteApi {
+	fake := FakeAuthleteApi{}
+	fake.Issuer = `http://localhost:8080`
+	fake.RedirectUri = `https://client.example.com/callback`
+	fake.tickets = map[string]*fakeGrant{}
+	fake.codes = map[string]*fakeGrant{}
+	fake.tokens = map[string]*fakeGrant{}
+
+	return &fake
+}
+
+// Calls returns the calls made so far in order.
+func (self *FakeAuthleteApi) Calls() []FakeAuthleteApiCall {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return append([]FakeAuthleteApiCall{}, self.calls...)
+}
+
+// LastRequest returns the request of the last call of the method, or nil.
+func (self *FakeAuthleteApi) LastRequest(method string) interface{} {
+	calls := self.Calls()
+
+	for i := len(calls) - 1; 0 <= i; i-- {
+		if calls[i].Method == method {
+			return calls[i].Request
+		}
+	}
+
+	return nil
+}
+
+// IssueAccessToken registers an access token so that it can be presented
+// to the endpoints which call the introspection and userinfo APIs.
+func (self *FakeAuthleteApi) IssueAccessToken(subject string, scopes ...string) string {
+	return self.issueToken(&fakeGrant{Subject: subject, Scopes: scopes})
+}
+
+func (self *FakeAuthleteApi) record(method string, request interface{}) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.calls = append(self.calls, FakeAuthleteApiCall{Method: method, Request: request})
+}
+
+func (self *FakeAuthleteApi) Authorization(request *dto.AuthorizationRequest) (*dto.AuthorizationResponse, *api.AuthleteError) {
+	self.record(`Authorization`, request)
+
+	if self.AuthorizationFunc != nil {
+		return self.AuthorizationFunc(request)
+	}
+
+	res := dto.AuthorizationResponse{}
+	params, _ := url.ParseQuery(request.Parameters)
+
+	clientId := params.Get(`client_id`)
+	if clientId == `` {
+		res.Action = dto.AuthorizationAction_BAD_REQUEST
+		res.ResponseContent = fakeErrorJson(`invalid_request`, `client_id is missing.`)
+		return &res, nil
+	}
+
+	grant := fakeGrant{}
+	grant.ClientId = clientId
+	grant.RedirectUri = params.Get(`redirect_uri`)
+	grant.State = params.Get(`state`)
+	grant.Scopes = strings.Fields(params.Get(`scope`))
+
+	if grant.RedirectUri == `` {
+		grant.RedirectUri = self.RedirectUri
+	}
+
+	// Errors after this point are reported to the client.
+	if params.Get(`response_type`) != `code` {
+		res.Action = dto.AuthorizationAction_LOCATION
+		res.ResponseContent = fakeRedirect(grant.RedirectUri, url.Values{
+			`error`: {`unsupported_response_type`}, `state`: {grant.State}})
+		return &res, nil
+	}
+
+	// The "claims" request parameter (OIDC Core 1.0, 5.5)
+	claims := map[string]json.RawMessage{}
+	json.Unmarshal([]byte(params.Get(`claims`)), &claims)
+	grant.IdTokenClaims = string(claims[`id_token`])
+	grant.UserInfoClaims = string(claims[`userinfo`])
+
+	idTokenClaims := map[string]json.RawMessage{}
+	json.Unmarshal(claims[`id_token`], &idTokenClaims)
+
+	for name := range idTokenClaims {
+		if name != `sub` && name != Claim_VERIFIED_CLAIMS {
+			res.Claims = append(res.Claims, name)
+		}
+	}
+
+	// A specific subject may be required by "claims" or "id_token_hint".
+	sub := struct {
+		Value string `json:"value"`
+	}{}
+	json.Unmarshal(idTokenClaims[`sub`], &sub)
+
+	// An essential "acr" claim request takes precedence over 'acr_values'.
+	acr := struct {
+		Essential bool     `json:"essential"`
+		Values    []string `json:"values"`
+	}{}
+	json.Unmarshal(idTokenClaims[`acr`], &acr)
+
+	maxAge, _ := strconv.ParseUint(params.Get(`max_age`), 10, 32)
+
+	res.Service = &dto.Service{ServiceName: `Fake Service`}
+	res.Client = &dto.Client{ClientName: `Fake Client ` + clientId, ClientIdAlias: clientId}
+	res.MaxAge = uint32(maxAge)
+	res.Subject = sub.Value
+	res.LoginHint = params.Get(`login_hint`)
+	res.UiLocales = strings.Fields(params.Get(`ui_locales`))
+	res.ClaimsLocales = strings.Fields(params.Get(`claims_locales`))
+	res.Acrs = strings.Fields(params.Get(`acr_values`))
+	if acr.Essential && len(acr.Values) != 0 {
+		res.Acrs = acr.Values
+		res.AcrEssential = true
+	}
+	res.IdTokenClaims = grant.IdTokenClaims
+	res.UserInfoClaims = grant.UserInfoClaims
+	res.Ticket = randomString()
+	res.Action = dto.AuthorizationAction_INTERACTION
+
+	if clientId, err := strconv.ParseUint(clientId, 10, 64); err == nil {
+		res.Client.ClientId = clientId
+	}
+
+	for _, scope := range grant.Scopes {
+		res.Scopes = append(res.Scopes, dto.Scope{Name: scope})
+	}
+
+	for _, prompt := range strings.Fields(params.Get(`prompt`)) {
+		res.Prompts = append(res.Prompts, types.Prompt(prompt))
+
+		if prompt == string(types.Prompt_NONE) {
+			res.Action = dto.AuthorizationAction_NO_INTERACTION
+		}
+	}
+
+	self.mutex.Lock()
+	self.tickets[res.Ticket] = &grant
+	self.mutex.Unlock()
+
+	return &res, nil
+}
+
+func (self *FakeAuthleteApi) AuthorizationIssue(request *dto.AuthorizationIssueRequest) (*dto.AuthorizationIssueResponse, *api.AuthleteError) {
+	self.record(`AuthorizationIssue`, request)
+
+	if self.AuthorizationIssueFunc != nil {
+		return self.AuthorizationIssueFunc(request)
+	}
+
+	res := dto.AuthorizationIssueResponse{}
+
+	grant := self.takeTicket(request.Ticket)
+	if grant == nil {
+		res.Action = dto.AuthorizationIssueAction_BAD_REQUEST
+		res.ResponseContent = fakeErrorJson(`invalid_request`, `The ticket is unknown.`)
+		return &res, nil
+	}
+
+	grant.Subject = request.Subject
+	if request.Sub != `` {
+		grant.Subject = request.Sub
+	}
+
+	code := randomString()
+
+	self.mutex.Lock()
+	self.codes[code] = grant
+	self.mutex.Unlock()
+
+	res.Action = dto.AuthorizationIssueAction_LOCATION
+	res.AuthorizationCode = code
+	res.ResponseContent = fakeRedirect(grant.RedirectUri, url.Values{`code`: {code}, `state`: {grant.State}})
+
+	return &res, nil
+}
+
+func (self *FakeAuthleteApi) AuthorizationFail(request *dto.AuthorizationFailRequest) (*dto.AuthorizationFailResponse, *api.AuthleteError) {
+	self.record(`AuthorizationFail`, request)
+
+	if self.AuthorizationFailFunc != nil {
+		return self.AuthorizationFailFunc(request)
+	}
+
+	res := dto.AuthorizationFailResponse{}
+
+	grant := self.takeTicket(request.Ticket)
+	if grant == nil {
+		res.Action = dto.AuthorizationFailAction_BAD_REQUEST
+		res.ResponseContent = fakeErrorJson(`invalid_request`, `The ticket is unknown.`)
+		return &res, nil
+	}
+
+	// Error codes which Authlete reports for the reasons.
+	errorCode := `server_error`
+	switch request.Reason {
+	case dto.AuthorizationFailReason_DENIED:
+		errorCode = `access_denied`
+	case dto.AuthorizationFailReason_NOT_LOGGED_IN, dto.AuthorizationFailReason_NOT_AUTHENTICATED,
+		dto.AuthorizationFailReason_LOGIN_REQUIRED, dto.AuthorizationFailReason_ACR_NOT_SATISFIED:
+		errorCode = `login_required`
+	}
+
+	res.Action = dto.AuthorizationFailAction_LOCATION
+	res.ResponseContent = fakeRedirect(grant.RedirectUri, url.Values{`error`: {errorCode}, `state`: {grant.State}})
+
+	return &res, nil
+}
+
+func (self *FakeAuthleteApi) Token(request *dto.TokenRequest) (*dto.TokenResponse, *api.AuthleteError) {
+	self.record(`Token`, request)
+
+	if self.TokenFunc != nil {
+		return self.TokenFunc(request)
+	}
+
+	res := dto.TokenResponse{}
+	params, _ := url.ParseQuery(request.Parameters)
+	res.GrantType = params.Get(`grant_type`)
+
+	switch res.GrantType {
+	case `authorization_code`:
+		self.mutex.Lock()
+		grant := self.codes[params.Get(`code`)]
+		delete(self.codes, params.Get(`code`))
+		self.mutex.Unlock()
+
+		if grant == nil || grant.RedirectUri != params.Get(`redirect_uri`) && params.Get(`redirect_uri`) != `` {
+			res.Action = dto.TokenAction_BAD_REQUEST
+			res.ResponseContent = fakeErrorJson(`invalid_grant`, `The authorization code is invalid.`)
+			return &res, nil
+		}
+
+		res.Action = dto.TokenAction_OK
+		res.Subject = grant.Subject
+		res.ResponseContent = self.tokenResponseContent(grant)
+	case `password`:
+		grant := fakeGrant{Scopes: strings.Fields(params.Get(`scope`))}
+		res.Action = dto.TokenAction_PASSWORD
+		res.Username = params.Get(`username`)
+		res.Password = params.Get(`password`)
+		res.Ticket = randomString()
+
+		self.mutex.Lock()
+		self.tickets[res.Ticket] = &grant
+		self.mutex.Unlock()
+	case `client_credentials`:
+		grant := fakeGrant{Scopes: strings.Fields(params.Get(`scope`))}
+		res.Action = dto.TokenAction_OK
+		res.ResponseContent = self.tokenResponseContent(&grant)
+	default:
+		res.Action = dto.TokenAction_BAD_REQUEST
+		res.ResponseContent = fakeErrorJson(`unsupported_grant_type`, `The grant type is not supported.`)
+	}
+
+	return &res, nil
+}
+
+func (self *FakeAuthleteApi) TokenIssue(request *dto.TokenIssueRequest) (*dto.TokenIssueResponse, *api.AuthleteError) {
+	self.record(`TokenIssue`, request)
+
+	if self.TokenIssueFunc != nil {
+		return self.TokenIssueFunc(request)
+	}
+
+	res := dto.TokenIssueResponse{}
+
+	grant := self.takeTicket(request.Ticket)
+	if grant == nil {
+		res.Action = dto.TokenIssueAction_INTERNAL_SERVER_ERROR
+		res.ResponseContent = fakeErrorJson(`server_error`, `The ticket is unknown.`)
+		return &res, nil
+	}
+
+	grant.Subject = request.Subject
+	res.Action = dto.TokenIssueAction_OK
+	res.ResponseContent = self.tokenResponseContent(grant)
+
+	return &res, nil
+}
+
+func (self *FakeAuthleteApi) TokenFail(request *dto.TokenFailRequest) (*dto.TokenFailResponse, *api.AuthleteError) {
+	self.record(`TokenFail`, request)
+
+	if self.TokenFailFunc != nil {
+		return self.TokenFailFunc(request)
+	}
+
+	self.takeTicket(request.Ticket)
+
+	res := dto.TokenFailResponse{}
+	res.Action = dto.TokenFailAction_BAD_REQUEST
+	res.ResponseContent = fakeErrorJson(`invalid_grant`, `The resource owner's credentials are invalid.`)
+
+	return &res, nil
+}
+
+func (self *FakeAuthleteApi) Introspection(request *dto.IntrospectionRequest) (*dto.IntrospectionResponse, *api.AuthleteError) {
+	self.record(`Introspection`, request)
+
+	if self.IntrospectionFunc != nil {
+		return self.IntrospectionFunc(request)
+	}
+
+	res := dto.IntrospectionResponse{}
+
+	grant := self.findToken(request.Token)
+	if grant == nil {
+		res.Action = dto.IntrospectionAction_UNAUTHORIZED
+		res.ResponseContent = `Bearer error="invalid_token",error_description="The access token is invalid."`
+		return &res, nil
+	}
+
+	for _, scope := range request.Scopes {
+		if containsString(grant.Scopes, scope) == false {
+			res.Action = dto.IntrospectionAction_FORBIDDEN
+			res.ResponseContent = `Bearer error="insufficient_scope",scope="` + strings.Join(request.Scopes, ` `) + `"`
+			return &res, nil
+		}
+	}
+
+	if request.Subject != `` && request.Subject != grant.Subject {
+		res.Action = dto.IntrospectionAction_FORBIDDEN
+		res.ResponseContent = `Bearer error="invalid_token",error_description="The subject does not match."`
+		return &res, nil
+	}
+
+	res.Action = dto.IntrospectionAction_OK
+	res.Subject = grant.Subject
+	res.Scopes = grant.Scopes
+	res.Usable = true
+
+	return &res, nil
+}
+
+func (self *FakeAuthleteApi) StandardIntrospection(request *dto.StandardIntrospectionRequest) (*dto.StandardIntrospectionResponse, *api.AuthleteError) {
+	self.record(`StandardIntrospection`, request)
+
+	if self.StandardIntrospectionFunc != nil {
+		return self.StandardIntrospectionFunc(request)
+	}
+
+	params, _ := url.ParseQuery(request.Parameters)
+	content := map[string]interface{}{`active`: false}
+
+	if grant := self.findToken(params.Get(`token`)); grant != nil {
+		content[`active`] = true
+		content[`scope`] = strings.Join(grant.Scopes, ` `)
+		content[`client_id`] = grant.ClientId
+		content[`sub`] = grant.Subject
+	}
+
+	bytes, _ := json.Marshal(content)
+
+	res := dto.StandardIntrospectionResponse{}
+	res.Action = dto.StandardIntrospectionAction_OK
+	res.ResponseContent = string(bytes)
+
+	return &res, nil
+}
+
+func (self *FakeAuthleteApi) Revocation(request *dto.RevocationRequest) (*dto.RevocationResponse, *api.AuthleteError) {
+	self.record(`Revocation`, request)
+
+	if self.RevocationFunc != nil {
+		return self.RevocationFunc(request)
+	}
+
+	params, _ := url.ParseQuery(request.Parameters)
+
+	// Unknown tokens are not an error (RFC 7009, 2.2).
+	self.mutex.Lock()
+	delete(self.tokens, params.Get(`token`))
+	self.mutex.Unlock()
+
+	res := dto.RevocationResponse{}
+	res.Action = dto.RevocationAction_OK
+
+	return &res, nil
+}
+
+func (self *FakeAuthleteApi) UserInfo(request *dto.UserInfoRequest) (*dto.UserInfoResponse, *api.AuthleteError) {
+	self.record(`UserInfo`, request)
+
+	if self.UserInfoFunc != nil {
+		return self.UserInfoFunc(request)
+	}
+
+	res := dto.UserInfoResponse{}
+
+	grant := self.findToken(request.Token)
+	if grant == nil {
+		res.Action = dto.UserInfoAction_UNAUTHORIZED
+		res.ResponseContent = `Bearer error="invalid_token",error_description="The access token is invalid."`
+		return &res, nil
+	}
+
+	if containsString(grant.Scopes, `openid`) == false {
+		res.Action = dto.UserInfoAction_FORBIDDEN
+		res.ResponseContent = `Bearer error="insufficient_scope",scope="openid"`
+		return &res, nil
+	}
+
+	res.Action = dto.UserInfoAction_OK
+	res.Subject = grant.Subject
+	res.Claims = fakeScopeClaims(grant.Scopes)
+	res.UserInfoClaims = grant.UserInfoClaims
+
+	userInfoClaims := map[string]json.RawMessage{}
+	json.Unmarshal([]byte(grant.UserInfoClaims), &userInfoClaims)
+
+	for name := range userInfoClaims {
+		if name != `sub` && name != Claim_VERIFIED_CLAIMS && containsString(res.Claims, name) == false {
+			res.Claims = append(res.Claims, name)
+		}
+	}
+
+	return &res, nil
+}
+
+func (self *FakeAuthleteApi) UserInfoIssue(request *dto.UserInfoIssueRequest) (*dto.UserInfoIssueResponse, *api.AuthleteError) {
+	self.record(`UserInfoIssue`, request)
+
+	if self.UserInfoIssueFunc != nil {
+		return self.UserInfoIssueFunc(request)
+	}
+
+	res := dto.UserInfoIssueResponse{}
+
+	grant := self.findToken(request.Token)
+	if grant == nil {
+		res.Action = dto.UserInfoIssueAction_UNAUTHORIZED
+		res.ResponseContent = `Bearer error="invalid_token",error_description="The access token is invalid."`
+		return &res, nil
+	}
+
+	claims := map[string]interface{}{}
+	json.Unmarshal([]byte(request.Claims), &claims)
+
+	claims[`sub`] = grant.Subject
+	if request.Sub != `` {
+		claims[`sub`] = request.Sub
+	}
+
+	bytes, _ := json.Marshal(claims)
+
+	res.Action = dto.UserInfoIssueAction_JSON
+	res.ResponseContent = string(bytes)
+
+	return &res, nil
+}
+
+func (self *FakeAuthleteApi) GetServiceJwks(pretty bool, includePrivateKeys bool) (string, *api.AuthleteError) {
+	self.record(`GetServiceJwks`, nil)
+
+	if self.GetServiceJwksFunc != nil {
+		return self.GetServiceJwksFunc(pretty, includePrivateKeys)
+	}
+
+	return `{"keys":[]}`, nil
+}
+
+func (self *FakeAuthleteApi) GetServiceConfiguration(pretty bool) (string, *api.AuthleteError) {
+	self.record(`GetServiceConfiguration`, nil)
+
+	if self.GetServiceConfigurationFunc != nil {
+		return self.GetServiceConfigurationFunc(pretty)
+	}
+
+	configuration := map[string]interface{}{
+		`issuer`:                   self.Issuer,
+		`authorization_endpoint`:   self.Issuer + `/api/authorization`,
+		`token_endpoint`:           self.Issuer + `/api/token`,
+		`userinfo_endpoint`:        self.Issuer + `/api/userinfo`,
+		`jwks_uri`:                 self.Issuer + `/api/jwks`,
+		`introspection_endpoint`:   self.Issuer + `/api/introspection`,
+		`revocation_endpoint`:      self.Issuer + `/api/revocation`,
+		`response_types_supported`: []string{`code`},
+		`grant_types_supported`:    []string{`authorization_code`, `password`, `client_credentials`},
+		`subject_types_supported`:  []string{`public`},
+		`scopes_supported`:         []string{`openid`, `profile`, `email`, `phone`, `address`},
+	}
+
+	bytes, _ := json.Marshal(configuration)
+	if pretty {
+		bytes, _ = json.MarshalIndent(configuration, ``, `  `)
+	}
+
+	return string(bytes), nil
+}
+
+func (self *FakeAuthleteApi) takeTicket(ticket string) *fakeGrant {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	// A ticket can be used only once.
+	grant := self.tickets[ticket]
+	delete(self.tickets, ticket)
+
+	return grant
+}
+
+func (self *FakeAuthleteApi) findToken(token string) *fakeGrant {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.tokens[token]
+}
+
+func (self *FakeAuthleteApi) issueToken(grant *fakeGrant) string {
+	token := randomString()
+
+	self.mutex.Lock()
+	self.tokens[token] = grant
+	self.mutex.Unlock()
+
+	return token
+}
+
+func (self *FakeAuthleteApi) tokenResponseContent(grant *fakeGrant) string {
+	content := map[string]interface{}{
+		`access_token`: self.issueToken(grant),
+		`token_type`:   `Bearer`,
+		`expires_in`:   int64(time.Hour / time.Second),
+		`scope`:        strings.Join(grant.Scopes, ` `),
+	}
+
+	bytes, _ := json.Marshal(content)
+
+	return string(bytes)
+}
+
+// fakeScopeClaims returns the claims which the scopes stand for (OIDC Core
+// 1.0, 5.4).
+func fakeScopeClaims(scopes []string) []string {
+	claims := []string{}
+
+	for _, scope := range scopes {
+		switch scope {
+		case `profile`:
+			claims = append(claims, types.CLAIM_NAME, types.CLAIM_FAMILY_NAME, types.CLAIM_GIVEN_NAME,
+				types.CLAIM_MIDDLE_NAME, types.CLAIM_NICKNAME, types.CLAIM_PREFERRED_USERNAME,
+				types.CLAIM_PROFILE, types.CLAIM_PICTURE, types.CLAIM_WEBSITE, types.CLAIM_GENDER,
+				types.CLAIM_BIRTHDATE, types.CLAIM_ZONEINFO, types.CLAIM_LOCALE, types.CLAIM_UPDATED_AT)
+		case `email`:
+			claims = append(claims, types.CLAIM_EMAIL, types.CLAIM_EMAIL_VERIFIED)
+		case `phone`:
+			claims = append(claims, types.CLAIM_PHONE_NUMBER, types.CLAIM_PHONE_NUMBER_VERIFIED)
+		case `address`:
+			claims = append(claims, types.CLAIM_ADDRESS)
+		}
+	}
+
+	return claims
+}
+
+func fakeRedirect(redirectUri string, params url.Values) string {
+	if params.Get(`state`) == `` {
+		params.Del(`state`)
+	}
+
+	separator := `?`
+	if strings.Contains(redirectUri, `?`) {
+		separator = `&`
+	}
+
+	return redirectUri + separator + params.Encode()
+}
+
+func fakeErrorJson(errorCode string, description string) string {
+	return fmt.Sprintf(`{"error":"%s","error_description":"%s"}`, errorCode, description)
+}
@@ -0,0 +1,226 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+)
+
+var (
+	federationInstance *Federation
+)
+
+func init() {
+	// Upstream OpenID providers are listed in `federation.toml`. When the
+	// file does not exist, login with external identity providers is not
+	// offered.
+	federationInstance = Federation_Load(getConfiguration(`FEDERATION_CONFIG`, `federation.toml`))
+}
+
+type FederationConfiguration struct {
+	Providers     []IdentityProviderConfiguration `toml:"providers"`
+	SamlProviders []SamlProviderConfiguration     `toml:"saml_providers"`
+}
+
+type IdentityProviderConfiguration struct {
+	// Identifier used in URLs and in linked accounts, e.g. "corporate".
+	Name string `toml:"name"`
+
+	// Label of the button on the login form.
+	DisplayName string `toml:"display_name"`
+
+	Issuer       string   `toml:"issuer"`
+	ClientId     string   `toml:"client_id"`
+	ClientSecret string   `toml:"client_secret"`
+	Scopes       []string `toml:"scopes"`
+
+	// If true, a local user who has the same verified email address is
+	// linked on the first login. Enable this only for providers which are
+	// trusted to verify email addresses.
+	LinkByEmail bool `toml:"link_by_email"`
+
+	// Values of "amr" which the provider is trusted to report, e.g. "hwk".
+	// Others are ignored. See federatedAmr.
+	TrustedAmr []string `toml:"trusted_amr"`
+}
+
+// IdentityProvider is an upstream OpenID provider. Its discovery document
+// is fetched on first use.
+type IdentityProvider struct {
+	Configuration IdentityProviderConfiguration
+	provider      *oidc.Provider
+	mutex         sync.Mutex
+}
+
+type Federation struct {
+	Providers     []*IdentityProvider
+	SamlProviders []*SamlProvider
+}
+
+func Federation_Load(file string) *Federation {
+	federation := Federation{}
+
+	if _, err := os.Stat(file); err != nil {
+		return &federation
+	}
+
+	config := FederationConfiguration{}
+	if _, err := toml.DecodeFile(file, &config); err != nil {
+		panic(fmt.Sprintf("federation: Failed to load %s: %s", file, err))
+	}
+
+	for _, c := range config.Providers {
+		federation.Providers = append(federation.Providers, &IdentityProvider{Configuration: c})
+	}
+
+	for _, c := range config.SamlProviders {
+		federation.SamlProviders = append(federation.SamlProviders, &SamlProvider{Configuration: c})
+	}
+
+	return &federation
+}
+
+func Federation_Get() *Federation {
+	return federationInstance
+}
+
+func (self *Federation) GetProvider(name string) *IdentityProvider {
+	for _, provider := range self.Providers {
+		if provider.Configuration.Name == name {
+			return provider
+		}
+	}
+
+	return nil
+}
+
+// Buttons on the login form
+type IdentityProviderLink struct {
+	Url         string
+	DisplayName string
+}
+
+func (self *Federation) Links() []IdentityProviderLink {
+	links := []IdentityProviderLink{}
+
+	for _, provider := range self.Providers {
+		name := provider.Configuration.DisplayName
+		if name == `` {
+			name = provider.Configuration.Name
+		}
+
+		links = append(links, IdentityProviderLink{
+			Url: `/federation/login/` + provider.Configuration.Name, DisplayName: name})
+	}
+
+	for _, provider := range self.SamlProviders {
+		name := provider.Configuration.DisplayName
+		if name == `` {
+			name = provider.Configuration.Name
+		}
+
+		links = append(links, IdentityProviderLink{
+			Url: `/saml/login/` + provider.Configuration.Name, DisplayName: name})
+	}
+
+	return links
+}
+
+// federatedAmr returns the authentication methods of a user who has logged
+// in through an identity provider. The login counts as "fed", and only the
+// methods reported by the provider which are listed in 'trusted' are added.
+// Otherwise, any provider could claim e.g. "hwk" and achieve the strongest
+// ACR.
+func federatedAmr(reported []string, trusted []string) []string {
+	amr := []string{Amr_FED}
+
+	for _, method := range reported {
+		if containsString(trusted, method) && containsString(amr, method) == false {
+			amr = append(amr, method)
+		}
+	}
+
+	return amr
+}
+
+// RedirectUri returns the redirection endpoint of this server under
+// 'baseUrl', e.g. the base URL of a tenant.
+func (self *IdentityProvider) RedirectUri(baseUrl string) string {
+	return baseUrl + `/federation/callback/` + self.Configuration.Name
+}
+
+func (self *IdentityProvider) discover(ctx context.Context) (*oidc.Provider, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.provider != nil {
+		return self.provider, nil
+	}
+
+	// OpenID Connect Discovery 1.0
+	provider, err := oidc.NewProvider(ctx, self.Configuration.Issuer)
+	if err != nil {
+		msg := fmt.Sprintf("federation: Discovery of '%s' failed: %s", self.Configuration.Issuer, err)
+		log.Warn().Msg(msg)
+		return nil, err
+	}
+
+	self.provider = provider
+
+	return provider, nil
+}
+
+func (self *IdentityProvider) OAuth2Config(ctx context.Context, baseUrl string) (*oauth2.Config, error) {
+	provider, err := self.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := self.Configuration.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, `profile`, `email`}
+	}
+
+	config := oauth2.Config{
+		ClientID:     self.Configuration.ClientId,
+		ClientSecret: self.Configuration.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  self.RedirectUri(baseUrl),
+		Scopes:       scopes,
+	}
+
+	return &config, nil
+}
+
+func (self *IdentityProvider) Verifier(ctx context.Context) (*oidc.IDTokenVerifier, error) {
+	provider, err := self.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The signature, the issuer, the audience and the expiration time of
+	// ID tokens are verified.
+	return provider.Verifier(&oidc.Config{ClientID: self.Configuration.ClientId}), nil
+}
@@ -0,0 +1,279 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+)
+
+// Parameters of an authorization request sent to an identity provider,
+// which are kept in the session until the user comes back.
+type federationRequest struct {
+	Provider string
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+// Claims of an ID token issued by an identity provider.
+type upstreamClaims struct {
+	Subject       string   `json:"sub"`
+	Name          string   `json:"name"`
+	GivenName     string   `json:"given_name"`
+	FamilyName    string   `json:"family_name"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Amr           []string `json:"amr"`
+}
+
+func FederationLoginEndpoint_Handler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		// Session
+		session := sessions.Default(ctx)
+
+		provider := Federation_Get().GetProvider(ctx.Param(`name`))
+		if provider == nil {
+			renderMessagePage(ctx, 404, `Login`, `The identity provider is unknown.`)
+			return
+		}
+
+		config, err := provider.OAuth2Config(ctx.Request.Context(), getServerBaseUrlOf(ctx))
+		if err != nil {
+			renderMessagePage(ctx, 502, `Login`, `The identity provider is not available.`)
+			return
+		}
+
+		// 'state' against CSRF, 'nonce' against replay of ID tokens and
+		// PKCE (RFC 7636) against interception of authorization codes.
+		request := federationRequest{
+			Provider: provider.Configuration.Name,
+			State:    randomString(),
+			Nonce:    randomString(),
+			Verifier: oauth2.GenerateVerifier(),
+		}
+
+		bytes, _ := json.Marshal(request)
+		session.Set(`federationRequest`, bytes)
+		session.Save()
+
+		// Authorization code flow with the identity provider.
+		location := config.AuthCodeURL(request.State,
+			oidc.Nonce(request.Nonce), oauth2.S256ChallengeOption(request.Verifier))
+
+		ctx.Redirect(302, location)
+	}
+}
+
+func FederationCallbackEndpoint_Handler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		// Session
+		session := sessions.Default(ctx)
+
+		// The request can be used only once.
+		request := takeFederationRequest(session)
+
+		provider := Federation_Get().GetProvider(ctx.Param(`name`))
+		if provider == nil || request == nil || request.Provider != provider.Configuration.Name ||
+			request.State != ctx.Query(`state`) {
+			renderMessagePage(ctx, 400, `Login`, `The login request is invalid or has expired.`)
+			return
+		}
+
+		// If the identity provider returned an error, e.g. access_denied.
+		if e := ctx.Query(`error`); e != `` {
+			msg := fmt.Sprintf("federation_endpoint: The identity provider returned an error: %s", e)
+			log.Debug().Msg(msg)
+			renderMessagePage(ctx, 401, `Login`, `Login with the identity provider failed.`)
+			return
+		}
+
+		claims, err := exchangeCode(ctx, provider, request)
+		if err != nil {
+			msg := fmt.Sprintf("federation_endpoint: Login with '%s' failed: %s", provider.Configuration.Name, err)
+			log.Debug().Msg(msg)
+			renderMessagePage(ctx, 401, `Login`, `Login with the identity provider failed.`)
+			return
+		}
+
+		// Find the local user linked to the account, or provision one.
+		config := provider.Configuration
+		user, err := findOrProvisionUser(ctx, config.Name, config.LinkByEmail, claims)
+		if err != nil {
+			msg := fmt.Sprintf("federation_endpoint: Failed to provision a user: %s", err)
+			log.Warn().Msg(msg)
+			renderMessagePage(ctx, 500, `Login`, `Failed to create an account.`)
+			return
+		}
+
+		completeFederatedLogin(ctx, session, user, federatedAmr(claims.Amr, config.TrustedAmr))
+	}
+}
+
+// completeFederatedLogin lets the user authenticated by an external identity
+// provider log in and continues the pending authorization request if any.
+func completeFederatedLogin(ctx *gin.Context, session sessions.Session, user *UserEntity, amr []string) {
+	if user.Disabled {
+		renderMessagePage(ctx, 403, `Login`, `The account is disabled.`)
+		return
+	}
+
+	msg := fmt.Sprintf("federation_endpoint: User authentication succeeded. The subject is '%s'.", user.Subject)
+	log.Debug().Msg(msg)
+
+	loginUser(ctx, session, user, amr)
+
+	if resumeAuthorization(ctx, session, user) {
+		return
+	}
+
+	renderMessagePage(ctx, 200, `Login`, `You have logged in.`)
+}
+
+func takeFederationRequest(session sessions.Session) *federationRequest {
+	value := session.Get(`federationRequest`)
+	if value == nil {
+		return nil
+	}
+
+	session.Delete(`federationRequest`)
+	session.Save()
+
+	bytes, _ := value.([]byte)
+
+	request := federationRequest{}
+	if json.Unmarshal(bytes, &request) != nil {
+		return nil
+	}
+
+	return &request
+}
+
+func exchangeCode(ctx *gin.Context, provider *IdentityProvider,
+	request *federationRequest) (*upstreamClaims, error) {
+	context := ctx.Request.Context()
+
+	config, err := provider.OAuth2Config(context, getServerBaseUrlOf(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	// Token request with the PKCE code verifier
+	token, err := config.Exchange(context, ctx.Query(`code`), oauth2.VerifierOption(request.Verifier))
+	if err != nil {
+		return nil, err
+	}
+
+	rawIdToken, ok := token.Extra(`id_token`).(string)
+	if ok == false {
+		return nil, fmt.Errorf("the token response does not contain an ID token")
+	}
+
+	verifier, err := provider.Verifier(context)
+	if err != nil {
+		return nil, err
+	}
+
+	idToken, err := verifier.Verify(context, rawIdToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if idToken.Nonce != request.Nonce {
+		return nil, fmt.Errorf("the nonce in the ID token does not match")
+	}
+
+	claims := upstreamClaims{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	return &claims, nil
+}
+
+// findOrProvisionUser returns the local user linked to the account at the
+// identity provider named 'name'. 'linkByEmail' tells whether the provider is
+// trusted to verify email addresses.
+func findOrProvisionUser(ctx *gin.Context, name string, linkByEmail bool, claims *upstreamClaims) (*UserEntity, error) {
+	db := UserStore_Of(ctx)
+
+	// Tenants may share a user store, so links made in a tenant are
+	// recorded under the name of the tenant.
+	if tenant := tenantNameOf(ctx); tenant != `` {
+		name = tenant + `/` + name
+	}
+
+	identity := FederatedIdentity{Provider: name, Subject: claims.Subject}
+
+	// If the account has already been linked to a local user.
+	user := db.GetByFederatedIdentity(name, claims.Subject)
+	if user != nil {
+		return user, nil
+	}
+
+	// Link the account to a local user who has the same email address
+	// if the identity provider is trusted to verify email addresses. The
+	// address of the local user has to be verified too. Otherwise, whoever
+	// registered the address first would take over the account.
+	if linkByEmail && claims.EmailVerified && claims.Email != `` {
+		user = db.GetByEmail(claims.Email)
+		if user != nil && user.EmailVerified {
+			db.AddFederatedIdentity(user.Subject, identity)
+			return user, nil
+		}
+	}
+
+	// Just-in-time provisioning. The user does not have a password and
+	// can log in only through the identity provider.
+	user = &UserEntity{
+		LoginId:             name + `:` + claims.Subject,
+		GivenName:           claims.GivenName,
+		FamilyName:          claims.FamilyName,
+		Email:               claims.Email,
+		EmailVerified:       claims.EmailVerified,
+		FederatedIdentities: []FederatedIdentity{identity},
+	}
+
+	if user.GivenName == `` && user.FamilyName == `` {
+		user.GivenName = claims.Name
+	}
+
+	err := db.Create(user)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := fmt.Sprintf("federation_endpoint: A user was provisioned. The subject is '%s'.", user.Subject)
+	log.Debug().Msg(msg)
+
+	return user, nil
+}
+
+func randomString() string {
+	bytes := make([]byte, 24)
+	rand.Read(bytes)
+
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
@@ -0,0 +1,307 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/authlete/authlete-go/dto"
+)
+
+// testIdentityProvider is a minimal OpenID provider which issues ID tokens
+// signed with RS256.
+type testIdentityProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	// Claims of the ID tokens to issue.
+	Subject       string
+	Amr           []string
+	EmailVerified bool
+
+	mutex     sync.Mutex
+	nonce     string
+	challenge string
+}
+
+func testIdentityProvider_New(t *testing.T) *testIdentityProvider {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	idp := &testIdentityProvider{key: key, Subject: `upstream-user`}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/.well-known/openid-configuration`, func(w http.ResponseWriter, r *http.Request) {
+		issuer := idp.server.URL
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			`issuer`:                                issuer,
+			`authorization_endpoint`:                issuer + `/authorize`,
+			`token_endpoint`:                        issuer + `/token`,
+			`jwks_uri`:                              issuer + `/jwks`,
+			`id_token_signing_alg_values_supported`: []string{`RS256`},
+		})
+	})
+	mux.HandleFunc(`/jwks`, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{`keys`: []interface{}{map[string]interface{}{
+			`kty`: `RSA`,
+			`kid`: `test`,
+			`use`: `sig`,
+			`alg`: `RS256`,
+			`n`:   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+			`e`:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc(`/token`, idp.token)
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+// authorize plays the part of the authorization endpoint of the provider
+// and returns the parameters of the redirection back to this server.
+func (self *testIdentityProvider) authorize(t *testing.T, location string) url.Values {
+	request, err := url.Parse(location)
+	if err != nil {
+		t.Fatalf("Invalid redirection to the provider: %s", location)
+	}
+
+	params := request.Query()
+	if params.Get(`code_challenge_method`) != `S256` || params.Get(`nonce`) == `` {
+		t.Fatalf("The authorization request lacks PKCE or a nonce: %s", location)
+	}
+
+	self.mutex.Lock()
+	self.nonce = params.Get(`nonce`)
+	self.challenge = params.Get(`code_challenge`)
+	self.mutex.Unlock()
+
+	return url.Values{`code`: {`test-code`}, `state`: {params.Get(`state`)}}
+}
+
+func (self *testIdentityProvider) token(w http.ResponseWriter, r *http.Request) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	// PKCE (RFC 7636)
+	digest := sha256.Sum256([]byte(r.PostFormValue(`code_verifier`)))
+	if base64.RawURLEncoding.EncodeToString(digest[:]) != self.challenge {
+		w.Header().Set(`Content-Type`, `application/json`)
+		w.WriteHeader(400)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	claims := map[string]interface{}{
+		`iss`:   self.server.URL,
+		`sub`:   self.Subject,
+		`aud`:   `test-client`,
+		`iat`:   time.Now().Unix(),
+		`exp`:   time.Now().Add(time.Minute).Unix(),
+		`nonce`: self.nonce,
+		`email`: self.Subject + `@example.com`,
+	}
+	if self.EmailVerified {
+		claims[`email_verified`] = true
+	}
+	if self.Amr != nil {
+		claims[`amr`] = self.Amr
+	}
+
+	w.Header().Set(`Content-Type`, `application/json`)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		`access_token`: `upstream-access-token`,
+		`token_type`:   `Bearer`,
+		`id_token`:     self.sign(claims),
+	})
+}
+
+func (self *testIdentityProvider) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{`alg`: `RS256`, `kid`: `test`, `typ`: `JWT`})
+	payload, _ := json.Marshal(claims)
+
+	input := base64.RawURLEncoding.EncodeToString(header) + `.` + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, self.key, crypto.SHA256, digest[:])
+
+	return input + `.` + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func testFederation_Install(t *testing.T, idp *testIdentityProvider, trustedAmr []string) {
+	original := federationInstance
+	federationInstance = &Federation{Providers: []*IdentityProvider{{Configuration: IdentityProviderConfiguration{
+		Name:       `mock`,
+		Issuer:     idp.server.URL,
+		ClientId:   `test-client`,
+		TrustedAmr: trustedAmr,
+	}}}}
+	t.Cleanup(func() { federationInstance = original })
+}
+
+// testFederatedLogin logs in through the provider during an authorization
+// request and returns the ACR reported to Authlete.
+func testFederatedLogin(t *testing.T, idp *testIdentityProvider) string {
+	return testFederatedLoginWith(t, idp).Acr
+}
+
+// testFederatedLoginWith logs in through the provider with the local users
+// and returns the authorization issued.
+func testFederatedLoginWith(t *testing.T, idp *testIdentityProvider, users ...UserEntity) *dto.AuthorizationIssueRequest {
+	testUserStore_Install(t, users...)
+	browser := testBrowser_New(t)
+
+	browser.authorize(nil)
+
+	res := browser.get(`/federation/login/mock`, nil)
+	if res.Status != 302 {
+		t.Fatalf("The login endpoint returned %d: %s", res.Status, res.Body)
+	}
+
+	res = browser.get(`/federation/callback/mock`, idp.authorize(t, res.Header.Get(`Location`)))
+	if res.Status != 200 {
+		t.Fatalf("The callback endpoint returned %d: %s", res.Status, res.Body)
+	}
+
+	// The pending authorization request continues.
+	form := parseTestForm(t, res.Body, `authorization-form`)
+	expectCode(t, browser.submit(form, testDecision(``, ``, true)))
+
+	request, _ := browser.fake.LastRequest(`AuthorizationIssue`).(*dto.AuthorizationIssueRequest)
+	if request == nil {
+		t.Fatalf("No authorization was issued")
+	}
+
+	return request
+}
+
+func TestFederatedLogin(t *testing.T) {
+	idp := testIdentityProvider_New(t)
+	testFederation_Install(t, idp, nil)
+
+	if acr := testFederatedLogin(t, idp); acr != Acr_SINGLE_FACTOR {
+		t.Errorf("The ACR of a federated login is '%s'", acr)
+	}
+}
+
+func TestFederatedLoginIgnoresUntrustedAmr(t *testing.T) {
+	idp := testIdentityProvider_New(t)
+	idp.Amr = []string{Amr_HWK}
+	testFederation_Install(t, idp, nil)
+
+	if acr := testFederatedLogin(t, idp); acr != Acr_SINGLE_FACTOR {
+		t.Errorf("The 'amr' of an untrusted provider achieved '%s'", acr)
+	}
+}
+
+func TestFederatedLoginWithTrustedAmr(t *testing.T) {
+	idp := testIdentityProvider_New(t)
+	idp.Amr = []string{Amr_HWK, `mfa`}
+	testFederation_Install(t, idp, []string{Amr_HWK})
+
+	if acr := testFederatedLogin(t, idp); acr != Acr_PHISHING_RESISTANT {
+		t.Errorf("The trusted 'amr' did not achieve the ACR: '%s'", acr)
+	}
+}
+
+func TestFederatedLoginRejectsWrongNonce(t *testing.T) {
+	idp := testIdentityProvider_New(t)
+	testFederation_Install(t, idp, nil)
+	testUserStore_Install(t)
+	browser := testBrowser_New(t)
+
+	res := browser.get(`/federation/login/mock`, nil)
+	params := idp.authorize(t, res.Header.Get(`Location`))
+
+	idp.mutex.Lock()
+	idp.nonce = `another-nonce`
+	idp.mutex.Unlock()
+
+	if res = browser.get(`/federation/callback/mock`, params); res.Status != 401 {
+		t.Fatalf("An ID token with a wrong nonce was accepted: %d", res.Status)
+	}
+}
+
+func TestFederatedLoginLinksByVerifiedEmail(t *testing.T) {
+	idp := testIdentityProvider_New(t)
+	idp.EmailVerified = true
+	testFederation_Install(t, idp, nil)
+	federationInstance.Providers[0].Configuration.LinkByEmail = true
+
+	// Someone registered the address of the user without verifying it.
+	squatter := UserEntity{Subject: `squatter`, LoginId: `squatter`, Email: `upstream-user@example.com`}
+	if request := testFederatedLoginWith(t, idp, squatter); request.Subject == `squatter` {
+		t.Fatalf("The login was linked to a user whose email address is not verified")
+	}
+
+	owner := UserEntity{Subject: `owner`, LoginId: `owner`, Email: `upstream-user@example.com`, EmailVerified: true}
+	if request := testFederatedLoginWith(t, idp, owner); request.Subject != `owner` {
+		t.Fatalf("The login was not linked to the user with the verified address: '%s'", request.Subject)
+	}
+}
+
+func TestFederatedLoginInTenant(t *testing.T) {
+	idp := testIdentityProvider_New(t)
+	testFederation_Install(t, idp, nil)
+	users := testUserStore_Install(t)
+
+	browser, _, tenant, _ := testTenants(t)
+	browser.fake = tenant
+
+	res := browser.get(`/path/api/authorization`, testAuthorizationParams(nil))
+	if strings.Contains(res.Body, `href="/path/federation/login/mock"`) == false {
+		t.Fatalf("The link to the provider lacks the path prefix: %s", res.Body)
+	}
+
+	res = browser.get(`/path/federation/login/mock`, nil)
+	if res.Status != 302 {
+		t.Fatalf("The login endpoint of the tenant returned %d: %s", res.Status, res.Body)
+	}
+
+	location, _ := url.Parse(res.Header.Get(`Location`))
+	if redirectUri := location.Query().Get(`redirect_uri`); strings.HasSuffix(redirectUri, `/path/federation/callback/mock`) == false {
+		t.Fatalf("The provider calls back '%s'", redirectUri)
+	}
+
+	res = browser.get(`/path/federation/callback/mock`, idp.authorize(t, location.String()))
+	if res.Status != 200 {
+		t.Fatalf("The callback endpoint of the tenant returned %d: %s", res.Status, res.Body)
+	}
+
+	form := parseTestForm(t, res.Body, `authorization-form`)
+	expectCode(t, browser.submit(form, testDecision(``, ``, true)))
+
+	// The user is provisioned in the user store of the tenant.
+	if browser.issuedSubject() == `` {
+		t.Fatalf("No authorization was issued by the tenant")
+	}
+
+	if len(users.Users) != 0 {
+		t.Errorf("The user was provisioned in the user store of the default server: %v", users.Users)
+	}
+}
@@ -0,0 +1,241 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/authlete/authlete-go/api"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	HealthStatus_UP       = `up`
+	HealthStatus_DOWN     = `down`
+	HealthStatus_DRAINING = `draining`
+)
+
+// HealthChecker is implemented by stores which depend on external services,
+// e.g. a directory server or Redis.
+type HealthChecker interface {
+	CheckHealth() error
+}
+
+// HealthCheck checks a dependency. It receives the instance of
+// api.AuthleteApi of the request for checks which call Authlete.
+type HealthCheck func(instance api.AuthleteApi) error
+
+// HealthResult is the result of a check of a dependency.
+type HealthResult struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Duration  float64   `json:"durationMs"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// Readiness checks the dependencies of this server. Results are cached for
+// a while so that frequent probes do not overload the dependencies, and a
+// check which does not finish in time is reported as down. A check which is
+// still running is not started again.
+type Readiness struct {
+	Timeout  time.Duration
+	CacheTtl time.Duration
+
+	names    []string
+	checks   map[string]*readinessCheck
+	draining int32
+}
+
+type readinessCheck struct {
+	check   HealthCheck
+	mutex   sync.Mutex
+	result  *HealthResult
+	running chan struct{}
+}
+
+func Readiness_New() *Readiness {
+	readiness := Readiness{}
+	readiness.Timeout = getConfigurationSeconds(`HEALTH_CHECK_TIMEOUT`, 3)
+	readiness.CacheTtl = getConfigurationSeconds(`HEALTH_CHECK_CACHE_TTL`, 10)
+	readiness.checks = map[string]*readinessCheck{}
+
+	return &readiness
+}
+
+// Add registers a check of a dependency.
+func (self *Readiness) Add(name string, check HealthCheck) {
+	self.names = append(self.names, name)
+	self.checks[name] = &readinessCheck{check: check}
+}
+
+// SetDraining makes the server unready regardless of the dependencies. It
+// is called when the server is shutting down.
+func (self *Readiness) SetDraining() {
+	atomic.StoreInt32(&self.draining, 1)
+}
+
+func (self *Readiness) IsDraining() bool {
+	return atomic.LoadInt32(&self.draining) != 0
+}
+
+// Check checks the dependencies in parallel and returns their results.
+func (self *Readiness) Check(instance api.AuthleteApi) map[string]*HealthResult {
+	results := map[string]*HealthResult{}
+	mutex := sync.Mutex{}
+	group := sync.WaitGroup{}
+
+	for _, name := range self.names {
+		group.Add(1)
+
+		go func(name string, check *readinessCheck) {
+			defer group.Done()
+
+			result := self.run(check, instance)
+
+			mutex.Lock()
+			results[name] = result
+			mutex.Unlock()
+		}(name, self.checks[name])
+	}
+
+	group.Wait()
+
+	return results
+}
+
+func (self *Readiness) run(check *readinessCheck, instance api.AuthleteApi) *HealthResult {
+	check.mutex.Lock()
+
+	// The cached result is still fresh.
+	if check.result != nil && time.Since(check.result.CheckedAt) < self.CacheTtl {
+		result := check.result
+		check.mutex.Unlock()
+		return result
+	}
+
+	// Start the check unless it is already running.
+	running := check.running
+	if running == nil {
+		running = make(chan struct{})
+		check.running = running
+
+		go func() {
+			start := time.Now()
+			err := check.check(instance)
+
+			check.mutex.Lock()
+			check.result = healthResult(start, err)
+			check.running = nil
+			check.mutex.Unlock()
+
+			close(running)
+		}()
+	}
+
+	check.mutex.Unlock()
+
+	select {
+	case <-running:
+		check.mutex.Lock()
+		defer check.mutex.Unlock()
+		return check.result
+	case <-time.After(self.Timeout):
+		return &HealthResult{Status: HealthStatus_DOWN, Error: `timed out`,
+			Duration: float64(self.Timeout.Milliseconds()), CheckedAt: time.Now().UTC()}
+	}
+}
+
+func healthResult(start time.Time, err error) *HealthResult {
+	result := HealthResult{}
+	result.Status = HealthStatus_UP
+	result.Duration = float64(time.Since(start).Microseconds()) / 1000
+	result.CheckedAt = time.Now().UTC()
+
+	if err != nil {
+		result.Status = HealthStatus_DOWN
+		result.Error = err.Error()
+	}
+
+	return &result
+}
+
+// LivenessEndpoint_Handler returns the handler of the liveness probe. It
+// does not check any dependency so that an outage of a dependency does not
+// make the server restarted.
+func LivenessEndpoint_Handler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.JSON(200, gin.H{"status": HealthStatus_UP})
+	}
+}
+
+// ReadinessEndpoint_Handler returns the handler of the readiness probe. It
+// responds with 503 when any dependency is down or the server is shutting
+// down.
+func ReadinessEndpoint_Handler(readiness *Readiness) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if readiness.IsDraining() {
+			ctx.JSON(503, gin.H{"status": HealthStatus_DRAINING})
+			return
+		}
+
+		value, _ := ctx.Get(`AuthleteApi`)
+		instance, _ := value.(api.AuthleteApi)
+
+		results := readiness.Check(instance)
+
+		status := HealthStatus_UP
+		for _, result := range results {
+			if result.Status != HealthStatus_UP {
+				status = HealthStatus_DOWN
+			}
+		}
+
+		code := 200
+		if status != HealthStatus_UP {
+			code = 503
+		}
+
+		ctx.JSON(code, gin.H{"status": status, "checks": results})
+	}
+}
+
+// AuthleteHealthCheck checks that Authlete is reachable and accepts the
+// credentials of the service by getting the configuration of the service.
+func AuthleteHealthCheck(instance api.AuthleteApi) error {
+	if instance == nil {
+		return errors.New("no instance of AuthleteApi is available")
+	}
+
+	if _, err := instance.GetServiceConfiguration(false); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// checkStoreHealth checks a store. Stores which do not implement
+// HealthChecker, e.g. those in the memory, are always up.
+func checkStoreHealth(store interface{}) error {
+	if checker, ok := store.(HealthChecker); ok {
+		return checker.CheckHealth()
+	}
+
+	return nil
+}
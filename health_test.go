@@ -0,0 +1,102 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/authlete/authlete-go/api"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	browser := testBrowser_New(t)
+
+	if res := browser.get(`/healthz`, nil); res.Status != 200 {
+		t.Fatalf("The liveness probe returned %d: %s", res.Status, res.Body)
+	}
+
+	res := browser.get(`/readyz`, nil)
+	if res.Status != 200 {
+		t.Fatalf("The readiness probe returned %d: %s", res.Status, res.Body)
+	}
+
+	content := struct {
+		Status string                   `json:"status"`
+		Checks map[string]*HealthResult `json:"checks"`
+	}{}
+	json.Unmarshal([]byte(res.Body), &content)
+
+	for _, name := range []string{`session`, `userStore`, `throttleStore`, `authlete`} {
+		if result := content.Checks[name]; result == nil || result.Status != HealthStatus_UP {
+			t.Errorf("The dependency '%s' is not up: %s", name, res.Body)
+		}
+	}
+}
+
+func TestHealthAuthleteDown(t *testing.T) {
+	fake := FakeAuthleteApi_New()
+	fake.GetServiceConfigurationFunc = func(bool) (string, *api.AuthleteError) {
+		return ``, &api.AuthleteError{Cause: errors.New("connection refused")}
+	}
+
+	browser := testBrowser_NewWithApi(t, fake)
+
+	res := browser.get(`/readyz`, nil)
+	if res.Status != 503 {
+		t.Fatalf("The readiness probe returned %d while Authlete is down: %s", res.Status, res.Body)
+	}
+}
+
+func TestReadinessTimeoutAndCache(t *testing.T) {
+	calls := int32(0)
+	release := make(chan struct{})
+
+	readiness := Readiness_New()
+	readiness.Timeout = 50 * time.Millisecond
+	readiness.CacheTtl = time.Minute
+	readiness.Add(`slow`, func(api.AuthleteApi) error {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return nil
+	})
+
+	// The check does not finish in time, and is not started again while it
+	// is running.
+	for i := 0; i < 2; i++ {
+		if result := readiness.Check(nil)[`slow`]; result.Status != HealthStatus_DOWN {
+			t.Fatalf("A check which timed out is reported as %s.", result.Status)
+		}
+	}
+
+	close(release)
+	time.Sleep(10 * time.Millisecond)
+
+	// The result of the finished check is cached.
+	for i := 0; i < 2; i++ {
+		if result := readiness.Check(nil)[`slow`]; result.Status != HealthStatus_UP {
+			t.Fatalf("A finished check is reported as %s.", result.Status)
+		}
+	}
+
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("The check was called %d times instead of once.", calls)
+	}
+}
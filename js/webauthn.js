@@ -0,0 +1,117 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+// WebAuthn (passkey) ceremonies used by the authorization page and the
+// passkey registration page.
+
+function base64UrlToBuffer(value) {
+  var base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+  var binary = atob(base64 + '==='.slice((base64.length + 3) % 4));
+  return Uint8Array.from(binary, function (c) { return c.charCodeAt(0); }).buffer;
+}
+
+function bufferToBase64Url(buffer) {
+  var binary = String.fromCharCode.apply(null, new Uint8Array(buffer));
+  return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+// Path prefix of the tenant, which the server sets to the page.
+function basePath() {
+  return document.documentElement.getAttribute('data-base-path') || '';
+}
+
+function postJson(url, body) {
+  return fetch(basePath() + url, {
+    method: 'POST',
+    credentials: 'same-origin',
+    headers: { 'Content-Type': 'application/json' },
+    body: body ? JSON.stringify(body) : null
+  }).then(function (response) {
+    return response.json().then(function (json) {
+      if (!response.ok) {
+        throw new Error(json.error || response.statusText);
+      }
+      return json;
+    });
+  });
+}
+
+// Registers a new passkey for the user who has logged in.
+function registerPasskey() {
+  return postJson('/api/webauthn/registration/options').then(function (options) {
+    var publicKey = options.publicKey;
+    publicKey.challenge = base64UrlToBuffer(publicKey.challenge);
+    publicKey.user.id = base64UrlToBuffer(publicKey.user.id);
+    (publicKey.excludeCredentials || []).forEach(function (credential) {
+      credential.id = base64UrlToBuffer(credential.id);
+    });
+    return navigator.credentials.create({ publicKey: publicKey });
+  }).then(function (credential) {
+    return postJson('/api/webauthn/registration', {
+      id: credential.id,
+      rawId: bufferToBase64Url(credential.rawId),
+      type: credential.type,
+      response: {
+        clientDataJSON: bufferToBase64Url(credential.response.clientDataJSON),
+        attestationObject: bufferToBase64Url(credential.response.attestationObject)
+      }
+    });
+  });
+}
+
+// Logs in with a passkey chosen by the authenticator (usernameless login).
+function loginWithPasskey() {
+  return postJson('/api/webauthn/login/options').then(function (options) {
+    var publicKey = options.publicKey;
+    publicKey.challenge = base64UrlToBuffer(publicKey.challenge);
+    (publicKey.allowCredentials || []).forEach(function (credential) {
+      credential.id = base64UrlToBuffer(credential.id);
+    });
+    return navigator.credentials.get({ publicKey: publicKey });
+  }).then(function (assertion) {
+    var response = assertion.response;
+    return postJson('/api/webauthn/login', {
+      id: assertion.id,
+      rawId: bufferToBase64Url(assertion.rawId),
+      type: assertion.type,
+      response: {
+        authenticatorData: bufferToBase64Url(response.authenticatorData),
+        clientDataJSON: bufferToBase64Url(response.clientDataJSON),
+        signature: bufferToBase64Url(response.signature),
+        userHandle: response.userHandle ? bufferToBase64Url(response.userHandle) : null
+      }
+    });
+  });
+}
+
+// Logs in with a passkey and then authorizes the client application.
+function authorizeWithPasskey(formId) {
+  loginWithPasskey().then(function () {
+    var form = document.getElementById(formId);
+
+    // The same parameter as the one sent by the "Authorize" button.
+    var authorized = document.createElement('input');
+    authorized.type = 'hidden';
+    authorized.name = 'authorized';
+    authorized.value = 'Authorize';
+    form.appendChild(authorized);
+
+    // Login ID and password are no longer needed.
+    form.submit();
+  }).catch(function (error) {
+    document.getElementById('passkey-error').textContent = 'Passkey login failed: ' + error.message;
+  });
+}
@@ -0,0 +1,509 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/authlete/authlete-go/types"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/rs/zerolog/log"
+)
+
+type LdapConfiguration struct {
+	// e.g. "ldap://ldap.example.com:389" or "ldaps://ldap.example.com:636"
+	Url string `toml:"url"`
+
+	// Upgrade "ldap://" connections to TLS by the StartTLS operation.
+	StartTls bool `toml:"start_tls"`
+
+	// Skip the verification of the server certificate. For testing only.
+	InsecureSkipVerify bool `toml:"insecure_skip_verify"`
+
+	// Service account used to search users. Anonymous if empty.
+	BindDn       string `toml:"bind_dn"`
+	BindPassword string `toml:"bind_password"`
+
+	// Where users are searched, and the filter which all users match.
+	BaseDn       string `toml:"base_dn"`
+	ObjectFilter string `toml:"object_filter"`
+
+	// Attribute whose value is used as the subject of ID tokens. It must be
+	// unique and must not change, e.g. "entryUUID" or "uid". For Active
+	// Directory, e.g. "sAMAccountName" or "userPrincipalName".
+	SubjectAttribute string `toml:"subject_attribute"`
+
+	// Maximum number of idle connections kept in the pool.
+	PoolSize int `toml:"pool_size"`
+
+	// Timeout of each operation in seconds.
+	Timeout int `toml:"timeout"`
+
+	Attributes LdapAttributeMapping `toml:"attributes"`
+
+	// Custom attributes of users, e.g. roles = "memberOf". Values are
+	// lists of strings.
+	CustomAttributes map[string]string `toml:"custom_attributes"`
+}
+
+// Names of the LDAP attributes mapped to the properties of UserEntity and
+// then to the claims returned by GetClaim.
+type LdapAttributeMapping struct {
+	LoginId           string `toml:"login_id"`
+	GivenName         string `toml:"given_name"`
+	FamilyName        string `toml:"family_name"`
+	MiddleName        string `toml:"middle_name"`
+	Nickname          string `toml:"nickname"`
+	PreferredUsername string `toml:"preferred_username"`
+	Profile           string `toml:"profile"`
+	Picture           string `toml:"picture"`
+	Website           string `toml:"website"`
+	Gender            string `toml:"gender"`
+	Birthdate         string `toml:"birthdate"`
+	Zoneinfo          string `toml:"zoneinfo"`
+	Locale            string `toml:"locale"`
+	Email             string `toml:"email"`
+	PhoneNumber       string `toml:"phone_number"`
+	Street            string `toml:"street_address"`
+	Locality          string `toml:"locality"`
+	Region            string `toml:"region"`
+	PostalCode        string `toml:"postal_code"`
+	Country           string `toml:"country"`
+
+	// Generalized time, e.g. "modifyTimestamp" or "whenChanged"
+	UpdatedAt string `toml:"updated_at"`
+}
+
+func LdapConfiguration_Load(file string) *LdapConfiguration {
+	// Defaults for the inetOrgPerson object class.
+	config := LdapConfiguration{
+		ObjectFilter:     `(objectClass=inetOrgPerson)`,
+		SubjectAttribute: `uid`,
+		PoolSize:         10,
+		Timeout:          10,
+		Attributes: LdapAttributeMapping{
+			LoginId:     `uid`,
+			GivenName:   `givenName`,
+			FamilyName:  `sn`,
+			Nickname:    `displayName`,
+			Website:     `labeledURI`,
+			Locale:      `preferredLanguage`,
+			Email:       `mail`,
+			PhoneNumber: `telephoneNumber`,
+			Street:      `street`,
+			Locality:    `l`,
+			Region:      `st`,
+			PostalCode:  `postalCode`,
+			Country:     `c`,
+			UpdatedAt:   `modifyTimestamp`,
+		},
+	}
+
+	if _, err := toml.DecodeFile(file, &config); err != nil {
+		panic(fmt.Sprintf("ldap_user_store: Failed to load %s: %s", file, err))
+	}
+
+	return &config
+}
+
+// LdapUserStore looks up users in a directory server and authenticates them
+// by binding with their DNs and passwords. The directory is not modified, so
+// registration, password reset and enrollment of second factors are not
+// available to its users.
+type LdapUserStore struct {
+	config *LdapConfiguration
+	pool   chan *ldap.Conn
+}
+
+func LdapUserStore_New(config *LdapConfiguration) *LdapUserStore {
+	return &LdapUserStore{
+		config: config,
+		pool:   make(chan *ldap.Conn, config.PoolSize),
+	}
+}
+
+func (self *LdapUserStore) tlsConfig() *tls.Config {
+	return &tls.Config{InsecureSkipVerify: self.config.InsecureSkipVerify}
+}
+
+// dial opens a connection bound as the service account.
+func (self *LdapUserStore) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(self.config.Url, ldap.DialWithTLSConfig(self.tlsConfig()))
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetTimeout(time.Duration(self.config.Timeout) * time.Second)
+
+	if self.config.StartTls {
+		if err := conn.StartTLS(self.tlsConfig()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if err := self.bindServiceAccount(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (self *LdapUserStore) bindServiceAccount(conn *ldap.Conn) error {
+	if self.config.BindDn == `` {
+		return conn.UnauthenticatedBind(``)
+	}
+
+	return conn.Bind(self.config.BindDn, self.config.BindPassword)
+}
+
+// get takes an idle connection from the pool or opens a new one.
+func (self *LdapUserStore) get() (*ldap.Conn, error) {
+	for {
+		select {
+		case conn := <-self.pool:
+			if conn.IsClosing() {
+				continue
+			}
+			return conn, nil
+		default:
+			return self.dial()
+		}
+	}
+}
+
+// CheckHealth reads the root DSE to see if the directory is available.
+func (self *LdapUserStore) CheckHealth() error {
+	conn, err := self.get()
+	if err != nil {
+		return err
+	}
+
+	request := ldap.NewSearchRequest(``,
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, self.config.Timeout, false,
+		`(objectClass=*)`, []string{`1.1`}, nil)
+
+	if _, err := conn.Search(request); err != nil {
+		conn.Close()
+		return err
+	}
+
+	self.put(conn)
+
+	return nil
+}
+
+// put returns the connection to the pool, or closes it if the pool is full.
+func (self *LdapUserStore) put(conn *ldap.Conn) {
+	if conn.IsClosing() {
+		return
+	}
+
+	select {
+	case self.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// Close closes the idle connections in the pool.
+func (self *LdapUserStore) Close() error {
+	for {
+		select {
+		case conn := <-self.pool:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (self *LdapUserStore) search(conn *ldap.Conn, attribute string, value string) (*ldap.Entry, error) {
+	filter := fmt.Sprintf("(&%s(%s=%s))", self.config.ObjectFilter, attribute, ldap.EscapeFilter(value))
+
+	mapping := self.config.Attributes
+	attributes := []string{self.config.SubjectAttribute}
+	for _, name := range []string{mapping.LoginId, mapping.GivenName, mapping.FamilyName,
+		mapping.MiddleName, mapping.Nickname, mapping.PreferredUsername, mapping.Profile,
+		mapping.Picture, mapping.Website, mapping.Gender, mapping.Birthdate, mapping.Zoneinfo,
+		mapping.Locale, mapping.Email, mapping.PhoneNumber, mapping.Street, mapping.Locality,
+		mapping.Region, mapping.PostalCode, mapping.Country, mapping.UpdatedAt} {
+		// Attributes which are not mapped are not asked for.
+		if name != `` {
+			attributes = append(attributes, name)
+		}
+	}
+	for _, name := range self.config.CustomAttributes {
+		attributes = append(attributes, name)
+	}
+
+	// At most 2 entries are asked for to detect ambiguous values.
+	request := ldap.NewSearchRequest(self.config.BaseDn,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, self.config.Timeout, false,
+		filter, attributes, nil)
+
+	result, err := conn.Search(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Entries) != 1 {
+		return nil, nil
+	}
+
+	return result.Entries[0], nil
+}
+
+// find looks up the user whose attribute has the value.
+func (self *LdapUserStore) find(attribute string, value string) *UserEntity {
+	if attribute == `` || value == `` {
+		return nil
+	}
+
+	conn, err := self.get()
+	if err != nil {
+		msg := fmt.Sprintf("ldap_user_store: Failed to connect to the directory: %s", err)
+		log.Warn().Msg(msg)
+		return nil
+	}
+	defer self.put(conn)
+
+	entry, err := self.search(conn, attribute, value)
+	if err != nil {
+		msg := fmt.Sprintf("ldap_user_store: Search failed: %s", err)
+		log.Warn().Msg(msg)
+		return nil
+	}
+
+	if entry == nil {
+		return nil
+	}
+
+	return self.toUserEntity(entry)
+}
+
+func (self *LdapUserStore) toUserEntity(entry *ldap.Entry) *UserEntity {
+	mapping := self.config.Attributes
+
+	user := UserEntity{
+		Subject:           entry.GetAttributeValue(self.config.SubjectAttribute),
+		LoginId:           entry.GetAttributeValue(mapping.LoginId),
+		GivenName:         entry.GetAttributeValue(mapping.GivenName),
+		FamilyName:        entry.GetAttributeValue(mapping.FamilyName),
+		MiddleName:        entry.GetAttributeValue(mapping.MiddleName),
+		Nickname:          entry.GetAttributeValue(mapping.Nickname),
+		PreferredUsername: entry.GetAttributeValue(mapping.PreferredUsername),
+		Profile:           entry.GetAttributeValue(mapping.Profile),
+		Picture:           entry.GetAttributeValue(mapping.Picture),
+		Website:           ldapUri(entry.GetAttributeValue(mapping.Website)),
+		Gender:            entry.GetAttributeValue(mapping.Gender),
+		Birthdate:         entry.GetAttributeValue(mapping.Birthdate),
+		Zoneinfo:          entry.GetAttributeValue(mapping.Zoneinfo),
+		Locale:            ldapLocale(entry.GetAttributeValue(mapping.Locale)),
+		Email:             entry.GetAttributeValue(mapping.Email),
+		PhoneNumber:       entry.GetAttributeValue(mapping.PhoneNumber),
+		UpdatedAt:         ldapTime(entry.GetAttributeValue(mapping.UpdatedAt)),
+	}
+
+	user.Address.StreetAddress = entry.GetAttributeValue(mapping.Street)
+	user.Address.Locality = entry.GetAttributeValue(mapping.Locality)
+	user.Address.Region = entry.GetAttributeValue(mapping.Region)
+	user.Address.PostalCode = entry.GetAttributeValue(mapping.PostalCode)
+	user.Address.Country = entry.GetAttributeValue(mapping.Country)
+
+	// Values with language tags, e.g. "sn;lang-ja" (RFC 3866).
+	user.LocalizedClaims = self.localizedClaims(entry)
+
+	user.Attributes = map[string]interface{}{}
+	for name, attribute := range self.config.CustomAttributes {
+		if values := entry.GetAttributeValues(attribute); len(values) > 0 {
+			user.Attributes[name] = values
+		}
+	}
+
+	// Email addresses in the directory are managed by administrators.
+	user.EmailVerified = user.Email != ``
+
+	if user.Subject == `` {
+		return nil
+	}
+
+	return &user
+}
+
+func (self *LdapUserStore) localizedClaims(entry *ldap.Entry) LocalizedClaims {
+	mapping := self.config.Attributes
+	claims := LocalizedClaims{}
+
+	// Claims which can have values in other languages
+	names := map[string]string{
+		strings.ToLower(mapping.GivenName):  types.CLAIM_GIVEN_NAME,
+		strings.ToLower(mapping.FamilyName): types.CLAIM_FAMILY_NAME,
+		strings.ToLower(mapping.MiddleName): types.CLAIM_MIDDLE_NAME,
+		strings.ToLower(mapping.Nickname):   types.CLAIM_NICKNAME,
+	}
+
+	for _, attribute := range entry.Attributes {
+		options := strings.Split(attribute.Name, `;`)
+
+		claimName := names[strings.ToLower(options[0])]
+		if claimName == `` || len(attribute.Values) == 0 {
+			continue
+		}
+
+		for _, option := range options[1:] {
+			if strings.HasPrefix(strings.ToLower(option), `lang-`) {
+				claims.Set(claimName, option[5:], attribute.Values[0])
+			}
+		}
+	}
+
+	return claims
+}
+
+// ldapUri removes the label from a labeledURI value, "URI [label]".
+func ldapUri(value string) string {
+	if i := strings.IndexByte(value, ' '); i >= 0 {
+		return value[:i]
+	}
+
+	return value
+}
+
+// ldapLocale takes the most preferred language of a preferredLanguage
+// value, e.g. "en-US, en;q=0.8" (RFC 2798, 2.7).
+func ldapLocale(value string) string {
+	if i := strings.IndexAny(value, `,;`); i >= 0 {
+		value = value[:i]
+	}
+
+	return strings.TrimSpace(value)
+}
+
+// ldapTime converts a generalized time, e.g. "20240102150405Z", into seconds
+// since the Unix epoch.
+func ldapTime(value string) int64 {
+	if len(value) < 14 {
+		return 0
+	}
+
+	t, err := time.Parse(`20060102150405`, value[:14])
+	if err != nil {
+		return 0
+	}
+
+	return t.Unix()
+}
+
+func (self *LdapUserStore) GetByCredentials(loginId string, password string) *UserEntity {
+	// An empty password would make an unauthenticated bind succeed.
+	if loginId == `` || password == `` {
+		return nil
+	}
+
+	conn, err := self.get()
+	if err != nil {
+		msg := fmt.Sprintf("ldap_user_store: Failed to connect to the directory: %s", err)
+		log.Warn().Msg(msg)
+		return nil
+	}
+
+	entry, err := self.search(conn, self.config.Attributes.LoginId, loginId)
+	if err != nil || entry == nil {
+		self.put(conn)
+		return nil
+	}
+
+	// Verify the password by binding as the user.
+	err = conn.Bind(entry.DN, password)
+
+	// Bind as the service account again before returning the connection
+	// to the pool.
+	if self.bindServiceAccount(conn) != nil {
+		conn.Close()
+	} else {
+		self.put(conn)
+	}
+
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) == false {
+			msg := fmt.Sprintf("ldap_user_store: Bind failed: %s", err)
+			log.Warn().Msg(msg)
+		}
+		return nil
+	}
+
+	return self.toUserEntity(entry)
+}
+
+func (self *LdapUserStore) GetBySubject(subject string) *UserEntity {
+	return self.find(self.config.SubjectAttribute, subject)
+}
+
+func (self *LdapUserStore) GetByEmail(email string) *UserEntity {
+	return self.find(self.config.Attributes.Email, email)
+}
+
+func (self *LdapUserStore) GetByFederatedIdentity(provider string, subject string) *UserEntity {
+	return nil
+}
+
+func (self *LdapUserStore) Create(user *UserEntity) error {
+	return ErrUserStoreReadOnly
+}
+
+func (self *LdapUserStore) Update(user *UserEntity) error {
+	return ErrUserStoreReadOnly
+}
+
+func (self *LdapUserStore) Delete(subject string) bool {
+	return false
+}
+
+// List returns no users. Directories are usually too large to list.
+func (self *LdapUserStore) List() []UserEntity {
+	return nil
+}
+
+func (self *LdapUserStore) UpdatePassword(subject string, password string) bool {
+	return false
+}
+
+func (self *LdapUserStore) UpdateEmailVerified(subject string, verified bool) bool {
+	return false
+}
+
+func (self *LdapUserStore) AddFederatedIdentity(subject string, identity FederatedIdentity) bool {
+	return false
+}
+
+func (self *LdapUserStore) UpdateTotp(subject string, secret string, recoveryCodes []string) bool {
+	return false
+}
+
+func (self *LdapUserStore) UseTotpStep(subject string, step uint64) bool {
+	return false
+}
+
+func (self *LdapUserStore) UseRecoveryCode(subject string, code string) bool {
+	return false
+}
@@ -0,0 +1,257 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	linkTokenIssuerInstance *LinkTokenIssuer
+
+	ErrInvalidToken = errors.New("the token is invalid, expired or already used")
+)
+
+func init() {
+	// Tokens issued before a restart become invalid unless the key is
+	// given by TOKEN_SIGNING_KEY. A cluster needs the same key on all the
+	// servers and USED_TOKEN_STORE set to "redis" so that a token used on
+	// one server cannot be used again on another.
+	key := []byte(getConfiguration(`TOKEN_SIGNING_KEY`, ``))
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+
+	var store UsedTokenStore
+
+	switch getConfiguration(`USED_TOKEN_STORE`, `memory`) {
+	case `redis`:
+		addr := getConfiguration(`THROTTLE_REDIS_ADDR`, `localhost:6379`)
+		store = RedisUsedTokenStore_New(getConfiguration(`USED_TOKEN_REDIS_ADDR`, addr))
+	default:
+		store = MemoryUsedTokenStore_New()
+	}
+
+	linkTokenIssuerInstance = LinkTokenIssuer_New(key, store)
+}
+
+// LinkTokenIssuer issues single-use, expiring tokens signed with HMAC-SHA256.
+// They are embedded in links sent by mail, e.g. for password reset.
+type LinkTokenIssuer struct {
+	key   []byte
+	store UsedTokenStore
+}
+
+// LinkToken is the payload of a token.
+type LinkToken struct {
+	Tenant  string `json:"tenant,omitempty"`
+	Purpose string `json:"purpose"`
+	Subject string `json:"sub"`
+
+	// The email address to which the link was sent
+	Email string `json:"email,omitempty"`
+
+	Expires int64  `json:"exp"`
+	Id      string `json:"jti"`
+}
+
+// UsedTokenStore remembers the IDs of used tokens until they expire.
+type UsedTokenStore interface {
+	// Use marks the token as used. It returns false if the token has
+	// already been used.
+	Use(id string, expires time.Time) (bool, error)
+
+	IsUsed(id string) (bool, error)
+}
+
+func LinkTokenIssuer_New(key []byte, store UsedTokenStore) *LinkTokenIssuer {
+	issuer := LinkTokenIssuer{}
+	issuer.key = key
+	issuer.store = store
+
+	return &issuer
+}
+
+func LinkTokenIssuer_Get() *LinkTokenIssuer {
+	return linkTokenIssuerInstance
+}
+
+// Issue returns a token which allows the holder to do 'purpose' on behalf
+// of the user until the token expires. The token is accepted only by the
+// tenant named 'tenant' ("" for the default server) because subjects are
+// unique only within a tenant.
+func (self *LinkTokenIssuer) Issue(tenant string, purpose string, user *UserEntity, lifetime time.Duration) string {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	payload := LinkToken{
+		Tenant:  tenant,
+		Purpose: purpose,
+		Subject: user.Subject,
+		Email:   user.Email,
+		Expires: time.Now().Add(lifetime).Unix(),
+		Id:      hex.EncodeToString(id),
+	}
+
+	bytes, _ := json.Marshal(payload)
+	encoded := base64.RawURLEncoding.EncodeToString(bytes)
+
+	return encoded + `.` + self.sign(encoded)
+}
+
+// Verify checks the token without consuming it.
+func (self *LinkTokenIssuer) Verify(token string, tenant string, purpose string) (*LinkToken, error) {
+	payload, err := self.parse(token, tenant, purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	used, err := self.store.IsUsed(payload.Id)
+	if err != nil {
+		msg := fmt.Sprintf("link_token_issuer: Failed to look up used tokens: %s", err)
+		log.Warn().Msg(msg)
+		return nil, ErrInvalidToken
+	}
+
+	if used {
+		return nil, ErrInvalidToken
+	}
+
+	return payload, nil
+}
+
+// Consume verifies the token and makes it unusable.
+func (self *LinkTokenIssuer) Consume(token string, tenant string, purpose string) (*LinkToken, error) {
+	payload, err := self.parse(token, tenant, purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	first, err := self.store.Use(payload.Id, time.Unix(payload.Expires, 0))
+	if err != nil {
+		msg := fmt.Sprintf("link_token_issuer: Failed to record a used token: %s", err)
+		log.Warn().Msg(msg)
+		return nil, ErrInvalidToken
+	}
+
+	if first == false {
+		return nil, ErrInvalidToken
+	}
+
+	return payload, nil
+}
+
+// IsFor tells whether the token was issued for the user as the user is now.
+// A link sent to an address which the user has changed since then must not
+// prove the control of the new address.
+func (self *LinkToken) IsFor(user *UserEntity) bool {
+	return user != nil && user.Subject == self.Subject && user.Email == self.Email
+}
+
+func (self *LinkTokenIssuer) parse(token string, tenant string, purpose string) (*LinkToken, error) {
+	parts := strings.Split(token, `.`)
+	if len(parts) != 2 {
+		return nil, ErrInvalidToken
+	}
+
+	// Check the signature before looking into the payload.
+	if hmac.Equal([]byte(self.sign(parts[0])), []byte(parts[1])) == false {
+		return nil, ErrInvalidToken
+	}
+
+	bytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	payload := LinkToken{}
+	if json.Unmarshal(bytes, &payload) != nil {
+		return nil, ErrInvalidToken
+	}
+
+	// A token issued for another purpose or by another tenant must not be
+	// accepted.
+	if payload.Tenant != tenant || payload.Purpose != purpose || time.Now().Unix() > payload.Expires {
+		return nil, ErrInvalidToken
+	}
+
+	return &payload, nil
+}
+
+func (self *LinkTokenIssuer) sign(data string) string {
+	mac := hmac.New(sha256.New, self.key)
+	mac.Write([]byte(data))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// MemoryUsedTokenStore keeps the IDs of used tokens in the memory of this
+// server.
+type MemoryUsedTokenStore struct {
+	used  map[string]time.Time
+	mutex sync.Mutex
+}
+
+func MemoryUsedTokenStore_New() *MemoryUsedTokenStore {
+	store := MemoryUsedTokenStore{}
+	store.used = map[string]time.Time{}
+
+	return &store
+}
+
+func (self *MemoryUsedTokenStore) Use(id string, expires time.Time) (bool, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if _, used := self.used[id]; used {
+		return false, nil
+	}
+
+	// Forget used tokens which have expired anyway.
+	now := time.Now()
+	for id, expires := range self.used {
+		if expires.Before(now) {
+			delete(self.used, id)
+		}
+	}
+
+	self.used[id] = expires
+
+	return true, nil
+}
+
+func (self *MemoryUsedTokenStore) IsUsed(id string) (bool, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	_, used := self.used[id]
+
+	return used, nil
+}
@@ -0,0 +1,44 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLinkTokenUsedOnAnotherServer(t *testing.T) {
+	// Two servers of a cluster share the key and the store of used tokens.
+	key := []byte(`shared-key`)
+	store := MemoryUsedTokenStore_New()
+	issuer := LinkTokenIssuer_New(key, store)
+	other := LinkTokenIssuer_New(key, store)
+
+	token := issuer.Issue(``, linkPurposePasswordReset, &UserEntity{Subject: `1`, Email: `alice@example.com`}, time.Minute)
+
+	if _, err := issuer.Consume(token, ``, linkPurposePasswordReset); err != nil {
+		t.Fatalf("The token was not accepted: %s", err)
+	}
+
+	if _, err := other.Verify(token, ``, linkPurposePasswordReset); err == nil {
+		t.Errorf("Another server accepted the used token")
+	}
+
+	if _, err := other.Consume(token, ``, linkPurposePasswordReset); err == nil {
+		t.Errorf("Another server let the token be used again")
+	}
+}
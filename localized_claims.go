@@ -0,0 +1,96 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// Claim values in other languages than the default one are held per claim
+// name and per language tag (BCP 47), e.g.
+//
+//	{"family_name": {"ja-Hani-JP": "鈴木", "ja-Kana-JP": "スズキ"}}
+//
+// See "OpenID Connect Core 1.0, 5.2. Claims Languages and Scripts".
+type LocalizedClaims map[string]map[string]string
+
+// Get returns the value of the claim in the language which best matches the
+// language tag, or nil if no value is close enough. The language and the
+// script must match while the region may differ, e.g. "en-GB" is satisfied
+// by "en-US" but "ja-Kana-JP" is not satisfied by "ja-Hani-JP". A tag which
+// is a prefix of others, e.g. "ja", matches them as in the basic filtering
+// of RFC 4647.
+func (self LocalizedClaims) Get(claimName string, languageTag string) interface{} {
+	variants := self[claimName]
+	if len(variants) == 0 {
+		return nil
+	}
+
+	requested, err := language.Parse(languageTag)
+	if err != nil {
+		return nil
+	}
+
+	// Candidates in a stable order
+	keys := make([]string, 0, len(variants))
+	for key := range variants {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tags := []language.Tag{}
+	values := []string{}
+	for _, key := range keys {
+		tag, err := language.Parse(key)
+		if err != nil {
+			continue
+		}
+		tags = append(tags, tag)
+		values = append(values, variants[key])
+	}
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	_, index, confidence := language.NewMatcher(tags).Match(requested)
+	if confidence >= language.High {
+		return values[index]
+	}
+
+	// Basic filtering (RFC 4647, 3.3.1)
+	prefix := strings.ToLower(languageTag) + `-`
+	for _, key := range keys {
+		if strings.HasPrefix(strings.ToLower(key), prefix) {
+			return variants[key]
+		}
+	}
+
+	return nil
+}
+
+// Set adds the value of the claim in the language.
+func (self LocalizedClaims) Set(claimName string, languageTag string, value string) {
+	if self[claimName] == nil {
+		self[claimName] = map[string]string{}
+	}
+
+	self[claimName][languageTag] = value
+}
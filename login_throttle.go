@@ -0,0 +1,365 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	loginThrottleInstance *LoginThrottle
+)
+
+func init() {
+	// Failure counters are kept in the memory by default. Set THROTTLE_STORE
+	// to "redis" to share them among the servers of a cluster.
+	var store ThrottleStore
+
+	switch getConfiguration(`THROTTLE_STORE`, `memory`) {
+	case `redis`:
+		store = RedisThrottleStore_New(getConfiguration(`THROTTLE_REDIS_ADDR`, `localhost:6379`))
+	default:
+		store = MemoryThrottleStore_New()
+	}
+
+	loginThrottleInstance = LoginThrottle_New(store)
+}
+
+// LoginThrottle limits repeated authentication failures per account and
+// per IP address. After a few failures, the next attempt is delayed
+// exponentially. When failures reach a threshold, further attempts are
+// rejected until the lockout expires or an administrator unlocks them.
+type LoginThrottle struct {
+	Store ThrottleStore
+
+	// Prefix of the keys of the counters, e.g. of a tenant.
+	Prefix string
+
+	// Number of failures which do not cause any delay.
+	FreeAttempts int
+
+	// Delay after the first failure beyond the free attempts. It doubles
+	// with every further failure up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Numbers of failures which lock the account and the IP address.
+	AccountLockThreshold int
+	IpLockThreshold      int
+
+	// Duration of a lockout.
+	LockDuration time.Duration
+
+	// Failures older than this are forgotten.
+	Window time.Duration
+}
+
+func LoginThrottle_New(store ThrottleStore) *LoginThrottle {
+	throttle := LoginThrottle{}
+	throttle.Store = store
+	throttle.FreeAttempts = 3
+	throttle.BaseDelay = 1 * time.Second
+	throttle.MaxDelay = 1 * time.Minute
+	throttle.AccountLockThreshold = 10
+	throttle.IpLockThreshold = 50
+	throttle.LockDuration = 15 * time.Minute
+	throttle.Window = 1 * time.Hour
+
+	return &throttle
+}
+
+func LoginThrottle_Get() *LoginThrottle {
+	return loginThrottleInstance
+}
+
+// ForTenant returns a throttle which shares the store and the settings but
+// counts the failures of the tenant separately.
+func (self *LoginThrottle) ForTenant(name string) *LoginThrottle {
+	throttle := *self
+	throttle.Prefix = `tenant:` + name + `:`
+
+	return &throttle
+}
+
+func (self *LoginThrottle) accountKey(loginId string) string {
+	return self.Prefix + `account:` + strings.ToLower(loginId)
+}
+
+func (self *LoginThrottle) ipKey(ip string) string {
+	return self.Prefix + `ip:` + ip
+}
+
+// Attempt reserves an authentication attempt and returns how long the
+// client has to wait before the next one. Zero means that the attempt is
+// allowed. The check and the counting of the attempt are done in one step,
+// so concurrent attempts cannot exceed the limits. An allowed attempt counts
+// as a failure until Succeeded or Released is called.
+func (self *LoginThrottle) Attempt(loginId string, ip string) time.Duration {
+	now := time.Now()
+
+	wait := self.acquire(self.accountKey(loginId), self.AccountLockThreshold, now)
+
+	if ip != `` && wait == 0 {
+		wait = self.acquire(self.ipKey(ip), self.IpLockThreshold, now)
+		if wait > 0 {
+			// The attempt is not made after all.
+			self.release(self.accountKey(loginId))
+		}
+	}
+
+	if wait > 0 {
+		msg := fmt.Sprintf("login_throttle: An authentication attempt was rejected. The client has to wait for %s.", wait)
+		log.Debug().Msg(msg)
+	}
+
+	return wait
+}
+
+func (self *LoginThrottle) acquire(key string, threshold int, now time.Time) time.Duration {
+	wait, err := self.Store.Acquire(key, now, self.Window, func(record ThrottleRecord) time.Duration {
+		return self.waitFor(record, threshold, now)
+	})
+	if err != nil {
+		// Don't lock everybody out when the store is not available.
+		msg := fmt.Sprintf("login_throttle: Failed to count an authentication attempt: %s", err)
+		log.Warn().Msg(msg)
+		return 0
+	}
+
+	return wait
+}
+
+func (self *LoginThrottle) release(key string) {
+	if err := self.Store.Release(key); err != nil {
+		msg := fmt.Sprintf("login_throttle: Failed to release an authentication attempt: %s", err)
+		log.Warn().Msg(msg)
+	}
+}
+
+func (self *LoginThrottle) waitFor(record ThrottleRecord, threshold int, now time.Time) time.Duration {
+	var until time.Time
+
+	if record.Failures >= threshold {
+		// Locked out
+		until = record.LastFailure.Add(self.LockDuration)
+	} else {
+		until = record.LastFailure.Add(self.delay(record.Failures))
+	}
+
+	if now.Before(until) == false {
+		return 0
+	}
+
+	return until.Sub(now)
+}
+
+func (self *LoginThrottle) delay(failures int) time.Duration {
+	excess := failures - self.FreeAttempts
+
+	if excess <= 0 {
+		return 0
+	}
+
+	delay := self.BaseDelay
+	for i := 1; i < excess && delay < self.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > self.MaxDelay {
+		delay = self.MaxDelay
+	}
+
+	return delay
+}
+
+// Failed tells that the attempt failed. The attempt has already been
+// counted by Attempt, so lockouts which it caused are only recorded, with
+// the tenant and the user agent of the request 'ctx'.
+func (self *LoginThrottle) Failed(ctx *gin.Context, loginId string, ip string) {
+	self.recordLockout(ctx, self.accountKey(loginId), self.AccountLockThreshold, loginId, ip)
+
+	if ip != `` {
+		self.recordLockout(ctx, self.ipKey(ip), self.IpLockThreshold, loginId, ip)
+	}
+}
+
+func (self *LoginThrottle) recordLockout(ctx *gin.Context, key string, threshold int, loginId string, ip string) {
+	record, err := self.Store.Get(key)
+	if err != nil {
+		msg := fmt.Sprintf("login_throttle: Failed to read the failure count: %s", err)
+		log.Warn().Msg(msg)
+		return
+	}
+
+	msg := fmt.Sprintf("login_throttle: An authentication failure was recorded. The number of failures is %d.", record.Failures)
+	log.Debug().Msg(msg)
+
+	if record.Failures == threshold {
+		// "account" or "ip"
+		scope := strings.SplitN(strings.TrimPrefix(key, self.Prefix), `:`, 2)[0]
+
+		AuditLog_Get().Record(ctx, &AuditEvent{
+			Event:   AuditEvent_ACCOUNT_LOCKED,
+			Reason:  scope,
+			LoginId: loginId,
+			Ip:      ip,
+			Details: map[string]string{`duration`: self.LockDuration.String()},
+		})
+	}
+}
+
+// Released tells that the attempt neither failed nor completed the login,
+// e.g. the password was right and the second factor is asked next.
+func (self *LoginThrottle) Released(loginId string, ip string) {
+	self.release(self.accountKey(loginId))
+
+	if ip != `` {
+		self.release(self.ipKey(ip))
+	}
+}
+
+// Succeeded clears the failures of the account. Failures of the IP address
+// are kept so that an attacker cannot reset them with an own account; only
+// the attempt itself is released. The IP address is empty when the account
+// is cleared without an attempt, e.g. after a password reset.
+func (self *LoginThrottle) Succeeded(loginId string, ip string) {
+	self.Store.Delete(self.accountKey(loginId))
+
+	if ip != `` {
+		self.release(self.ipKey(ip))
+	}
+}
+
+// Unlock clears the failures of the account and, if given, of the IP address.
+func (self *LoginThrottle) Unlock(loginId string, ip string) error {
+	if loginId != `` {
+		if err := self.Store.Delete(self.accountKey(loginId)); err != nil {
+			return err
+		}
+	}
+
+	if ip != `` {
+		if err := self.Store.Delete(self.ipKey(ip)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type ThrottleRecord struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+// ThrottleStore keeps the numbers of recent authentication failures.
+type ThrottleStore interface {
+	// Get returns the record of the key. A zero record is returned when
+	// the key does not exist.
+	Get(key string) (ThrottleRecord, error)
+
+	// Acquire calls 'wait' with the record of the key and, if it returns
+	// zero, increments the failure count and makes the record expire after
+	// 'ttl'. Both are done atomically. The result of 'wait' is returned.
+	Acquire(key string, now time.Time, ttl time.Duration, wait func(ThrottleRecord) time.Duration) (time.Duration, error)
+
+	// Release decrements the failure count of the key if it is positive.
+	Release(key string) error
+
+	Delete(key string) error
+}
+
+type memoryThrottleEntry struct {
+	record  ThrottleRecord
+	expires time.Time
+}
+
+// MemoryThrottleStore is a ThrottleStore for a single server and tests.
+type MemoryThrottleStore struct {
+	entries map[string]memoryThrottleEntry
+	mutex   sync.Mutex
+}
+
+func MemoryThrottleStore_New() *MemoryThrottleStore {
+	store := MemoryThrottleStore{}
+	store.entries = map[string]memoryThrottleEntry{}
+
+	return &store
+}
+
+func (self *MemoryThrottleStore) Get(key string) (ThrottleRecord, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	entry, ok := self.entries[key]
+	if ok == false || time.Now().After(entry.expires) {
+		return ThrottleRecord{}, nil
+	}
+
+	return entry.record, nil
+}
+
+func (self *MemoryThrottleStore) Acquire(key string, now time.Time, ttl time.Duration,
+	wait func(ThrottleRecord) time.Duration) (time.Duration, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	entry, ok := self.entries[key]
+	if ok == false || now.After(entry.expires) {
+		entry = memoryThrottleEntry{}
+	}
+
+	if w := wait(entry.record); w > 0 {
+		return w, nil
+	}
+
+	entry.record.Failures++
+	entry.record.LastFailure = now
+	entry.expires = now.Add(ttl)
+
+	self.entries[key] = entry
+
+	return 0, nil
+}
+
+func (self *MemoryThrottleStore) Release(key string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	entry, ok := self.entries[key]
+	if ok && entry.record.Failures > 0 {
+		entry.record.Failures--
+		self.entries[key] = entry
+	}
+
+	return nil
+}
+
+func (self *MemoryThrottleStore) Delete(key string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	delete(self.entries, key)
+
+	return nil
+}
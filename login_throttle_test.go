@@ -0,0 +1,137 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleConcurrentAttempts(t *testing.T) {
+	throttle := LoginThrottle_New(MemoryThrottleStore_New())
+
+	// Attempts made at the same time must not slip through before any of
+	// them is counted.
+	allowed := int32(0)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if throttle.Attempt(`john`, `192.0.2.1`) == 0 {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The free attempts and the one which the first delay follows
+	if allowed != int32(throttle.FreeAttempts+1) {
+		t.Errorf("%d attempts were allowed instead of %d", allowed, throttle.FreeAttempts+1)
+	}
+}
+
+func TestLoginThrottleReleasesSucceededAttempts(t *testing.T) {
+	throttle := LoginThrottle_New(MemoryThrottleStore_New())
+
+	// Successful logins of many users behind the same IP address do not
+	// count as failures of the address.
+	for i := 0; i < throttle.IpLockThreshold+1; i++ {
+		loginId := `user` + strings.Repeat(`x`, i)
+		if wait := throttle.Attempt(loginId, `192.0.2.1`); wait > 0 {
+			t.Fatalf("The attempt %d was throttled for %s", i, wait)
+		}
+		throttle.Succeeded(loginId, `192.0.2.1`)
+	}
+
+	record, _ := throttle.Store.Get(throttle.ipKey(`192.0.2.1`))
+	if record.Failures != 0 {
+		t.Errorf("The IP address has %d failures", record.Failures)
+	}
+}
+
+func TestLoginThrottleIgnoresDecisionsWithoutLogin(t *testing.T) {
+	browser := testBrowser_New(t)
+
+	// Denials without credentials are not login attempts.
+	for i := 0; i < 3; i++ {
+		form := browser.authorize(nil)
+		expectError(t, browser.submit(form, testDecision(``, ``, false)), `access_denied`)
+	}
+
+	throttle := LoginThrottle_Get()
+	record, _ := throttle.Store.Get(throttle.ipKey(`127.0.0.1`))
+	if record.Failures != 0 {
+		t.Errorf("The IP address has %d failures", record.Failures)
+	}
+}
+
+func testUnlock(browser *testBrowser, authorization string) *testResponse {
+	params := url.Values{`loginId`: {`john`}}
+	request, _ := http.NewRequest(`POST`, browser.server.URL+`/api/admin/unlock`, strings.NewReader(params.Encode()))
+	request.Header.Set(`Content-Type`, `application/x-www-form-urlencoded`)
+	if authorization != `` {
+		request.Header.Set(`Authorization`, authorization)
+	}
+
+	return browser.do(request)
+}
+
+func TestUnlockRequiresAdministrator(t *testing.T) {
+	browser := testBrowser_New(t)
+
+	throttle := LoginThrottle_Get()
+	throttle.LockDuration = time.Hour
+	for i := 0; i < throttle.AccountLockThreshold; i++ {
+		throttle.Store.Acquire(throttle.accountKey(`john`), time.Now(), time.Hour,
+			func(ThrottleRecord) time.Duration { return 0 })
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{`no credentials`, ``, 401},
+		{`any basic credentials`, `Basic YWRtaW46`, 401},
+		{`token without the scope`, `Bearer ` + browser.fake.IssueAccessToken(`1`, `openid`), 403},
+	}
+
+	for _, test := range tests {
+		if res := testUnlock(browser, test.authorization); res.Status != test.status {
+			t.Errorf("%s: %d instead of %d", test.name, res.Status, test.status)
+		}
+	}
+
+	if throttle.Attempt(`john`, ``) == 0 {
+		t.Fatalf("The account was unlocked without an administrator")
+	}
+
+	token := browser.fake.IssueAccessToken(`1`, `admin`)
+	if res := testUnlock(browser, `Bearer `+token); res.Status != 204 {
+		t.Fatalf("The administrator could not unlock the account: %d %s", res.Status, res.Body)
+	}
+
+	if wait := throttle.Attempt(`john`, ``); wait > 0 {
+		t.Errorf("The account is still locked for %s", wait)
+	}
+}
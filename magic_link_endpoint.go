@@ -0,0 +1,182 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	linkPurposeMagicLink = `magic_link`
+
+	// Lifetime of login links.
+	magicLinkLifetime = 15 * time.Minute
+)
+
+func MagicLinkEndpoint_Handler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		// Session
+		session := sessions.Default(ctx)
+
+		email := ctx.PostForm(`email`)
+		user := UserStore_Of(ctx).GetByEmail(email)
+
+		if user != nil && user.Disabled == false {
+			// The link works only in this browser. Otherwise, anybody
+			// could log a victim into the sender's account by sending
+			// the victim a link.
+			session.Set(`magicLinkSubject`, user.Subject)
+			session.Save()
+
+			sendMagicLinkMail(ctx, user)
+		} else {
+			msg := "magic_link_endpoint: No user has the email address."
+			log.Debug().Msg(msg)
+		}
+
+		// The response is the same whether the user exists or not so that
+		// the page cannot be used to find registered email addresses.
+		renderMessagePage(ctx, 200, `Login`,
+			`If an account with the email address exists, a link to log in has been sent to it. Open it in this browser.`)
+	}
+}
+
+func sendMagicLinkMail(ctx *gin.Context, user *UserEntity) {
+	token := LinkTokenIssuer_Get().Issue(tenantNameOf(ctx), linkPurposeMagicLink, user, magicLinkLifetime)
+	link := getServerBaseUrlOf(ctx) + `/magic-link/login?token=` + url.QueryEscape(token)
+
+	body := fmt.Sprintf("Hello %s,\r\n\r\n"+
+		"Open the following link in the browser in which you asked for it to log in.\r\n\r\n%s\r\n\r\n"+
+		"The link expires in 15 minutes. If you did not ask for it, ignore this mail.\r\n",
+		user.GivenName, link)
+
+	err := MailSender_Get().Send(user.Email, `Your login link`, body)
+	if err != nil {
+		msg := fmt.Sprintf("magic_link_endpoint: Failed to send a mail: %s", err)
+		log.Warn().Msg(msg)
+	}
+}
+
+func MagicLinkLoginEndpoint_Handler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		// Session
+		session := sessions.Default(ctx)
+
+		issuer := LinkTokenIssuer_Get()
+
+		if ctx.Request.Method != `POST` {
+			// Check the link before asking for the confirmation, but
+			// leave it usable.
+			token := ctx.Query(`token`)
+			if _, err := issuer.Verify(token, tenantNameOf(ctx), linkPurposeMagicLink); err != nil {
+				renderMessagePage(ctx, 400, `Login`, `The link is invalid or has expired.`)
+				return
+			}
+
+			renderConfirmationPage(ctx, `Login`, `Log in with the link.`, `/magic-link/login`, token, `Log in`)
+			return
+		}
+
+		token := ctx.PostForm(`token`)
+
+		link, err := issuer.Verify(token, tenantNameOf(ctx), linkPurposeMagicLink)
+		if err != nil {
+			renderMessagePage(ctx, 400, `Login`, `The link is invalid or has expired.`)
+			return
+		}
+
+		subject := link.Subject
+
+		// The link has to be opened in the browser in which it was
+		// requested. In another browser, it is left usable.
+		value := session.Get(`magicLinkSubject`)
+		if pending, _ := value.(string); pending != subject {
+			msg := "magic_link_endpoint: The link was opened in another browser."
+			log.Debug().Msg(msg)
+			renderMessagePage(ctx, 400, `Login`,
+				`Open the link in the browser in which you asked for it.`)
+			return
+		}
+
+		// The link can be used only once.
+		if _, err := issuer.Consume(token, tenantNameOf(ctx), linkPurposeMagicLink); err != nil {
+			renderMessagePage(ctx, 400, `Login`, `The link is invalid or has expired.`)
+			return
+		}
+
+		session.Delete(`magicLinkSubject`)
+
+		db := UserStore_Of(ctx)
+		user := db.GetBySubject(subject)
+		if user == nil || user.Disabled {
+			renderMessagePage(ctx, 400, `Login`, `The account does not exist.`)
+			return
+		}
+
+		// The link proves the control of the address to which it was sent.
+		if link.IsFor(user) == false {
+			renderMessagePage(ctx, 400, `Login`, `The link is invalid or has expired.`)
+			return
+		}
+
+		// A link in a mail does not replace the second factor which the
+		// user has enrolled. Such users have to log in with the password.
+		if user.IsTotpEnabled() {
+			msg := fmt.Sprintf("magic_link_endpoint: The user has to present a second factor. The subject is '%s'.", subject)
+			log.Debug().Msg(msg)
+			Metrics_Get().LoginAttempted(Amr_EMAIL, LoginResult_FAILURE)
+			auditLoginFailure(ctx, session, Amr_EMAIL, user.LoginId, LoginResult_FAILURE, `second_factor_required`)
+			renderMessagePage(ctx, 403, `Login`,
+				`Your account requires a second factor. Log in with your password.`)
+			return
+		}
+
+		// The user has proved the control of the email address. If the
+		// store cannot record it, e.g. a read-only directory, the user
+		// still has to verify the address when verification is required.
+		if db.UpdateEmailVerified(subject, true) {
+			user.EmailVerified = true
+		}
+
+		if isEmailVerificationPending(user) {
+			msg := fmt.Sprintf("magic_link_endpoint: The email address has not been verified. The subject is '%s'.", subject)
+			log.Debug().Msg(msg)
+			auditLoginFailure(ctx, session, Amr_EMAIL, user.LoginId, LoginResult_FAILURE, `email_not_verified`)
+			renderMessagePage(ctx, 403, `Login`, `Your email address has not been verified.`)
+			return
+		}
+
+		msg := fmt.Sprintf("magic_link_endpoint: User authentication succeeded. The subject is '%s'.", subject)
+		log.Debug().Msg(msg)
+
+		// Let the user log in.
+		loginUser(ctx, session, user, []string{Amr_EMAIL})
+
+		// Continue the pending authorization request if any.
+		if resumeAuthorization(ctx, session, user) {
+			return
+		}
+
+		renderMessagePage(ctx, 200, `Login`, `You have logged in.`)
+	}
+}
@@ -0,0 +1,123 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+// testMailSender keeps mails instead of sending them.
+type testMailSender struct {
+	mutex  sync.Mutex
+	bodies []string
+}
+
+func (self *testMailSender) Send(to string, subject string, body string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.bodies = append(self.bodies, body)
+
+	return nil
+}
+
+// link returns the query parameters of the link in the last mail.
+func (self *testMailSender) link(t *testing.T) url.Values {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if len(self.bodies) == 0 {
+		t.Fatalf("No mail was sent")
+	}
+
+	found := regexp.MustCompile(`https?://\S+`).FindString(self.bodies[len(self.bodies)-1])
+	link, err := url.Parse(found)
+	if err != nil {
+		t.Fatalf("The mail has no link: %s", self.bodies[len(self.bodies)-1])
+	}
+
+	return link.Query()
+}
+
+func testMailSender_Install(t *testing.T) *testMailSender {
+	sender := &testMailSender{}
+
+	original := mailSenderInstance
+	mailSenderInstance = sender
+	t.Cleanup(func() { mailSenderInstance = original })
+
+	return sender
+}
+
+// testUserStore_Install replaces the user store of the default server.
+func testUserStore_Install(t *testing.T, users ...UserEntity) *UserDatabase {
+	db := &UserDatabase{Users: users}
+
+	original := userStoreInstance
+	userStoreInstance = db
+	t.Cleanup(func() { userStoreInstance = original })
+
+	return db
+}
+
+func TestMagicLinkLogin(t *testing.T) {
+	sender := testMailSender_Install(t)
+	testUserStore_Install(t, UserEntity{Subject: `1`, LoginId: `alice`, Email: `alice@example.com`, GivenName: `Alice`})
+
+	browser := testBrowser_New(t)
+	browser.post(`/magic-link`, url.Values{`email`: {`alice@example.com`}})
+	token := sender.link(t).Get(`token`)
+
+	// Fetching the link, e.g. by a mail scanner, does not use it up.
+	for i := 0; i < 2; i++ {
+		res := browser.get(`/magic-link/login`, url.Values{`token`: {token}})
+		if form := parseTestForm(t, res.Body, `confirmation-form`); form.Action != `/magic-link/login` {
+			t.Fatalf("The confirmation is posted to '%s'", form.Action)
+		}
+	}
+
+	// Nor does posting it in another browser.
+	other := testBrowser_New(t)
+	if res := other.post(`/magic-link/login`, url.Values{`token`: {token}}); res.Status != 400 {
+		t.Fatalf("The link worked in another browser: %d %s", res.Status, res.Body)
+	}
+
+	res := browser.post(`/magic-link/login`, url.Values{`token`: {token}})
+	if res.Status != 200 {
+		t.Fatalf("Login with the link failed: %d %s", res.Status, res.Body)
+	}
+
+	if res := browser.post(`/magic-link/login`, url.Values{`token`: {token}}); res.Status != 400 {
+		t.Fatalf("The link was used twice: %d %s", res.Status, res.Body)
+	}
+}
+
+func TestMagicLinkRequiresSecondFactor(t *testing.T) {
+	sender := testMailSender_Install(t)
+	testUserStore_Install(t, UserEntity{Subject: `1`, LoginId: `alice`, Email: `alice@example.com`, TotpSecret: `JBSWY3DPEHPK3PXP`})
+
+	browser := testBrowser_New(t)
+	browser.post(`/magic-link`, url.Values{`email`: {`alice@example.com`}})
+
+	res := browser.post(`/magic-link/login`, url.Values{`token`: {sender.link(t).Get(`token`)}})
+	if res.Status != 403 {
+		t.Fatalf("A user with a second factor logged in with a link: %d %s", res.Status, res.Body)
+	}
+}
@@ -0,0 +1,140 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	mailSenderInstance MailSender
+)
+
+func init() {
+	// Mails are written to the log by default so that the server and tests
+	// can run without a mail server. Set MAIL_SENDER to "smtp" to send them
+	// or to "file" to append them to MAIL_FILE.
+	switch getConfiguration(`MAIL_SENDER`, `log`) {
+	case `smtp`:
+		mailSenderInstance = SmtpMailSender_New(
+			getConfiguration(`SMTP_ADDR`, `localhost:25`),
+			getConfiguration(`SMTP_USERNAME`, ``),
+			getConfiguration(`SMTP_PASSWORD`, ``),
+			getConfiguration(`MAIL_FROM`, `no-reply@localhost`))
+	case `file`:
+		mailSenderInstance = FileMailSender_New(getConfiguration(`MAIL_FILE`, `mail.log`))
+	default:
+		mailSenderInstance = &LogMailSender{}
+	}
+}
+
+// MailSender sends plain text mails to users.
+type MailSender interface {
+	Send(to string, subject string, body string) error
+}
+
+func MailSender_Get() MailSender {
+	return mailSenderInstance
+}
+
+func MailSender_Set(sender MailSender) {
+	mailSenderInstance = sender
+}
+
+// SmtpMailSender sends mails through an SMTP server.
+type SmtpMailSender struct {
+	Addr string
+	Auth smtp.Auth
+	From string
+}
+
+func SmtpMailSender_New(addr string, username string, password string, from string) *SmtpMailSender {
+	sender := SmtpMailSender{}
+	sender.Addr = addr
+	sender.From = from
+
+	if username != `` {
+		host := strings.Split(addr, `:`)[0]
+		sender.Auth = smtp.PlainAuth(``, username, password, host)
+	}
+
+	return &sender
+}
+
+func (self *SmtpMailSender) Send(to string, subject string, body string) error {
+	message := formatMail(self.From, to, subject, body)
+
+	return smtp.SendMail(self.Addr, self.Auth, self.From, []string{to}, []byte(message))
+}
+
+// FileMailSender appends mails to a file instead of sending them.
+type FileMailSender struct {
+	Path  string
+	mutex sync.Mutex
+}
+
+func FileMailSender_New(path string) *FileMailSender {
+	sender := FileMailSender{}
+	sender.Path = path
+
+	return &sender
+}
+
+func (self *FileMailSender) Send(to string, subject string, body string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	file, err := os.OpenFile(self.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.WriteString(file, formatMail(``, to, subject, body)+"\r\n")
+
+	return err
+}
+
+// LogMailSender writes mails to the log instead of sending them.
+type LogMailSender struct{}
+
+func (self *LogMailSender) Send(to string, subject string, body string) error {
+	log.Info().Str(`to`, to).Str(`subject`, subject).Msg(body)
+
+	return nil
+}
+
+func formatMail(from string, to string, subject string, body string) string {
+	header := ``
+
+	if from != `` {
+		header += fmt.Sprintf("From: %s\r\n", from)
+	}
+
+	header += fmt.Sprintf("To: %s\r\nSubject: %s\r\nDate: %s\r\n", to, subject, time.Now().Format(time.RFC1123Z))
+	header += "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n"
+
+	return header + "\r\n" + body
+}
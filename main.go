@@ -16,7 +16,18 @@
 
 package main
 
+import (
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
 func main() {
 	server := AuthorizationServer_New()
-	_ = server.Run()
+
+	// Run() returns when the server has shut down on SIGINT or SIGTERM.
+	if err := server.Run(); err != nil {
+		msg := fmt.Sprintf("main: The server stopped unexpectedly: %s", err)
+		log.Fatal().Msg(msg)
+	}
 }
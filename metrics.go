@@ -0,0 +1,319 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/authlete/authlete-go/api"
+	"github.com/authlete/authlete-go/dto"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = `gin_oauth_server`
+
+	LoginResult_SUCCESS   = `success`
+	LoginResult_FAILURE   = `failure`
+	LoginResult_THROTTLED = `throttled`
+)
+
+var (
+	metricsInstance *Metrics
+
+	// Values of the 'grant_type' label. Others are counted as "other" so
+	// that clients cannot create time series without limit.
+	metricsGrantTypes = map[string]bool{
+		`authorization_code`: true,
+		`refresh_token`:      true,
+		`client_credentials`: true,
+		`password`:           true,
+		`urn:ietf:params:oauth:grant-type:device_code`:    true,
+		`urn:ietf:params:oauth:grant-type:jwt-bearer`:     true,
+		`urn:ietf:params:oauth:grant-type:token-exchange`: true,
+		`urn:openid:params:grant-type:ciba`:               true,
+	}
+)
+
+func init() {
+	metricsInstance = Metrics_New()
+}
+
+// Metrics holds the Prometheus metrics of this server. They are registered
+// to a registry of their own, which is exposed by MetricsEndpoint_Handler().
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	authorizations  *prometheus.CounterVec
+	decisions       *prometheus.CounterVec
+	tokens          *prometheus.CounterVec
+	introspections  *prometheus.CounterVec
+	logins          *prometheus.CounterVec
+	apiDuration     *prometheus.HistogramVec
+	apiErrors       *prometheus.CounterVec
+}
+
+func Metrics_New() *Metrics {
+	metrics := Metrics{}
+	metrics.Registry = prometheus.NewRegistry()
+
+	metrics.requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      `http_requests_total`,
+		Help:      `Number of HTTP requests per endpoint, method and status code.`,
+	}, []string{`endpoint`, `method`, `status`})
+
+	metrics.requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      `http_request_duration_seconds`,
+		Help:      `Latency of HTTP requests per endpoint and method.`,
+		Buckets:   prometheus.DefBuckets,
+	}, []string{`endpoint`, `method`})
+
+	metrics.authorizations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      `authorization_requests_total`,
+		Help:      `Number of authorization requests per action which Authlete told.`,
+	}, []string{`action`})
+
+	metrics.decisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      `authorization_results_total`,
+		Help:      `Number of authorization requests which were completed, per result.`,
+	}, []string{`result`})
+
+	metrics.tokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      `token_requests_total`,
+		Help:      `Number of token requests per grant type and result.`,
+	}, []string{`grant_type`, `result`})
+
+	metrics.introspections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      `introspections_total`,
+		Help:      `Number of introspected access tokens per API and result.`,
+	}, []string{`api`, `result`})
+
+	metrics.logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      `login_attempts_total`,
+		Help:      `Number of user authentication attempts per method and result.`,
+	}, []string{`method`, `result`})
+
+	metrics.apiDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      `authlete_api_call_duration_seconds`,
+		Help:      `Latency of calls of Authlete APIs.`,
+		Buckets:   prometheus.DefBuckets,
+	}, []string{`api`})
+
+	metrics.apiErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      `authlete_api_errors_total`,
+		Help:      `Number of failed calls of Authlete APIs per HTTP status code (0 for network errors).`,
+	}, []string{`api`, `status`})
+
+	metrics.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metrics.requests, metrics.requestDuration, metrics.authorizations, metrics.decisions,
+		metrics.tokens, metrics.introspections, metrics.logins, metrics.apiDuration, metrics.apiErrors)
+
+	return &metrics
+}
+
+func Metrics_Get() *Metrics {
+	return metricsInstance
+}
+
+// LoginAttempted counts an attempt of user authentication. 'method' is one
+// of the authentication method references, e.g. "pwd".
+func (self *Metrics) LoginAttempted(method string, result string) {
+	self.logins.WithLabelValues(method, result).Inc()
+}
+
+// RequestMetrics_Handler returns middleware which measures HTTP requests.
+// Endpoints are identified by their route patterns.
+func RequestMetrics_Handler() gin.HandlerFunc {
+	metrics := Metrics_Get()
+
+	return func(ctx *gin.Context) {
+		start := time.Now()
+
+		ctx.Next()
+
+		endpoint := ctx.FullPath()
+		if endpoint == `` {
+			endpoint = `unmatched`
+		}
+
+		status := strconv.Itoa(ctx.Writer.Status())
+
+		metrics.requests.WithLabelValues(endpoint, ctx.Request.Method, status).Inc()
+		metrics.requestDuration.WithLabelValues(endpoint, ctx.Request.Method).Observe(time.Since(start).Seconds())
+	}
+}
+
+// MetricsEndpoint_Handler returns the handler which exposes the metrics in
+// the Prometheus text format.
+func MetricsEndpoint_Handler() gin.HandlerFunc {
+	return gin.WrapH(metricsHandler())
+}
+
+func metricsHandler() http.Handler {
+	registry := Metrics_Get().Registry
+
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry})
+}
+
+// MetricsAuthentication_Handler returns middleware which requires the token
+// as a bearer token.
+func MetricsAuthentication_Handler(token string) gin.HandlerFunc {
+	expected := []byte(`Bearer ` + token)
+
+	return func(ctx *gin.Context) {
+		presented := []byte(ctx.GetHeader(`Authorization`))
+
+		if subtle.ConstantTimeCompare(presented, expected) != 1 {
+			ctx.Header(`WWW-Authenticate`, `Bearer`)
+			ctx.AbortWithStatus(401)
+			return
+		}
+
+		ctx.Next()
+	}
+}
+
+// MetricsServer_New creates a server which serves only the metrics, at the
+// path "/metrics", so that they are not exposed on the public listener.
+func MetricsServer_New(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(`/metrics`, metricsHandler())
+
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+// metricsGrantType returns the value of the 'grant_type' label.
+func metricsGrantType(grantType string) string {
+	if metricsGrantTypes[grantType] {
+		return grantType
+	}
+
+	return `other`
+}
+
+// AuthleteApi_Metrics returns the decorator which measures the calls of
+// Authlete APIs and counts the outcomes of the OAuth endpoints from their
+// responses.
+func AuthleteApi_Metrics() AuthleteApiDecorator {
+	metrics := &metricsApi{metrics: Metrics_Get()}
+
+	return func(*gin.Context) AuthleteApiHook {
+		return metrics.hook
+	}
+}
+
+// metricsApi measures the calls of the APIs which this server uses.
+type metricsApi struct {
+	metrics *Metrics
+}
+
+func (self *metricsApi) hook(call *AuthleteApiCall, next func() (interface{}, *api.AuthleteError)) (interface{}, *api.AuthleteError) {
+	start := time.Now()
+	response, err := next()
+
+	self.metrics.apiDuration.WithLabelValues(call.Name).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		self.metrics.apiErrors.WithLabelValues(call.Name, strconv.Itoa(err.StatusCode)).Inc()
+	}
+
+	self.countOutcome(call, response)
+
+	return response, err
+}
+
+// countOutcome counts the outcome of the OAuth endpoint which made the call.
+func (self *metricsApi) countOutcome(call *AuthleteApiCall, response interface{}) {
+	switch request := call.Request.(type) {
+	case *dto.AuthorizationRequest:
+		if res, _ := response.(*dto.AuthorizationResponse); res != nil {
+			self.metrics.authorizations.WithLabelValues(string(res.Action)).Inc()
+		}
+	case *dto.AuthorizationIssueRequest:
+		if res, _ := response.(*dto.AuthorizationIssueResponse); res != nil {
+			result := `issued`
+			if res.Action != dto.AuthorizationIssueAction_LOCATION && res.Action != dto.AuthorizationIssueAction_FORM {
+				result = strings.ToLower(string(res.Action))
+			}
+			self.metrics.decisions.WithLabelValues(result).Inc()
+		}
+	case *dto.AuthorizationFailRequest:
+		// The reason, e.g. "denied" or "not_authenticated"
+		self.metrics.decisions.WithLabelValues(strings.ToLower(string(request.Reason))).Inc()
+	case *dto.TokenRequest:
+		// The result of the password flow is counted by TokenIssue or TokenFail.
+		if res, _ := response.(*dto.TokenResponse); res != nil && res.Action != dto.TokenAction_PASSWORD {
+			params, _ := url.ParseQuery(request.Parameters)
+			self.metrics.tokens.WithLabelValues(metricsGrantType(params.Get(`grant_type`)), string(res.Action)).Inc()
+		}
+	case *dto.TokenIssueRequest, *dto.TokenFailRequest:
+		if action := authleteApiAction(response); action != `` {
+			self.metrics.tokens.WithLabelValues(`password`, action).Inc()
+		}
+	case *dto.IntrospectionRequest:
+		if res, _ := response.(*dto.IntrospectionResponse); res != nil {
+			result := `error`
+			switch res.Action {
+			case dto.IntrospectionAction_OK:
+				result = `active`
+			case dto.IntrospectionAction_UNAUTHORIZED:
+				result = `inactive`
+			case dto.IntrospectionAction_FORBIDDEN:
+				result = `forbidden`
+			}
+			self.metrics.introspections.WithLabelValues(`Introspection`, result).Inc()
+		}
+	case *dto.StandardIntrospectionRequest:
+		if res, _ := response.(*dto.StandardIntrospectionResponse); res != nil {
+			result := `error`
+			if res.Action == dto.StandardIntrospectionAction_OK {
+				content := struct {
+					Active bool `json:"active"`
+				}{}
+				json.Unmarshal([]byte(res.ResponseContent), &content)
+
+				result = `inactive`
+				if content.Active {
+					result = `active`
+				}
+			}
+			self.metrics.introspections.WithLabelValues(`StandardIntrospection`, result).Inc()
+		}
+	}
+}
@@ -0,0 +1,53 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	// Not served on the public listener by default.
+	if res := testBrowser_New(t).get(`/metrics`, nil); res.Status != 404 {
+		t.Fatalf("The metrics were served without configuration: %d", res.Status)
+	}
+
+	t.Setenv(`METRICS_TOKEN`, `metrics-token`)
+	browser := testBrowser_New(t)
+
+	if res := browser.get(`/metrics`, nil); res.Status != 401 {
+		t.Fatalf("The metrics were served without the token: %d", res.Status)
+	}
+
+	// Clients cannot add values of the 'grant_type' label.
+	browser.post(`/api/token`, url.Values{`grant_type`: {`made-up-grant-type`}, `client_id`: {`1`}})
+
+	request, _ := http.NewRequest(`GET`, browser.server.URL+`/metrics`, nil)
+	request.Header.Set(`Authorization`, `Bearer metrics-token`)
+
+	res := browser.do(request)
+	if res.Status != 200 {
+		t.Fatalf("The metrics were not served with the token: %d", res.Status)
+	}
+
+	if strings.Contains(res.Body, `made-up-grant-type`) || strings.Contains(res.Body, `grant_type="other"`) == false {
+		t.Errorf("An unknown grant type was used as a label")
+	}
+}
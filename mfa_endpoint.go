@@ -0,0 +1,168 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/authlete/authlete-go/dto"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Seconds within which the user has to present the second factor after
+	// the password has been verified.
+	secondFactorTimeout = 300
+)
+
+type MfaEndpoint struct {
+	AuthorizationDecisionEndpoint
+}
+
+func MfaEndpoint_Handler() gin.HandlerFunc {
+	// Instance of the endpoint to which the second factor is presented
+	endpoint := MfaEndpoint{}
+
+	return func(ctx *gin.Context) {
+		endpoint.Handle(ctx)
+	}
+}
+
+func (self *MfaEndpoint) Handle(ctx *gin.Context) {
+	api := self.GetAuthleteApi(ctx)
+	if api == nil {
+		return
+	}
+
+	// Session
+	session := sessions.Default(ctx)
+
+	// The user who has presented a correct password and the decision
+	// which was made in the authorization page.
+	user, authorized := takePendingSecondFactor(ctx, session)
+
+	if user != nil {
+		// Verify the code presented by the user. If the verification fails,
+		// the user stays logged out and the authorization request fails.
+		authenticateSecondFactor(ctx, session, user)
+	}
+
+	// If the ACR is essential but the user has not achieved it.
+	if authorized && isEssentialAcrUnmet(session) {
+		msg := "mfa_endpoint: The request fails because the user has not achieved the essential ACR."
+		log.Debug().Msg(msg)
+		self.authorizationFail(ctx, session, dto.AuthorizationFailReason_ACR_NOT_SATISFIED)
+		return
+	}
+
+	// Process the authorization request according to the user's decision.
+	self.handleDecision(ctx, session, authorized)
+}
+
+func requestSecondFactor(ctx *gin.Context, session sessions.Session,
+	user *UserEntity, authorized bool) {
+	// Remember the user until the second factor is presented.
+	session.Set(`mfaSubject`, user.Subject)
+	session.Set(`mfaStartedAt`, uint64(time.Now().Unix()))
+	session.Set(`mfaAuthorized`, authorized)
+	session.Save()
+
+	// Render the page to input a code of the second factor.
+	model := MfaPageModel{UserName: user.GivenName}
+	ctx.HTML(200, `mfa.html`, gin.H{"model": model})
+}
+
+func takePendingSecondFactor(ctx *gin.Context, session sessions.Session) (*UserEntity, bool) {
+	value := session.Get(`mfaSubject`)
+	subject, _ := value.(string)
+
+	value = session.Get(`mfaStartedAt`)
+	startedAt, _ := value.(uint64)
+
+	value = session.Get(`mfaAuthorized`)
+	authorized, _ := value.(bool)
+
+	// The pending state can be used only once.
+	session.Delete(`mfaSubject`)
+	session.Delete(`mfaStartedAt`)
+	session.Delete(`mfaAuthorized`)
+	session.Save()
+
+	if subject == `` {
+		return nil, authorized
+	}
+
+	// If the user took too long to present the second factor.
+	if uint64(time.Now().Unix()) > startedAt+secondFactorTimeout {
+		msg := "mfa_endpoint: The second factor was not presented in time."
+		log.Debug().Msg(msg)
+		return nil, authorized
+	}
+
+	return UserStore_Of(ctx).GetBySubject(subject), authorized
+}
+
+func authenticateSecondFactor(ctx *gin.Context, session sessions.Session, user *UserEntity) {
+	// Code that the user input in the second factor form. It is either a
+	// code generated by an authenticator application or a recovery code.
+	code := ctx.PostForm(`code`)
+
+	// Failures of the second factor count as well as those of the password.
+	throttle := LoginThrottle_Of(ctx)
+	if throttle.Attempt(user.LoginId, ctx.ClientIP()) > 0 {
+		msg := fmt.Sprintf("mfa_endpoint: Second factor verification was throttled. The subject is '%s'.", user.Subject)
+		log.Debug().Msg(msg)
+		Metrics_Get().LoginAttempted(Amr_OTP, LoginResult_THROTTLED)
+		auditLoginFailure(ctx, session, Amr_OTP, user.LoginId, LoginResult_THROTTLED, ``)
+		return
+	}
+
+	if verifySecondFactor(ctx, user, code) == false {
+		// User authentication failed.
+		msg := fmt.Sprintf("mfa_endpoint: Second factor verification failed. The subject is '%s'.", user.Subject)
+		log.Debug().Msg(msg)
+		throttle.Failed(ctx, user.LoginId, ctx.ClientIP())
+		Metrics_Get().LoginAttempted(Amr_OTP, LoginResult_FAILURE)
+		auditLoginFailure(ctx, session, Amr_OTP, user.LoginId, LoginResult_FAILURE, `invalid_code`)
+		return
+	}
+
+	// User authentication succeeded.
+	msg := fmt.Sprintf("mfa_endpoint: User authentication succeeded. The subject is '%s'.", user.Subject)
+	log.Debug().Msg(msg)
+	throttle.Succeeded(user.LoginId, ctx.ClientIP())
+
+	// Let the user log in.
+	loginUser(ctx, session, user, []string{Amr_PWD, Amr_OTP})
+}
+
+func verifySecondFactor(ctx *gin.Context, user *UserEntity, code string) bool {
+	db := UserStore_Of(ctx)
+
+	// Check if the code is a valid TOTP code.
+	step, ok := Totp_Verify(user.TotpSecret, code, time.Now())
+	if ok {
+		// Reject the code if it has already been used.
+		return db.UseTotpStep(user.Subject, step)
+	}
+
+	// Check if the code is one of the unused recovery codes.
+	return db.UseRecoveryCode(user.Subject, code)
+}
@@ -0,0 +1,120 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Issuer shown in authenticator applications.
+	totpIssuer = `gin-oauth-server`
+
+	// Number of recovery codes issued on enrollment.
+	recoveryCodeCount = 10
+)
+
+func MfaEnrollmentEndpoint_Handler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		// Session
+		session := sessions.Default(ctx)
+
+		// Only a user who has logged in can enroll a second factor.
+		user := getUserFromSession(session)
+		if user == nil {
+			ctx.String(401, "Login is required to enroll a second factor.")
+			return
+		}
+
+		if ctx.Request.Method == `POST` {
+			confirmEnrollment(ctx, session, user)
+		} else {
+			startEnrollment(ctx, session, user)
+		}
+	}
+}
+
+func startEnrollment(ctx *gin.Context, session sessions.Session, user *UserEntity) {
+	// A new secret shared with the authenticator application of the user.
+	// It is not used until the user proves that the application has it.
+	secret := Totp_GenerateSecret()
+	session.Set(`mfaEnrollmentSecret`, secret)
+	session.Save()
+
+	renderEnrollmentPage(ctx, user, secret, ``)
+}
+
+func confirmEnrollment(ctx *gin.Context, session sessions.Session, user *UserEntity) {
+	value := session.Get(`mfaEnrollmentSecret`)
+	secret, _ := value.(string)
+
+	if secret == `` {
+		ctx.String(400, "Enrollment has not been started.")
+		return
+	}
+
+	// Code that the authenticator application of the user generated.
+	code := ctx.PostForm(`code`)
+
+	if _, ok := Totp_Verify(secret, code, time.Now()); ok == false {
+		renderEnrollmentPage(ctx, user, secret, `The code is wrong. Try again.`)
+		return
+	}
+
+	// The enrollment is confirmed.
+	session.Delete(`mfaEnrollmentSecret`)
+	session.Save()
+
+	// Recovery codes which can be used when the application is lost.
+	codes := RecoveryCodes_Generate(recoveryCodeCount)
+	if UserStore_Of(ctx).UpdateTotp(user.Subject, secret, codes) == false {
+		renderMessagePage(ctx, 400, `Two-Factor Authentication`, `A second factor cannot be enrolled for this account.`)
+		return
+	}
+
+	msg := fmt.Sprintf("mfa_enrollment_endpoint: A second factor was enrolled. The subject is '%s'.", user.Subject)
+	log.Debug().Msg(msg)
+
+	// Show the recovery codes. This is the only chance to see them.
+	model := MfaEnrollmentPageModel{UserName: user.GivenName, RecoveryCodes: codes}
+	ctx.HTML(200, `mfa_enrollment.html`, gin.H{"model": model})
+}
+
+func renderEnrollmentPage(ctx *gin.Context, user *UserEntity, secret string, message string) {
+	uri := Totp_KeyUri(totpIssuer, user.LoginId, secret)
+
+	qrcode, err := Totp_QrCode(uri)
+	if err != nil {
+		msg := fmt.Sprintf("mfa_enrollment_endpoint: Failed to generate a QR code: %s", err)
+		log.Debug().Msg(msg)
+	}
+
+	model := MfaEnrollmentPageModel{
+		UserName: user.GivenName,
+		QrCode:   template.URL(qrcode),
+		Secret:   secret,
+		Error:    message,
+	}
+
+	ctx.HTML(200, `mfa_enrollment.html`, gin.H{"model": model})
+}
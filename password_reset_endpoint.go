@@ -0,0 +1,143 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	linkPurposePasswordReset = `password_reset`
+
+	// Lifetime of links to reset passwords.
+	passwordResetLifetime = 30 * time.Minute
+)
+
+func PasswordForgotEndpoint_Handler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if ctx.Request.Method != `POST` {
+			ctx.HTML(200, `password_forgot.html`, gin.H{})
+			return
+		}
+
+		email := ctx.PostForm(`email`)
+		user := UserStore_Of(ctx).GetByEmail(email)
+
+		if user != nil && user.Disabled == false {
+			sendPasswordResetMail(ctx, user)
+		} else {
+			msg := "password_reset_endpoint: No user has the email address."
+			log.Debug().Msg(msg)
+		}
+
+		// The response is the same whether the user exists or not so that
+		// the page cannot be used to find registered email addresses.
+		renderMessagePage(ctx, 200, `Password Reset`,
+			`If an account with the email address exists, a link to reset the password has been sent to it.`)
+	}
+}
+
+func sendPasswordResetMail(ctx *gin.Context, user *UserEntity) {
+	token := LinkTokenIssuer_Get().Issue(tenantNameOf(ctx), linkPurposePasswordReset, user, passwordResetLifetime)
+	link := getServerBaseUrlOf(ctx) + `/password/reset?token=` + url.QueryEscape(token)
+
+	body := fmt.Sprintf("Hello %s,\r\n\r\n"+
+		"Open the following link to set a new password for '%s'.\r\n\r\n%s\r\n\r\n"+
+		"The link expires in 30 minutes. If you did not ask for it, ignore this mail.\r\n",
+		user.GivenName, user.LoginId, link)
+
+	err := MailSender_Get().Send(user.Email, `Reset your password`, body)
+	if err != nil {
+		msg := fmt.Sprintf("password_reset_endpoint: Failed to send a mail: %s", err)
+		log.Warn().Msg(msg)
+	}
+}
+
+func PasswordResetEndpoint_Handler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		issuer := LinkTokenIssuer_Get()
+
+		if ctx.Request.Method != `POST` {
+			// Check the link before showing the form, but leave it usable.
+			token := ctx.Query(`token`)
+			if _, err := issuer.Verify(token, tenantNameOf(ctx), linkPurposePasswordReset); err != nil {
+				renderMessagePage(ctx, 400, `Password Reset`, `The link is invalid or has expired.`)
+				return
+			}
+
+			renderPasswordResetPage(ctx, token, ``)
+			return
+		}
+
+		token := ctx.PostForm(`token`)
+		password := ctx.PostForm(`password`)
+
+		if len(password) < minPasswordLength {
+			renderPasswordResetPage(ctx, token,
+				fmt.Sprintf(`The password must be at least %d characters long.`, minPasswordLength))
+			return
+		}
+
+		// The link can be used only once.
+		link, err := issuer.Consume(token, tenantNameOf(ctx), linkPurposePasswordReset)
+		if err != nil {
+			renderMessagePage(ctx, 400, `Password Reset`, `The link is invalid or has expired.`)
+			return
+		}
+
+		subject := link.Subject
+
+		db := UserStore_Of(ctx)
+		user := db.GetBySubject(subject)
+		if user == nil {
+			renderMessagePage(ctx, 400, `Password Reset`, `The account does not exist.`)
+			return
+		}
+
+		// The link was sent to an address which the user no longer has.
+		if link.IsFor(user) == false {
+			renderMessagePage(ctx, 400, `Password Reset`, `The link is invalid or has expired.`)
+			return
+		}
+
+		if db.UpdatePassword(subject, password) == false {
+			renderMessagePage(ctx, 400, `Password Reset`, `The password of this account cannot be changed here.`)
+			return
+		}
+
+		// The user has proved the control of the email address as well.
+		db.UpdateEmailVerified(subject, true)
+
+		// Lift the lockout of the account if any.
+		LoginThrottle_Of(ctx).Succeeded(user.LoginId, ``)
+
+		msg := fmt.Sprintf("password_reset_endpoint: A password was reset. The subject is '%s'.", subject)
+		log.Debug().Msg(msg)
+
+		renderMessagePage(ctx, 200, `Password Reset`, `Your password has been changed.`)
+	}
+}
+
+func renderPasswordResetPage(ctx *gin.Context, token string, message string) {
+	model := PasswordResetPageModel{Token: token, Error: message}
+	ctx.HTML(200, `password_reset.html`, gin.H{"model": model})
+}
@@ -0,0 +1,127 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Number of times an attempt is evaluated again when other servers change
+// the record at the same time.
+const redisThrottleMaxRetries = 10
+
+// RedisThrottleStore is a ThrottleStore shared by the servers of a cluster.
+type RedisThrottleStore struct {
+	Client *redis.Client
+	Prefix string
+}
+
+func RedisThrottleStore_New(addr string) *RedisThrottleStore {
+	store := RedisThrottleStore{}
+	store.Client = redis.NewClient(&redis.Options{Addr: addr})
+	store.Prefix = `throttle:`
+
+	return &store
+}
+
+func (self *RedisThrottleStore) Get(key string) (ThrottleRecord, error) {
+	values, err := self.Client.HGetAll(context.Background(), self.Prefix+key).Result()
+	if err != nil {
+		return ThrottleRecord{}, err
+	}
+
+	return toThrottleRecord(values[`failures`], values[`last`]), nil
+}
+
+func (self *RedisThrottleStore) Acquire(key string, now time.Time, ttl time.Duration,
+	wait func(ThrottleRecord) time.Duration) (time.Duration, error) {
+	ctx := context.Background()
+	key = self.Prefix + key
+
+	// Read the record and increment the counter in an optimistic
+	// transaction. It fails if another server changes the record in the
+	// meantime, and then the attempt is evaluated again.
+	for i := 0; i < redisThrottleMaxRetries; i++ {
+		var w time.Duration
+
+		err := self.Client.Watch(ctx, func(tx *redis.Tx) error {
+			values, err := tx.HGetAll(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+
+			record := toThrottleRecord(values[`failures`], values[`last`])
+			if w = wait(record); w > 0 {
+				return nil
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.HSet(ctx, key, `failures`, record.Failures+1, `last`, now.UnixNano())
+				pipe.Expire(ctx, key, ttl)
+				return nil
+			})
+			return err
+		}, key)
+
+		if err != redis.TxFailedErr {
+			return w, err
+		}
+	}
+
+	return 0, fmt.Errorf("the record of %s kept changing", key)
+}
+
+// Decrement the counter unless the record has expired.
+var redisThrottleReleaseScript = redis.NewScript(`
+if tonumber(redis.call('HGET', KEYS[1], 'failures') or '0') > 0 then
+	redis.call('HINCRBY', KEYS[1], 'failures', -1)
+end
+return 0
+`)
+
+func (self *RedisThrottleStore) Release(key string) error {
+	return redisThrottleReleaseScript.Run(context.Background(), self.Client, []string{self.Prefix + key}).Err()
+}
+
+func (self *RedisThrottleStore) Delete(key string) error {
+	return self.Client.Del(context.Background(), self.Prefix+key).Err()
+}
+
+func (self *RedisThrottleStore) CheckHealth() error {
+	return self.Client.Ping(context.Background()).Err()
+}
+
+func (self *RedisThrottleStore) Close() error {
+	return self.Client.Close()
+}
+
+func toThrottleRecord(failures string, last string) ThrottleRecord {
+	record := ThrottleRecord{}
+	record.Failures, _ = strconv.Atoi(failures)
+
+	nanos, _ := strconv.ParseInt(last, 10, 64)
+	if nanos != 0 {
+		record.LastFailure = time.Unix(0, nanos)
+	}
+
+	return record
+}
@@ -0,0 +1,59 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisUsedTokenStore is a UsedTokenStore shared by the servers of a
+// cluster.
+type RedisUsedTokenStore struct {
+	Client *redis.Client
+	Prefix string
+}
+
+func RedisUsedTokenStore_New(addr string) *RedisUsedTokenStore {
+	store := RedisUsedTokenStore{}
+	store.Client = redis.NewClient(&redis.Options{Addr: addr})
+	store.Prefix = `used-token:`
+
+	return &store
+}
+
+func (self *RedisUsedTokenStore) Use(id string, expires time.Time) (bool, error) {
+	// The key is set only by the first server which uses the token, and it
+	// is removed when the token expires.
+	ttl := time.Until(expires)
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+
+	return self.Client.SetNX(context.Background(), self.Prefix+id, 1, ttl).Result()
+}
+
+func (self *RedisUsedTokenStore) IsUsed(id string) (bool, error) {
+	count, err := self.Client.Exists(context.Background(), self.Prefix+id).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return count != 0, nil
+}
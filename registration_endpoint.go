@@ -0,0 +1,154 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"fmt"
+	"net/mail"
+
+	"github.com/authlete/authlete-go/types"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// 'prompt=create' (Initiating User Registration via OpenID Connect 1.0)
+	Prompt_CREATE types.Prompt = `create`
+
+	// Minimum length of passwords of new users.
+	minPasswordLength = 8
+)
+
+func RegistrationEndpoint_Handler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if ctx.Request.Method == `POST` {
+			register(ctx)
+		} else {
+			renderRegistrationPage(ctx, RegistrationPageModel{})
+		}
+	}
+}
+
+func register(ctx *gin.Context) {
+	// Session
+	session := sessions.Default(ctx)
+
+	// Values that the user input in the registration form.
+	model := RegistrationPageModel{}
+	model.LoginId = ctx.PostForm(`loginId`)
+	model.GivenName = ctx.PostForm(`givenName`)
+	model.FamilyName = ctx.PostForm(`familyName`)
+	model.Email = ctx.PostForm(`email`)
+	password := ctx.PostForm(`password`)
+
+	model.Error = validateRegistration(&model, password)
+	if model.Error != `` {
+		renderRegistrationPage(ctx, model)
+		return
+	}
+
+	user := UserEntity{
+		LoginId:    model.LoginId,
+		Password:   password,
+		GivenName:  model.GivenName,
+		FamilyName: model.FamilyName,
+		Email:      model.Email,
+	}
+
+	// Create the user in the user database.
+	err := UserStore_Of(ctx).Create(&user)
+	if err == ErrUserStoreReadOnly {
+		model.Error = `Registration is not available.`
+		renderRegistrationPage(ctx, model)
+		return
+	}
+	if err != nil {
+		model.Error = `The login ID is already used. Choose another one.`
+		renderRegistrationPage(ctx, model)
+		return
+	}
+
+	msg := fmt.Sprintf("registration_endpoint: A user was registered. The subject is '%s'.", user.Subject)
+	log.Debug().Msg(msg)
+
+	// REGISTRATION_EMAIL_VERIFICATION is one of "none", "optional" (the
+	// user is asked to verify the email address later) and "required"
+	// (the user cannot log in until the email address is verified).
+	verification := getConfiguration(`REGISTRATION_EMAIL_VERIFICATION`, `optional`)
+
+	if verification != `none` {
+		err = sendVerificationMail(ctx, &user)
+		if err != nil {
+			msg := fmt.Sprintf("registration_endpoint: Failed to send a verification mail: %s", err)
+			log.Warn().Msg(msg)
+		}
+	}
+
+	if verification == `required` {
+		// The link in the mail lets the user log in and continues the
+		// pending authorization request.
+		session.Set(`pendingRegistration`, user.Subject)
+		session.Save()
+
+		renderMessagePage(ctx, 200, `Registration`,
+			`A link to verify your email address has been sent. Open it to continue.`)
+		return
+	}
+
+	// Let the user log in.
+	loginUser(ctx, session, &user, []string{Amr_PWD})
+
+	// Continue the pending authorization request if any.
+	if resumeAuthorization(ctx, session, &user) {
+		return
+	}
+
+	model.Completed = true
+	renderRegistrationPage(ctx, model)
+}
+
+// isEmailVerificationPending tells whether the user cannot log in yet
+// because REGISTRATION_EMAIL_VERIFICATION is "required" and the email
+// address of the user has not been verified.
+func isEmailVerificationPending(user *UserEntity) bool {
+	if user.Email == `` || user.EmailVerified {
+		return false
+	}
+
+	return getConfiguration(`REGISTRATION_EMAIL_VERIFICATION`, `optional`) == `required`
+}
+
+func validateRegistration(model *RegistrationPageModel, password string) string {
+	if model.LoginId == `` || model.GivenName == `` || model.FamilyName == `` {
+		return `Login ID, given name and family name are required.`
+	}
+
+	if len(password) < minPasswordLength {
+		return fmt.Sprintf(`The password must be at least %d characters long.`, minPasswordLength)
+	}
+
+	if _, err := mail.ParseAddress(model.Email); err != nil {
+		return `The email address is invalid.`
+	}
+
+	return ``
+}
+
+func renderRegistrationPage(ctx *gin.Context, model RegistrationPageModel) {
+	ctx.HTML(200, `registration.html`, gin.H{"model": model})
+}
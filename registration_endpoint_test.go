@@ -0,0 +1,102 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRequiredEmailVerification(t *testing.T) {
+	t.Setenv(`REGISTRATION_EMAIL_VERIFICATION`, `required`)
+	sender := testMailSender_Install(t)
+	testUserStore_Install(t)
+
+	// Another browser, in which the link is not opened.
+	other := testBrowser_New(t)
+
+	browser := testBrowser_New(t)
+	form := browser.authorize(nil)
+	res := browser.post(`/registration`, url.Values{
+		`loginId`:    {`alice`},
+		`password`:   {`alice-password`},
+		`givenName`:  {`Alice`},
+		`familyName`: {`Smith`},
+		`email`:      {`alice@example.com`},
+	})
+	if res.Status != 200 {
+		t.Fatalf("The registration failed: %d %s", res.Status, res.Body)
+	}
+	token := sender.link(t).Get(`token`)
+
+	// The user cannot log in until the email address is verified.
+	expectError(t, browser.submit(form, testDecision(`alice`, `alice-password`, true)), `login_required`)
+
+	params := url.Values{`grant_type`: {`password`}, `username`: {`alice`}, `password`: {`alice-password`}}
+	if res := other.post(`/api/token`, params); res.Status != 400 {
+		t.Fatalf("The token endpoint returned %d for an unverified user: %s", res.Status, res.Body)
+	}
+
+	// Fetching the link, e.g. by a mail scanner, does not use it up.
+	for i := 0; i < 2; i++ {
+		res := other.get(`/email/verification`, url.Values{`token`: {token}})
+		if form := parseTestForm(t, res.Body, `confirmation-form`); form.Action != `/email/verification` {
+			t.Fatalf("The confirmation is posted to '%s'", form.Action)
+		}
+	}
+
+	if res := other.post(`/api/token`, params); res.Status != 400 {
+		t.Fatalf("Fetching the link verified the email address: %d %s", res.Status, res.Body)
+	}
+
+	// The confirmation verifies the email address.
+	if res := other.post(`/email/verification`, url.Values{`token`: {token}}); res.Status != 200 {
+		t.Fatalf("The verification failed: %d %s", res.Status, res.Body)
+	}
+
+	if res := other.post(`/api/token`, params); res.Status != 200 {
+		t.Fatalf("The token endpoint returned %d for a verified user: %s", res.Status, res.Body)
+	}
+}
+
+func TestEmailVerificationOfChangedAddress(t *testing.T) {
+	sender := testMailSender_Install(t)
+	users := testUserStore_Install(t)
+
+	browser := testBrowser_New(t)
+	browser.post(`/registration`, url.Values{
+		`loginId`:    {`alice`},
+		`password`:   {`alice-password`},
+		`givenName`:  {`Alice`},
+		`familyName`: {`Smith`},
+		`email`:      {`alice@example.com`},
+	})
+	token := sender.link(t).Get(`token`)
+
+	// The user changes the email address before opening the link.
+	user := users.GetByEmail(`alice@example.com`)
+	user.Email = `alice@another.example`
+	users.Update(user)
+
+	if res := browser.post(`/email/verification`, url.Values{`token`: {token}}); res.Status != 400 {
+		t.Fatalf("The link verified another address: %d %s", res.Status, res.Body)
+	}
+
+	if users.GetBySubject(user.Subject).EmailVerified {
+		t.Errorf("The new address was marked verified")
+	}
+}
@@ -0,0 +1,190 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+
+	"github.com/crewjam/saml"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Authentication request sent to a SAML identity provider, which is kept in
+// the session until the user comes back.
+type samlRequest struct {
+	Provider   string
+	RequestId  string
+	RelayState string
+}
+
+func SamlLoginEndpoint_Handler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		// Session
+		session := sessions.Default(ctx)
+
+		provider := Federation_Get().GetSamlProvider(ctx.Param(`name`))
+		if provider == nil {
+			renderMessagePage(ctx, 404, `Login`, `The identity provider is unknown.`)
+			return
+		}
+
+		sp, err := provider.ServiceProvider(ctx.Request.Context(), getServerBaseUrlOf(ctx))
+		if err != nil {
+			renderMessagePage(ctx, 502, `Login`, `The identity provider is not available.`)
+			return
+		}
+
+		// SP-initiated login with the HTTP-Redirect binding. The response
+		// comes back with the HTTP-POST binding.
+		req, err := sp.MakeAuthenticationRequest(
+			sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+		if err != nil {
+			renderMessagePage(ctx, 500, `Login`, `Failed to make an authentication request.`)
+			return
+		}
+
+		request := samlRequest{
+			Provider:   provider.Configuration.Name,
+			RequestId:  req.ID,
+			RelayState: randomString(),
+		}
+
+		// The request is signed with the key of this service provider.
+		location, err := req.Redirect(request.RelayState, sp)
+		if err != nil {
+			renderMessagePage(ctx, 500, `Login`, `Failed to make an authentication request.`)
+			return
+		}
+
+		bytes, _ := json.Marshal(request)
+		session.Set(`samlRequest`, bytes)
+		session.Save()
+
+		ctx.Redirect(302, location.String())
+	}
+}
+
+func SamlAcsEndpoint_Handler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		// The response is posted from the identity provider's site, so
+		// browsers don't send the session cookie (SameSite=Lax). Post it
+		// again from this site.
+		if ctx.PostForm(`resubmitted`) == `` {
+			ctx.HTML(200, `saml_post.html`, gin.H{
+				"action":       ctx.Request.URL.Path,
+				"samlResponse": ctx.PostForm(`SAMLResponse`),
+				"relayState":   ctx.PostForm(`RelayState`),
+			})
+			return
+		}
+
+		// Session
+		session := sessions.Default(ctx)
+
+		// The request can be used only once.
+		request := takeSamlRequest(session)
+
+		provider := Federation_Get().GetSamlProvider(ctx.Param(`name`))
+		if provider == nil || request == nil || request.Provider != provider.Configuration.Name ||
+			request.RelayState != ctx.PostForm(`RelayState`) {
+			renderMessagePage(ctx, 400, `Login`, `The login request is invalid or has expired.`)
+			return
+		}
+
+		sp, err := provider.ServiceProvider(ctx.Request.Context(), getServerBaseUrlOf(ctx))
+		if err != nil {
+			renderMessagePage(ctx, 502, `Login`, `The identity provider is not available.`)
+			return
+		}
+
+		// Verify the signature, the audience, the recipient, the validity
+		// period and that the response is for the request sent above.
+		assertion, err := sp.ParseResponse(ctx.Request, []string{request.RequestId})
+		if err != nil {
+			if e, ok := err.(*saml.InvalidResponseError); ok {
+				err = e.PrivateErr
+			}
+			msg := fmt.Sprintf("saml_endpoint: Login with '%s' failed: %s", provider.Configuration.Name, err)
+			log.Debug().Msg(msg)
+			renderMessagePage(ctx, 401, `Login`, `Login with the identity provider failed.`)
+			return
+		}
+
+		claims := provider.assertionClaims(assertion)
+		if claims.Subject == `` {
+			renderMessagePage(ctx, 401, `Login`, `Login with the identity provider failed.`)
+			return
+		}
+
+		// Find the local user linked to the account, or provision one.
+		config := provider.Configuration
+		user, err := findOrProvisionUser(ctx, config.Name, config.LinkByEmail, claims)
+		if err != nil {
+			msg := fmt.Sprintf("saml_endpoint: Failed to provision a user: %s", err)
+			log.Warn().Msg(msg)
+			renderMessagePage(ctx, 500, `Login`, `Failed to create an account.`)
+			return
+		}
+
+		completeFederatedLogin(ctx, session, user, federatedAmr(claims.Amr, config.TrustedAmr))
+	}
+}
+
+func SamlMetadataEndpoint_Handler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		provider := Federation_Get().GetSamlProvider(ctx.Param(`name`))
+		if provider == nil {
+			ctx.Status(404)
+			return
+		}
+
+		sp, err := provider.ServiceProvider(ctx.Request.Context(), getServerBaseUrlOf(ctx))
+		if err != nil {
+			ctx.Status(502)
+			return
+		}
+
+		// Metadata of this service provider to be registered with the
+		// identity provider.
+		bytes, _ := xml.MarshalIndent(sp.Metadata(), ``, `  `)
+
+		ctx.Data(200, `application/samlmetadata+xml`, bytes)
+	}
+}
+
+func takeSamlRequest(session sessions.Session) *samlRequest {
+	value := session.Get(`samlRequest`)
+	if value == nil {
+		return nil
+	}
+
+	session.Delete(`samlRequest`)
+	session.Save()
+
+	bytes, _ := value.([]byte)
+
+	request := samlRequest{}
+	if json.Unmarshal(bytes, &request) != nil {
+		return nil
+	}
+
+	return &request
+}
@@ -0,0 +1,254 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/rs/zerolog/log"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+type SamlProviderConfiguration struct {
+	// Identifier used in URLs and in linked accounts, e.g. "enterprise".
+	// It must not be the same as the name of any OpenID provider.
+	Name string `toml:"name"`
+
+	// Label of the button on the login form.
+	DisplayName string `toml:"display_name"`
+
+	// Metadata of the identity provider, either fetched from the URL or
+	// read from the file.
+	MetadataUrl  string `toml:"metadata_url"`
+	MetadataFile string `toml:"metadata_file"`
+
+	// PEM files of the certificate and the private key of this service
+	// provider. Authentication requests are signed with the key.
+	Certificate string `toml:"certificate"`
+	Key         string `toml:"key"`
+
+	// Names of the attributes which carry the user's information. Either
+	// the name or the friendly name of an attribute matches.
+	Attributes SamlAttributeMapping `toml:"attributes"`
+
+	// If true, the email address asserted by the identity provider is
+	// regarded as verified, and a local user who has the same email
+	// address is linked on the first login.
+	LinkByEmail bool `toml:"link_by_email"`
+
+	// Values of "amr" which the provider is trusted to report. They are
+	// derived from the authentication context of assertions.
+	TrustedAmr []string `toml:"trusted_amr"`
+}
+
+type SamlAttributeMapping struct {
+	Email      string `toml:"email"`
+	GivenName  string `toml:"given_name"`
+	FamilyName string `toml:"family_name"`
+	Name       string `toml:"name"`
+}
+
+// Attribute names defined by the eduPerson and X.500 schemas, which most
+// identity providers support.
+var defaultSamlAttributes = SamlAttributeMapping{
+	Email:      `urn:oid:0.9.2342.19200300.100.1.3`,
+	GivenName:  `urn:oid:2.5.4.42`,
+	FamilyName: `urn:oid:2.5.4.4`,
+	Name:       `urn:oid:2.16.840.1.113730.3.1.241`,
+}
+
+// SamlProvider is an upstream SAML 2.0 identity provider. This server acts
+// as a service provider for it. The metadata is loaded on first use.
+type SamlProvider struct {
+	Configuration SamlProviderConfiguration
+	sp            *saml.ServiceProvider
+	mutex         sync.Mutex
+}
+
+func (self *Federation) GetSamlProvider(name string) *SamlProvider {
+	for _, provider := range self.SamlProviders {
+		if provider.Configuration.Name == name {
+			return provider
+		}
+	}
+
+	return nil
+}
+
+func (self *SamlProvider) MetadataUrl(baseUrl string) string {
+	return baseUrl + `/saml/metadata/` + self.Configuration.Name
+}
+
+func (self *SamlProvider) AcsUrl(baseUrl string) string {
+	return baseUrl + `/saml/acs/` + self.Configuration.Name
+}
+
+// ServiceProvider returns this server as the service provider under
+// 'baseUrl', e.g. the base URL of a tenant. Each base URL is a service
+// provider of its own.
+func (self *SamlProvider) ServiceProvider(ctx context.Context, baseUrl string) (*saml.ServiceProvider, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.sp == nil {
+		sp, err := self.build(ctx)
+		if err != nil {
+			msg := fmt.Sprintf("saml_federation: Failed to set up '%s': %s", self.Configuration.Name, err)
+			log.Warn().Msg(msg)
+			return nil, err
+		}
+
+		self.sp = sp
+	}
+
+	metadataUrl, _ := url.Parse(self.MetadataUrl(baseUrl))
+	acsUrl, _ := url.Parse(self.AcsUrl(baseUrl))
+
+	sp := *self.sp
+	sp.EntityID = metadataUrl.String()
+	sp.MetadataURL = *metadataUrl
+	sp.AcsURL = *acsUrl
+
+	return &sp, nil
+}
+
+func (self *SamlProvider) build(ctx context.Context) (*saml.ServiceProvider, error) {
+	config := self.Configuration
+
+	metadata, err := self.loadMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPair, err := tls.LoadX509KeyPair(config.Certificate, config.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := keyPair.PrivateKey.(crypto.Signer)
+	if ok == false {
+		return nil, fmt.Errorf("the private key cannot sign")
+	}
+
+	// The URLs are set by ServiceProvider.
+	sp := saml.ServiceProvider{
+		Key:         key,
+		Certificate: certificate,
+		IDPMetadata: metadata,
+	}
+
+	// Sign authentication requests.
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		sp.SignatureMethod = dsig.RSASHA256SignatureMethod
+	} else {
+		sp.SignatureMethod = dsig.ECDSASHA256SignatureMethod
+	}
+
+	return &sp, nil
+}
+
+func (self *SamlProvider) loadMetadata(ctx context.Context) (*saml.EntityDescriptor, error) {
+	config := self.Configuration
+
+	if config.MetadataFile != `` {
+		data, err := os.ReadFile(config.MetadataFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return samlsp.ParseMetadata(data)
+	}
+
+	metadataUrl, err := url.Parse(config.MetadataUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	return samlsp.FetchMetadata(ctx, http.DefaultClient, *metadataUrl)
+}
+
+// assertionClaims converts attributes in the assertion into the claims used to find
+// or provision a local user.
+func (self *SamlProvider) assertionClaims(assertion *saml.Assertion) *upstreamClaims {
+	mapping := self.Configuration.Attributes
+	claims := upstreamClaims{}
+
+	if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		claims.Subject = assertion.Subject.NameID.Value
+	}
+
+	claims.Email = samlAttribute(assertion, mapping.Email, defaultSamlAttributes.Email)
+	claims.GivenName = samlAttribute(assertion, mapping.GivenName, defaultSamlAttributes.GivenName)
+	claims.FamilyName = samlAttribute(assertion, mapping.FamilyName, defaultSamlAttributes.FamilyName)
+	claims.Name = samlAttribute(assertion, mapping.Name, defaultSamlAttributes.Name)
+
+	// SAML has no notion of verified email addresses. Trust the identity
+	// provider only if it has been configured so.
+	claims.EmailVerified = self.Configuration.LinkByEmail && claims.Email != ``
+
+	// Password-based authentication contexts are reported as "pwd".
+	for _, statement := range assertion.AuthnStatements {
+		ref := statement.AuthnContext.AuthnContextClassRef
+		if ref == nil {
+			continue
+		}
+
+		switch ref.Value {
+		case `urn:oasis:names:tc:SAML:2.0:ac:classes:Password`,
+			`urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport`:
+			claims.Amr = []string{Amr_PWD}
+		}
+	}
+
+	return &claims
+}
+
+func samlAttribute(assertion *saml.Assertion, name string, defaultName string) string {
+	if name == `` {
+		name = defaultName
+	}
+
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if attribute.Name != name && attribute.FriendlyName != name {
+				continue
+			}
+
+			if len(attribute.Values) > 0 {
+				return attribute.Values[0].Value
+			}
+		}
+	}
+
+	return ``
+}
@@ -0,0 +1,375 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/authlete/authlete-go-gin/endpoint"
+	"github.com/authlete/authlete-go/dto"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// SCIM 2.0 (RFC 7643, RFC 7644) endpoint to provision users. Requests must
+// carry an access token which has the scope for SCIM.
+type ScimEndpoint struct {
+	endpoint.BaseEndpoint
+
+	// Scope which access tokens must cover.
+	Scope string
+}
+
+func ScimEndpoint_New() *ScimEndpoint {
+	return &ScimEndpoint{Scope: getConfiguration(`SCIM_SCOPE`, `scim`)}
+}
+
+// Authenticate is a middleware which validates the access token by the
+// introspection API of Authlete.
+func (self *ScimEndpoint) Authenticate() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		api := self.GetAuthleteApi(ctx)
+		if api == nil {
+			ctx.Abort()
+			return
+		}
+
+		req := dto.IntrospectionRequest{
+			Token:  extractBearerToken(ctx),
+			Scopes: []string{self.Scope},
+		}
+
+		res, err := api.Introspection(&req)
+		if err != nil {
+			msg := fmt.Sprintf("scim_endpoint: Introspection failed: %s", err)
+			log.Warn().Msg(msg)
+			self.error(ctx, ScimError_New(500, ``, `Failed to validate the access token.`))
+			ctx.Abort()
+			return
+		}
+
+		status := 500
+
+		switch res.Action {
+		case dto.IntrospectionAction_OK:
+			msg := fmt.Sprintf("scim_endpoint: The request is made by the client '%d'.", res.ClientId)
+			log.Debug().Msg(msg)
+			ctx.Set(`scimClientId`, strconv.FormatUint(res.ClientId, 10))
+			ctx.Next()
+			return
+		case dto.IntrospectionAction_BAD_REQUEST:
+			status = 400
+		case dto.IntrospectionAction_UNAUTHORIZED:
+			status = 401
+		case dto.IntrospectionAction_FORBIDDEN:
+			status = 403
+		}
+
+		// The response content is the value for WWW-Authenticate.
+		ctx.Header(`WWW-Authenticate`, res.ResponseContent)
+		self.error(ctx, ScimError_New(status, ``, `The access token is not valid for this request.`))
+		ctx.Abort()
+	}
+}
+
+func extractBearerToken(ctx *gin.Context) string {
+	authorization := ctx.GetHeader(`Authorization`)
+
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], `Bearer `) {
+		return strings.TrimSpace(authorization[7:])
+	}
+
+	return ``
+}
+
+func (self *ScimEndpoint) location(ctx *gin.Context, subject string) string {
+	return getServerBaseUrlOf(ctx) + strings.TrimSuffix(ctx.FullPath(), `/:id`) + `/` + subject
+}
+
+func (self *ScimEndpoint) respond(ctx *gin.Context, status int, body interface{}) {
+	ctx.Header(`Content-Type`, `application/scim+json`)
+	ctx.JSON(status, body)
+}
+
+func (self *ScimEndpoint) error(ctx *gin.Context, err *ScimError) {
+	status, _ := strconv.Atoi(err.Status)
+	self.respond(ctx, status, err)
+}
+
+func (self *ScimEndpoint) storeError(ctx *gin.Context, err error) {
+	switch err {
+	case ErrLoginIdAlreadyUsed:
+		self.error(ctx, ScimError_New(409, `uniqueness`, `The userName is already used.`))
+	case ErrUserNotFound:
+		self.error(ctx, ScimError_New(404, ``, `The user does not exist.`))
+	case ErrUserStoreReadOnly:
+		self.error(ctx, ScimError_New(501, ``, `The user store does not accept changes.`))
+	default:
+		self.error(ctx, ScimError_New(500, ``, err.Error()))
+	}
+}
+
+// GET /Users
+func (self *ScimEndpoint) List() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		matches, err := scimFilter_Parse(ctx.Query(`filter`))
+		if err != nil {
+			self.error(ctx, err)
+			return
+		}
+
+		// 1-based index and page size (RFC 7644, 3.4.2.4)
+		startIndex, _ := strconv.Atoi(ctx.DefaultQuery(`startIndex`, `1`))
+		if startIndex < 1 {
+			startIndex = 1
+		}
+
+		count, err2 := strconv.Atoi(ctx.DefaultQuery(`count`, `100`))
+		if err2 != nil || count < 0 {
+			count = 100
+		}
+
+		resources := []ScimUser{}
+		for _, user := range UserStore_Of(ctx).List() {
+			resource := ScimUser_New(&user, self.location(ctx, user.Subject))
+			if matches(resource) {
+				resources = append(resources, *resource)
+			}
+		}
+
+		total := len(resources)
+
+		// The page
+		from := startIndex - 1
+		if from > total {
+			from = total
+		}
+		to := from + count
+		if to > total {
+			to = total
+		}
+
+		self.respond(ctx, 200, ScimListResponse{
+			Schemas:      []string{ScimSchema_LIST_RESPONSE},
+			TotalResults: total,
+			StartIndex:   startIndex,
+			ItemsPerPage: to - from,
+			Resources:    resources[from:to],
+		})
+	}
+}
+
+// GET /Users/:id
+func (self *ScimEndpoint) Get() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		user := UserStore_Of(ctx).GetBySubject(ctx.Param(`id`))
+		if user == nil {
+			self.error(ctx, ScimError_New(404, ``, `The user does not exist.`))
+			return
+		}
+
+		self.respond(ctx, 200, ScimUser_New(user, self.location(ctx, user.Subject)))
+	}
+}
+
+// POST /Users
+func (self *ScimEndpoint) Create() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		resource := ScimUser{}
+		if ctx.ShouldBindJSON(&resource) != nil || resource.UserName == `` {
+			self.error(ctx, ScimError_New(400, `invalidValue`, `The request body is not a valid User.`))
+			return
+		}
+
+		user := resource.ToUserEntity(``)
+		if err := UserStore_Of(ctx).Create(user); err != nil {
+			self.storeError(ctx, err)
+			return
+		}
+
+		msg := fmt.Sprintf("scim_endpoint: A user was provisioned. The subject is '%s'.", user.Subject)
+		log.Debug().Msg(msg)
+		self.audit(ctx, AuditEvent_USER_CREATED, user)
+
+		location := self.location(ctx, user.Subject)
+		ctx.Header(`Location`, location)
+		self.respond(ctx, 201, ScimUser_New(user, location))
+	}
+}
+
+// PUT /Users/:id
+func (self *ScimEndpoint) Replace() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		resource := ScimUser{}
+		if ctx.ShouldBindJSON(&resource) != nil || resource.UserName == `` {
+			self.error(ctx, ScimError_New(400, `invalidValue`, `The request body is not a valid User.`))
+			return
+		}
+
+		self.update(ctx, resource.ToUserEntity(ctx.Param(`id`)))
+	}
+}
+
+// PATCH /Users/:id
+func (self *ScimEndpoint) Patch() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		subject := ctx.Param(`id`)
+
+		request := ScimPatchRequest{}
+		if ctx.ShouldBindJSON(&request) != nil {
+			self.error(ctx, ScimError_New(400, `invalidSyntax`, `The request body is not a valid PatchOp.`))
+			return
+		}
+
+		user := UserStore_Of(ctx).GetBySubject(subject)
+		if user == nil {
+			self.error(ctx, ScimError_New(404, ``, `The user does not exist.`))
+			return
+		}
+
+		// Apply the operations to the current resource.
+		resource := ScimUser_New(user, ``)
+		if err := resource.ApplyPatch(request.Operations); err != nil {
+			self.error(ctx, err.(*ScimError))
+			return
+		}
+
+		if resource.UserName == `` {
+			self.error(ctx, ScimError_New(400, `invalidValue`, `The userName is required.`))
+			return
+		}
+
+		self.update(ctx, resource.ToUserEntity(subject))
+	}
+}
+
+func (self *ScimEndpoint) update(ctx *gin.Context, user *UserEntity) {
+	store := UserStore_Of(ctx)
+
+	if err := store.Update(user); err != nil {
+		self.storeError(ctx, err)
+		return
+	}
+
+	msg := fmt.Sprintf("scim_endpoint: A user was updated. The subject is '%s'.", user.Subject)
+	log.Debug().Msg(msg)
+	self.audit(ctx, AuditEvent_USER_UPDATED, user)
+
+	updated := store.GetBySubject(user.Subject)
+	self.respond(ctx, 200, ScimUser_New(updated, self.location(ctx, user.Subject)))
+}
+
+// DELETE /Users/:id
+func (self *ScimEndpoint) Delete() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		subject := ctx.Param(`id`)
+
+		if UserStore_Of(ctx).Delete(subject) == false {
+			self.error(ctx, ScimError_New(404, ``, `The user does not exist.`))
+			return
+		}
+
+		msg := fmt.Sprintf("scim_endpoint: A user was deprovisioned. The subject is '%s'.", subject)
+		log.Debug().Msg(msg)
+		self.audit(ctx, AuditEvent_USER_DELETED, &UserEntity{Subject: subject})
+
+		ctx.Status(204)
+	}
+}
+
+// audit records an administrative action. The actor is the client which
+// made the request.
+func (self *ScimEndpoint) audit(ctx *gin.Context, event string, user *UserEntity) {
+	AuditLog_Get().Record(ctx, &AuditEvent{
+		Event:   event,
+		Actor:   ctx.GetString(`scimClientId`),
+		Subject: user.Subject,
+		LoginId: user.LoginId,
+	})
+}
+
+// Filters of the form `attribute op "value"` where op is "eq", "co" or "sw"
+// (RFC 7644, 3.4.2.2). Other filters are rejected.
+var scimFilterPattern = regexp.MustCompile(`(?i)^\s*([A-Za-z.]+)\s+(eq|co|sw)\s+"((?:[^"\\]|\\.)*)"\s*$`)
+
+func scimFilter_Parse(filter string) (func(*ScimUser) bool, *ScimError) {
+	if filter == `` {
+		return func(*ScimUser) bool { return true }, nil
+	}
+
+	groups := scimFilterPattern.FindStringSubmatch(filter)
+	if groups == nil {
+		return nil, ScimError_New(400, `invalidFilter`, `The filter is not supported.`)
+	}
+
+	attribute := strings.ToLower(groups[1])
+	operator := strings.ToLower(groups[2])
+	value := strings.ReplaceAll(groups[3], `\"`, `"`)
+
+	// Values of the attribute in the resource
+	values := func(resource *ScimUser) []string {
+		switch attribute {
+		case `id`:
+			return []string{resource.Id}
+		case `username`:
+			return []string{resource.UserName}
+		case `externalid`:
+			return []string{resource.ExternalId}
+		case `emails`, `emails.value`:
+			list := []string{}
+			for _, email := range resource.Emails {
+				list = append(list, email.Value)
+			}
+			return list
+		default:
+			return nil
+		}
+	}
+
+	if values(&ScimUser{}) == nil {
+		return nil, ScimError_New(400, `invalidFilter`, fmt.Sprintf("Filtering by '%s' is not supported.", groups[1]))
+	}
+
+	return func(resource *ScimUser) bool {
+		for _, v := range values(resource) {
+			// String comparisons are case-insensitive except for "id".
+			a, b := strings.ToLower(v), strings.ToLower(value)
+			if attribute == `id` {
+				a, b = v, value
+			}
+
+			switch operator {
+			case `eq`:
+				if a == b {
+					return true
+				}
+			case `co`:
+				if strings.Contains(a, b) {
+					return true
+				}
+			case `sw`:
+				if strings.HasPrefix(a, b) {
+					return true
+				}
+			}
+		}
+		return false
+	}, nil
+}
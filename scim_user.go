@@ -0,0 +1,353 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/authlete/authlete-go/dto"
+)
+
+const (
+	ScimSchema_USER          = `urn:ietf:params:scim:schemas:core:2.0:User`
+	ScimSchema_LIST_RESPONSE = `urn:ietf:params:scim:api:messages:2.0:ListResponse`
+	ScimSchema_PATCH_OP      = `urn:ietf:params:scim:api:messages:2.0:PatchOp`
+	ScimSchema_ERROR         = `urn:ietf:params:scim:api:messages:2.0:Error`
+)
+
+// ScimUser is the User resource of RFC 7643, limited to the attributes
+// which UserEntity has.
+type ScimUser struct {
+	Schemas      []string         `json:"schemas"`
+	Id           string           `json:"id,omitempty"`
+	ExternalId   string           `json:"externalId,omitempty"`
+	UserName     string           `json:"userName"`
+	Name         *ScimName        `json:"name,omitempty"`
+	NickName     string           `json:"nickName,omitempty"`
+	ProfileUrl   string           `json:"profileUrl,omitempty"`
+	Locale       string           `json:"locale,omitempty"`
+	Timezone     string           `json:"timezone,omitempty"`
+	Photos       []ScimMultiValue `json:"photos,omitempty"`
+	Emails       []ScimMultiValue `json:"emails,omitempty"`
+	PhoneNumbers []ScimMultiValue `json:"phoneNumbers,omitempty"`
+	Addresses    []ScimAddress    `json:"addresses,omitempty"`
+	Active       *bool            `json:"active,omitempty"`
+	Password     string           `json:"password,omitempty"`
+	Meta         *ScimMeta        `json:"meta,omitempty"`
+}
+
+type ScimName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	MiddleName string `json:"middleName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type ScimMultiValue struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type ScimAddress struct {
+	StreetAddress string `json:"streetAddress,omitempty"`
+	Locality      string `json:"locality,omitempty"`
+	Region        string `json:"region,omitempty"`
+	PostalCode    string `json:"postalCode,omitempty"`
+	Country       string `json:"country,omitempty"`
+	Primary       bool   `json:"primary,omitempty"`
+}
+
+type ScimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+type ScimListResponse struct {
+	Schemas      []string   `json:"schemas"`
+	TotalResults int        `json:"totalResults"`
+	StartIndex   int        `json:"startIndex"`
+	ItemsPerPage int        `json:"itemsPerPage"`
+	Resources    []ScimUser `json:"Resources"`
+}
+
+type ScimPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []ScimPatchOperation `json:"Operations"`
+}
+
+type ScimPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// ScimError is the error response of RFC 7644, 3.12.
+type ScimError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+func ScimError_New(status int, scimType string, detail string) *ScimError {
+	return &ScimError{
+		Schemas:  []string{ScimSchema_ERROR},
+		Status:   fmt.Sprintf("%d", status),
+		ScimType: scimType,
+		Detail:   detail,
+	}
+}
+
+func (self *ScimError) Error() string {
+	return self.Detail
+}
+
+func ScimUser_New(user *UserEntity, location string) *ScimUser {
+	active := user.Disabled == false
+
+	resource := ScimUser{
+		Schemas:    []string{ScimSchema_USER},
+		Id:         user.Subject,
+		ExternalId: user.ExternalId,
+		UserName:   user.LoginId,
+		NickName:   user.Nickname,
+		ProfileUrl: user.Profile,
+		Locale:     user.Locale,
+		Timezone:   user.Zoneinfo,
+		Active:     &active,
+		Meta:       &ScimMeta{ResourceType: `User`, Location: location},
+	}
+
+	if user.UpdatedAt != 0 {
+		resource.Meta.LastModified = time.Unix(user.UpdatedAt, 0).UTC().Format(time.RFC3339)
+	}
+
+	if user.GivenName != `` || user.MiddleName != `` || user.FamilyName != `` {
+		resource.Name = &ScimName{
+			Formatted:  strings.TrimSpace(user.GivenName + ` ` + user.FamilyName),
+			GivenName:  user.GivenName,
+			MiddleName: user.MiddleName,
+			FamilyName: user.FamilyName,
+		}
+	}
+
+	if user.Picture != `` {
+		resource.Photos = []ScimMultiValue{{Value: user.Picture, Type: `photo`, Primary: true}}
+	}
+
+	if user.Email != `` {
+		resource.Emails = []ScimMultiValue{{Value: user.Email, Type: `work`, Primary: true}}
+	}
+
+	if user.PhoneNumber != `` {
+		resource.PhoneNumbers = []ScimMultiValue{{Value: user.PhoneNumber, Type: `work`, Primary: true}}
+	}
+
+	if user.Address != (dto.Address{}) {
+		resource.Addresses = []ScimAddress{{
+			StreetAddress: user.Address.StreetAddress,
+			Locality:      user.Address.Locality,
+			Region:        user.Address.Region,
+			PostalCode:    user.Address.PostalCode,
+			Country:       user.Address.Country,
+			Primary:       true,
+		}}
+	}
+
+	return &resource
+}
+
+// ToUserEntity converts the resource into a user. The password is empty
+// unless the resource contains one.
+func (self *ScimUser) ToUserEntity(subject string) *UserEntity {
+	user := UserEntity{
+		Subject:    subject,
+		LoginId:    self.UserName,
+		Password:   self.Password,
+		ExternalId: self.ExternalId,
+		Nickname:   self.NickName,
+		Profile:    self.ProfileUrl,
+		Locale:     self.Locale,
+		Zoneinfo:   self.Timezone,
+		Picture:    primaryValue(self.Photos),
+		Disabled:   self.Active != nil && *self.Active == false,
+	}
+
+	if self.Name != nil {
+		user.GivenName = self.Name.GivenName
+		user.MiddleName = self.Name.MiddleName
+		user.FamilyName = self.Name.FamilyName
+	}
+
+	// Email addresses provisioned by the client are trusted.
+	user.Email = primaryValue(self.Emails)
+	user.EmailVerified = user.Email != ``
+	user.PhoneNumber = primaryValue(self.PhoneNumbers)
+
+	for i, address := range self.Addresses {
+		if i == 0 || address.Primary {
+			user.Address = dto.Address{
+				StreetAddress: address.StreetAddress,
+				Locality:      address.Locality,
+				Region:        address.Region,
+				PostalCode:    address.PostalCode,
+				Country:       address.Country,
+			}
+		}
+	}
+
+	return &user
+}
+
+func primaryValue(values []ScimMultiValue) string {
+	value := ``
+
+	for i, v := range values {
+		if i == 0 || v.Primary {
+			value = v.Value
+		}
+	}
+
+	return value
+}
+
+// Filter with a value selection, e.g. `emails[type eq "work"].value`.
+var scimValuePathPattern = regexp.MustCompile(`\[[^\]]*\]`)
+
+// ApplyPatch applies the operations of RFC 7644, 3.5.2 to the resource.
+func (self *ScimUser) ApplyPatch(operations []ScimPatchOperation) error {
+	for _, operation := range operations {
+		// Value filters are ignored because each multi-valued attribute
+		// has only one value here.
+		path := scimValuePathPattern.ReplaceAllString(operation.Path, ``)
+		path = strings.TrimPrefix(path, ScimSchema_USER+`:`)
+
+		switch strings.ToLower(operation.Op) {
+		case `add`, `replace`:
+			if err := self.set(path, operation.Value); err != nil {
+				return err
+			}
+		case `remove`:
+			if err := self.remove(path); err != nil {
+				return err
+			}
+		default:
+			return ScimError_New(400, `invalidSyntax`, fmt.Sprintf("Unknown operation '%s'.", operation.Op))
+		}
+	}
+
+	return nil
+}
+
+func (self *ScimUser) set(path string, value json.RawMessage) error {
+	// Without a path, the value is a partial resource.
+	document := []byte(value)
+
+	if path != `` {
+		// Build a partial resource from the path, e.g. `name.givenName`
+		// becomes {"name":{"givenName":value}}.
+		names := strings.Split(path, `.`)
+		for i := len(names) - 1; i >= 0; i-- {
+			document = []byte(fmt.Sprintf(`{%q:%s}`, scimAttributeName(names[i]), document))
+		}
+
+		// A single value for a multi-valued attribute, e.g. "emails.value".
+		document = wrapMultiValue(names, document)
+	}
+
+	if err := json.Unmarshal(document, self); err != nil {
+		return ScimError_New(400, `invalidValue`, fmt.Sprintf("The value for '%s' is invalid.", path))
+	}
+
+	return nil
+}
+
+// wrapMultiValue converts {"emails":{"value":"x"}} into
+// {"emails":[{"value":"x","primary":true}]}.
+func wrapMultiValue(names []string, document []byte) []byte {
+	switch scimAttributeName(names[0]) {
+	case `emails`, `phoneNumbers`, `addresses`, `photos`:
+	default:
+		return document
+	}
+
+	if len(names) < 2 {
+		return document
+	}
+
+	partial := map[string]map[string]interface{}{}
+	if json.Unmarshal(document, &partial) != nil {
+		return document
+	}
+
+	key := scimAttributeName(names[0])
+	value := partial[key]
+	value[`primary`] = true
+
+	bytes, _ := json.Marshal(map[string]interface{}{key: []interface{}{value}})
+
+	return bytes
+}
+
+func (self *ScimUser) remove(path string) error {
+	switch scimAttributeName(strings.Split(path, `.`)[0]) {
+	case `externalId`:
+		self.ExternalId = ``
+	case `name`:
+		self.Name = nil
+	case `emails`:
+		self.Emails = nil
+	case `phoneNumbers`:
+		self.PhoneNumbers = nil
+	case `photos`:
+		self.Photos = nil
+	case `nickName`:
+		self.NickName = ``
+	case `profileUrl`:
+		self.ProfileUrl = ``
+	case `locale`:
+		self.Locale = ``
+	case `timezone`:
+		self.Timezone = ``
+	case `addresses`:
+		self.Addresses = nil
+	default:
+		return ScimError_New(400, `noTarget`, fmt.Sprintf("'%s' cannot be removed.", path))
+	}
+
+	return nil
+}
+
+// Attribute names are case-insensitive (RFC 7643, 2.1).
+func scimAttributeName(name string) string {
+	for _, known := range []string{`id`, `externalId`, `userName`, `name`, `givenName`, `middleName`,
+		`familyName`, `nickName`, `profileUrl`, `locale`, `timezone`, `photos`,
+		`emails`, `phoneNumbers`, `addresses`, `active`, `password`, `value`, `type`, `primary`,
+		`streetAddress`, `locality`, `region`, `postalCode`, `country`} {
+		if strings.EqualFold(name, known) {
+			return known
+		}
+	}
+
+	return name
+}
@@ -0,0 +1,293 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gin-gonic/gin"
+)
+
+// TenantConfiguration is the content of the file named by TENANTS_CONFIG.
+type TenantConfiguration struct {
+	Tenants []TenantEntry `toml:"tenant"`
+}
+
+type TenantEntry struct {
+	Name string `toml:"name"`
+
+	// Host names and/or a path prefix, e.g. "/brand-a", which route
+	// requests to the tenant.
+	Hosts      []string `toml:"hosts"`
+	PathPrefix string   `toml:"path_prefix"`
+
+	// TOML file of the credentials of the Authlete service.
+	Authlete string `toml:"authlete"`
+
+	// "default" (the user store of the server), "memory" or "ldap".
+	UserStore  string `toml:"user_store"`
+	LdapConfig string `toml:"ldap_config"`
+
+	// Directory of templates which replace the default ones of the same
+	// names.
+	Templates string `toml:"templates"`
+
+	// Name of the session cookie. Default: "<Name>Session"
+	SessionCookie string `toml:"session_cookie"`
+
+	// Base URL of links sent by mail. Default: SERVER_BASE_URL
+	BaseUrl string `toml:"base_url"`
+
+	// Relying party of passkeys. Default: the first of 'hosts' and the
+	// origin of 'base_url', or WEBAUTHN_RP_ID and WEBAUTHN_RP_ORIGINS
+	WebAuthnRpId      string   `toml:"webauthn_rp_id"`
+	WebAuthnRpOrigins []string `toml:"webauthn_rp_origins"`
+}
+
+// Tenant is one of the Authlete services hosted by this server.
+type Tenant struct {
+	Name          string
+	Hosts         []string
+	PathPrefix    string
+	Authlete      string
+	Templates     string
+	SessionCookie string
+	BaseUrl       string
+	UserStore     UserStore
+
+	// Passkeys of the users of the tenant. Subjects are unique only within
+	// a tenant, so they are not shared with other tenants.
+	Credentials *CredentialDatabase
+
+	WebAuthnRpId      string
+	WebAuthnRpOrigins []string
+}
+
+func TenantConfiguration_Load(file string) *TenantConfiguration {
+	config := TenantConfiguration{}
+
+	if _, err := toml.DecodeFile(file, &config); err != nil {
+		panic(fmt.Sprintf("tenant: Failed to load %s: %s", file, err))
+	}
+
+	return &config
+}
+
+func Tenant_New(entry *TenantEntry) *Tenant {
+	if entry.Name == `` || entry.Authlete == `` {
+		panic("tenant: A tenant needs 'name' and 'authlete'.")
+	}
+
+	if len(entry.Hosts) == 0 && entry.PathPrefix == `` {
+		panic(fmt.Sprintf("tenant: The tenant '%s' needs 'hosts' or 'path_prefix'.", entry.Name))
+	}
+
+	tenant := Tenant{}
+	tenant.Name = entry.Name
+	tenant.Hosts = entry.Hosts
+	tenant.Authlete = entry.Authlete
+	tenant.Templates = entry.Templates
+	tenant.SessionCookie = entry.SessionCookie
+	tenant.BaseUrl = strings.TrimSuffix(entry.BaseUrl, `/`)
+
+	if entry.PathPrefix != `` {
+		tenant.PathPrefix = `/` + strings.Trim(entry.PathPrefix, `/`)
+	}
+
+	if tenant.SessionCookie == `` {
+		tenant.SessionCookie = entry.Name + `Session`
+	}
+
+	tenant.WebAuthnRpId = entry.WebAuthnRpId
+	tenant.WebAuthnRpOrigins = entry.WebAuthnRpOrigins
+
+	if tenant.WebAuthnRpId == `` && len(tenant.Hosts) != 0 {
+		tenant.WebAuthnRpId = tenant.Hosts[0]
+	}
+
+	if len(tenant.WebAuthnRpOrigins) == 0 && tenant.BaseUrl != `` {
+		if base, err := url.Parse(tenant.BaseUrl); err == nil {
+			tenant.WebAuthnRpOrigins = []string{base.Scheme + `://` + base.Host}
+		}
+	}
+
+	switch entry.UserStore {
+	case `memory`:
+		tenant.UserStore = &UserDatabase{}
+	case `ldap`:
+		tenant.UserStore = LdapUserStore_New(LdapConfiguration_Load(entry.LdapConfig))
+	}
+
+	return &tenant
+}
+
+// Tenant_Of returns the tenant which the request is made to, or nil when
+// the request is made to the default server.
+func Tenant_Of(ctx *gin.Context) *Tenant {
+	value, _ := ctx.Get(`tenant`)
+	tenant, _ := value.(*Tenant)
+
+	return tenant
+}
+
+// tenantNameOf returns the name of the tenant which the request is made to,
+// or "" when the request is made to the default server.
+func tenantNameOf(ctx *gin.Context) string {
+	if tenant := Tenant_Of(ctx); tenant != nil {
+		return tenant.Name
+	}
+
+	return ``
+}
+
+// Tenant_Handler returns middleware which tells the endpoints the tenant.
+func Tenant_Handler(tenant *Tenant) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Set(`tenant`, tenant)
+		ctx.Next()
+	}
+}
+
+// UserStore_Of returns the user store of the tenant which the request is
+// made to.
+func UserStore_Of(ctx *gin.Context) UserStore {
+	if tenant := Tenant_Of(ctx); tenant != nil && tenant.UserStore != nil {
+		return tenant.UserStore
+	}
+
+	return UserStore_Get()
+}
+
+// CredentialDatabase_Of returns the passkeys of the tenant which the
+// request is made to.
+func CredentialDatabase_Of(ctx *gin.Context) *CredentialDatabase {
+	if tenant := Tenant_Of(ctx); tenant != nil && tenant.Credentials != nil {
+		return tenant.Credentials
+	}
+
+	return CredentialDatabase_Get()
+}
+
+// LoginThrottle_Of returns the login throttle of the tenant which the
+// request is made to. Tenants share the store, but not the counters.
+func LoginThrottle_Of(ctx *gin.Context) *LoginThrottle {
+	if tenant := Tenant_Of(ctx); tenant != nil {
+		return LoginThrottle_Get().ForTenant(tenant.Name)
+	}
+
+	return LoginThrottle_Get()
+}
+
+// getServerBaseUrlOf returns the base URL of links of the tenant which the
+// request is made to. Unless the tenant has 'base_url', it is SERVER_BASE_URL
+// with the first host name of the tenant, followed by the path prefix.
+func getServerBaseUrlOf(ctx *gin.Context) string {
+	tenant := Tenant_Of(ctx)
+	if tenant == nil {
+		return getServerBaseUrl()
+	}
+
+	if tenant.BaseUrl != `` {
+		return tenant.BaseUrl
+	}
+
+	base := getServerBaseUrl()
+	if parsed, err := url.Parse(base); err == nil && len(tenant.Hosts) != 0 {
+		parsed.Host = tenant.Hosts[0]
+		base = parsed.String()
+	}
+
+	return base + tenant.PathPrefix
+}
+
+// TenantRouter dispatches requests to the servers of the tenants by the
+// host name or, if no host name matches, by the longest path prefix. The
+// path prefix is removed before the request is passed to the server of the
+// tenant. Other requests are passed to the default server.
+type TenantRouter struct {
+	Default  http.Handler
+	hosts    map[string]*AuthorizationServer
+	prefixes []*AuthorizationServer
+}
+
+func TenantRouter_New(server *AuthorizationServer) *TenantRouter {
+	router := TenantRouter{}
+	router.Default = server.Engine
+	router.hosts = map[string]*AuthorizationServer{}
+
+	return &router
+}
+
+func (self *TenantRouter) Add(server *AuthorizationServer) {
+	for _, host := range server.Tenant.Hosts {
+		self.hosts[strings.ToLower(host)] = server
+	}
+
+	if server.Tenant.PathPrefix != `` {
+		self.prefixes = append(self.prefixes, server)
+
+		// Longer prefixes first
+		sort.SliceStable(self.prefixes, func(i, j int) bool {
+			return len(self.prefixes[i].Tenant.PathPrefix) > len(self.prefixes[j].Tenant.PathPrefix)
+		})
+	}
+}
+
+func (self *TenantRouter) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	host := request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if server, ok := self.hosts[strings.ToLower(host)]; ok {
+		// Links in the pages of the tenant may carry the path prefix.
+		server.servePrefixed(writer, request)
+		return
+	}
+
+	for _, server := range self.prefixes {
+		if hasPathPrefix(request.URL.Path, server.Tenant.PathPrefix) {
+			server.servePrefixed(writer, request)
+			return
+		}
+	}
+
+	self.Default.ServeHTTP(writer, request)
+}
+
+func hasPathPrefix(path string, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+`/`)
+}
+
+// servePrefixed serves the request after removing the path prefix of the
+// tenant if the path has it.
+func (self *AuthorizationServer) servePrefixed(writer http.ResponseWriter, request *http.Request) {
+	prefix := self.Tenant.PathPrefix
+
+	if prefix == `` || hasPathPrefix(request.URL.Path, prefix) == false {
+		self.Engine.ServeHTTP(writer, request)
+		return
+	}
+
+	http.StripPrefix(prefix, self.Engine).ServeHTTP(writer, request)
+}
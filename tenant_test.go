@@ -0,0 +1,190 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTenants creates the default server and the servers of two tenants,
+// one of which is routed by a path prefix and the other by a host name.
+func testTenants(t *testing.T) (*testBrowser, *FakeAuthleteApi, *FakeAuthleteApi, *FakeAuthleteApi) {
+	fakes := []*FakeAuthleteApi{}
+	for i := 0; i < 3; i++ {
+		fake := FakeAuthleteApi_New()
+		fake.RedirectUri = testRedirectUri
+		fakes = append(fakes, fake)
+	}
+
+	// Users of the tenant routed by the path are kept apart.
+	users := &UserDatabase{Users: []UserEntity{{Subject: `2001`, LoginId: `alice`, Password: `alice`, GivenName: `Alice`}}}
+
+	server := AuthorizationServer_NewWithApi(fakes[0])
+	server.AddTenant(AuthorizationServer_NewForTenant(&Tenant{
+		Name: `path`, PathPrefix: `/path`, SessionCookie: `PathSession`, UserStore: users,
+	}, AuthleteApi_Instance(fakes[1])))
+	server.AddTenant(AuthorizationServer_NewForTenant(&Tenant{
+		Name: `host`, Hosts: []string{`host.example.com`}, SessionCookie: `HostSession`,
+	}, AuthleteApi_Instance(fakes[2])))
+
+	browser := testBrowser_NewWithHandler(t, server.Handler())
+
+	return browser, fakes[0], fakes[1], fakes[2]
+}
+
+func TestTenantByPathPrefix(t *testing.T) {
+	browser, fake, tenant, _ := testTenants(t)
+	browser.fake = tenant
+
+	res := browser.get(`/path/api/authorization`, testAuthorizationParams(nil))
+	if res.Status != 200 {
+		t.Fatalf("The authorization endpoint of the tenant returned %d: %s", res.Status, res.Body)
+	}
+
+	// Links in the page carry the path prefix.
+	form := parseTestForm(t, res.Body, `authorization-form`)
+	if form.Action != `/path/api/authorization/decision` {
+		t.Fatalf("The form is posted to '%s'.", form.Action)
+	}
+
+	// Users of the default user store do not exist in the tenant.
+	res = browser.submit(form, testDecision(`john`, `john`, true))
+	expectError(t, res, `login_required`)
+
+	res = browser.get(`/path/api/authorization`, testAuthorizationParams(nil))
+	form = parseTestForm(t, res.Body, `authorization-form`)
+	expectCode(t, browser.submit(form, testDecision(`alice`, `alice`, true)))
+
+	if browser.issuedSubject() != `2001` {
+		t.Errorf("The authorization was issued for '%s' instead of '2001'.", browser.issuedSubject())
+	}
+
+	if len(fake.Calls()) != 0 {
+		t.Errorf("The Authlete service of the default server was called: %v", fake.Calls())
+	}
+}
+
+func TestTenantByHost(t *testing.T) {
+	browser, fake, _, tenant := testTenants(t)
+
+	request, _ := http.NewRequest(`GET`, browser.server.URL+`/api/authorization?`+testAuthorizationParams(nil).Encode(), nil)
+	request.Host = `host.example.com`
+
+	res := browser.do(request)
+	if res.Status != 200 || len(tenant.Calls()) != 1 || len(fake.Calls()) != 0 {
+		t.Fatalf("The request was not routed to the tenant: %d %v", res.Status, tenant.Calls())
+	}
+
+	if cookie := res.Header.Get(`Set-Cookie`); strings.HasPrefix(cookie, `HostSession=`) == false {
+		t.Errorf("The session cookie of the tenant is not used: %s", cookie)
+	}
+
+	// Other requests are served by the default server.
+	browser.authorize(nil)
+	if len(fake.Calls()) != 1 {
+		t.Errorf("The request was not routed to the default server: %v", fake.Calls())
+	}
+}
+
+func TestTenantRefusesTokensOfOtherTenants(t *testing.T) {
+	sender := testMailSender_Install(t)
+
+	// Mallory has the same subject in the default server as Alice in the
+	// tenant.
+	testUserStore_Install(t, UserEntity{Subject: `2001`, LoginId: `mallory`, Password: `mallory`, Email: `mallory@example.com`})
+
+	browser, _, tenant, _ := testTenants(t)
+	browser.fake = tenant
+
+	browser.post(`/password/forgot`, url.Values{`email`: {`mallory@example.com`}})
+	token := sender.link(t).Get(`token`)
+
+	// The link of the default server must not reset the password of Alice.
+	if res := browser.get(`/path/password/reset`, url.Values{`token`: {token}}); res.Status != 400 {
+		t.Errorf("The tenant showed the form for the token of another tenant: %d", res.Status)
+	}
+
+	res := browser.post(`/path/password/reset`, url.Values{`token`: {token}, `password`: {`mallory-chose-this`}})
+	if res.Status != 400 {
+		t.Fatalf("The tenant accepted the token of another tenant: %d %s", res.Status, res.Body)
+	}
+
+	res = browser.get(`/path/api/authorization`, testAuthorizationParams(nil))
+	form := parseTestForm(t, res.Body, `authorization-form`)
+	expectCode(t, browser.submit(form, testDecision(`alice`, `alice`, true)))
+
+	// The token is still valid where it was issued.
+	if _, err := LinkTokenIssuer_Get().Verify(token, ``, linkPurposePasswordReset); err != nil {
+		t.Errorf("The token is not valid in the default server: %s", err)
+	}
+}
+
+func TestTenantKeepsCredentialsAndThrottlesApart(t *testing.T) {
+	server := AuthorizationServer_NewForTenant(&Tenant{Name: `path`, PathPrefix: `/path`},
+		AuthleteApi_Instance(FakeAuthleteApi_New()))
+
+	// Passkeys registered in a tenant are not those of the default server.
+	if server.Tenant.Credentials == nil || server.Tenant.Credentials == CredentialDatabase_Get() {
+		t.Fatalf("The tenant shares the passkeys of the default server")
+	}
+
+	// Failures in a tenant do not lock the same login ID elsewhere.
+	throttle := LoginThrottle_New(MemoryThrottleStore_New())
+	throttle.LockDuration = time.Hour
+	scoped := throttle.ForTenant(`path`)
+	for i := 0; i < throttle.AccountLockThreshold; i++ {
+		scoped.Store.Acquire(scoped.accountKey(`john`), time.Now(), time.Hour,
+			func(ThrottleRecord) time.Duration { return 0 })
+	}
+
+	if scoped.Attempt(`john`, ``) == 0 {
+		t.Fatalf("The account was not locked in the tenant")
+	}
+
+	if wait := throttle.Attempt(`john`, ``); wait > 0 {
+		t.Errorf("The account of the default server was locked for %s", wait)
+	}
+}
+
+func TestTenantRecordsLockouts(t *testing.T) {
+	browser, _, tenant, _ := testTenants(t)
+	browser.fake = tenant
+	buffer := testAuditEvents()
+
+	// The first failure locks the account.
+	loginThrottleInstance.AccountLockThreshold = 1
+
+	browser.post(`/path/api/token`, url.Values{`grant_type`: {`password`}, `username`: {`alice`}, `password`: {`wrong`}})
+
+	for _, event := range parseTestAuditEvents(t, buffer) {
+		if event.Event != AuditEvent_ACCOUNT_LOCKED {
+			continue
+		}
+
+		if event.Tenant != `path` || event.UserAgent == `` {
+			t.Errorf("The lockout was recorded without the request: %+v", event)
+		}
+
+		return
+	}
+
+	t.Errorf("No lockout was recorded: %s", buffer)
+}
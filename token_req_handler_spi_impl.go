@@ -17,19 +17,77 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/authlete/authlete-go-gin/handler/spi"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
 )
 
 type TokenReqHandlerSpiImpl struct {
 	spi.TokenReqHandlerSpiAdapter
+	Context  *gin.Context
+	ClientIp string
+}
+
+func TokenReqHandlerSpiImpl_New(ctx *gin.Context) *TokenReqHandlerSpiImpl {
+	impl := TokenReqHandlerSpiImpl{}
+	impl.Context = ctx
+	impl.ClientIp = ctx.ClientIP()
+
+	return &impl
 }
 
 func (self *TokenReqHandlerSpiImpl) AuthenticateUser(loginId string, password string) string {
-	user := UserDatabase_Get().GetByCredentials(loginId, password)
+	// Resource Owner Password Credentials flow is subject to the same
+	// limits as the login form.
+	throttle := LoginThrottle_Of(self.Context)
+	if throttle.Attempt(loginId, self.ClientIp) > 0 {
+		msg := fmt.Sprintf("token_req_handler_spi_impl: User authentication was throttled. The presented login ID is '%s'.", loginId)
+		log.Debug().Msg(msg)
+		Metrics_Get().LoginAttempted(Amr_PWD, LoginResult_THROTTLED)
+		auditLoginFailure(self.Context, nil, Amr_PWD, loginId, LoginResult_THROTTLED, ``)
+		return ``
+	}
+
+	user := UserStore_Of(self.Context).GetByCredentials(loginId, password)
 
 	if user == nil {
+		throttle.Failed(self.Context, loginId, self.ClientIp)
+		Metrics_Get().LoginAttempted(Amr_PWD, LoginResult_FAILURE)
+		auditLoginFailure(self.Context, nil, Amr_PWD, loginId, LoginResult_FAILURE, `invalid_credentials`)
 		return ``
 	}
 
+	// The user has to verify the email address before logging in.
+	if isEmailVerificationPending(user) {
+		throttle.Released(loginId, self.ClientIp)
+		Metrics_Get().LoginAttempted(Amr_PWD, LoginResult_FAILURE)
+		auditLoginFailure(self.Context, nil, Amr_PWD, loginId, LoginResult_FAILURE, `email_not_verified`)
+		return ``
+	}
+
+	// The flow cannot ask for the second factor, so users who have
+	// enrolled one have to log in through the authorization endpoint.
+	if user.IsTotpEnabled() {
+		msg := fmt.Sprintf("token_req_handler_spi_impl: A second factor is required. The presented login ID is '%s'.", loginId)
+		log.Debug().Msg(msg)
+		throttle.Released(loginId, self.ClientIp)
+		Metrics_Get().LoginAttempted(Amr_PWD, LoginResult_FAILURE)
+		auditLoginFailure(self.Context, nil, Amr_PWD, loginId, LoginResult_FAILURE, `second_factor_required`)
+		return ``
+	}
+
+	throttle.Succeeded(loginId, self.ClientIp)
+	Metrics_Get().LoginAttempted(Amr_PWD, LoginResult_SUCCESS)
+
+	AuditLog_Get().Record(self.Context, &AuditEvent{
+		Event:   AuditEvent_LOGIN,
+		Result:  LoginResult_SUCCESS,
+		Method:  Amr_PWD,
+		Subject: user.Subject,
+		LoginId: user.LoginId,
+	})
+
 	return user.Subject
 }
@@ -0,0 +1,138 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+// Time-Based One-Time Password Algorithm (RFC 6238)
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	// Time step in seconds (RFC 6238, 4.1. X)
+	totpPeriod = 30
+
+	// Number of digits of a code.
+	totpDigits = 6
+
+	// Number of time steps before and after the current one which are
+	// accepted to allow for clock drift (RFC 6238, 5.2).
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func Totp_GenerateSecret() string {
+	// RFC 4226 recommends a shared secret of 160 bits.
+	key := make([]byte, 20)
+	rand.Read(key)
+
+	return totpEncoding.EncodeToString(key)
+}
+
+func Totp_Verify(secret string, code string, t time.Time) (step uint64, ok bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+
+	code = strings.TrimSpace(code)
+	current := uint64(t.Unix()) / totpPeriod
+
+	for i := -totpSkew; i <= totpSkew; i++ {
+		candidate := uint64(int64(current) + int64(i))
+		expected := totpCode(key, candidate)
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return candidate, true
+		}
+	}
+
+	return 0, false
+}
+
+func totpCode(key []byte, step uint64) string {
+	// HOTP(K, T) (RFC 4226, 5.3)
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, step)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo)
+}
+
+func Totp_KeyUri(issuer string, account string, secret string) string {
+	// Key URI format understood by authenticator applications.
+	// https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+	label := url.PathEscape(issuer) + `:` + url.PathEscape(account)
+
+	params := url.Values{}
+	params.Set(`secret`, secret)
+	params.Set(`issuer`, issuer)
+	params.Set(`digits`, fmt.Sprint(totpDigits))
+	params.Set(`period`, fmt.Sprint(totpPeriod))
+
+	return `otpauth://totp/` + label + `?` + params.Encode()
+}
+
+func Totp_QrCode(uri string) (string, error) {
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return ``, err
+	}
+
+	// Data URI which can be used as 'src' of an <img> element.
+	return `data:image/png;base64,` + base64.StdEncoding.EncodeToString(png), nil
+}
+
+func RecoveryCodes_Generate(count int) []string {
+	codes := make([]string, count)
+
+	for i := range codes {
+		bytes := make([]byte, 5)
+		rand.Read(bytes)
+
+		// e.g. "K4ZT-QMNX"
+		code := totpEncoding.EncodeToString(bytes)
+		codes[i] = code[:4] + `-` + code[4:]
+	}
+
+	return codes
+}
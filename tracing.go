@@ -0,0 +1,151 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/authlete/authlete-go/api"
+	"github.com/authlete/authlete-go/dto"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = `gin-oauth-server`
+
+var (
+	tracerProviderInstance *sdktrace.TracerProvider
+)
+
+func init() {
+	// W3C Trace Context and Baggage are propagated whether spans are
+	// exported or not.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	// Spans are not exported by default. Set OTEL_TRACES_EXPORTER to "otlp"
+	// to send them to OTEL_EXPORTER_OTLP_ENDPOINT (http://localhost:4318 by
+	// default) or to "stdout" to write them to the standard output.
+	exporter, err := newSpanExporter(getConfiguration(`OTEL_TRACES_EXPORTER`, `none`))
+	if err != nil {
+		msg := fmt.Sprintf("tracing: Failed to create a span exporter: %s", err)
+		log.Warn().Msg(msg)
+		return
+	}
+
+	if exporter == nil {
+		return
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults.
+	res, _ := resource.New(context.Background(),
+		resource.WithAttributes(semconv.ServiceName(`gin-oauth-server`)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv())
+
+	tracerProviderInstance = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res))
+
+	otel.SetTracerProvider(tracerProviderInstance)
+}
+
+func newSpanExporter(name string) (sdktrace.SpanExporter, error) {
+	switch name {
+	case `otlp`:
+		return otlptracehttp.New(context.Background())
+	case `stdout`:
+		return stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case `none`:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown exporter '%s'", name)
+	}
+}
+
+// Tracing_Shutdown exports the spans which have not been exported yet.
+func Tracing_Shutdown(ctx context.Context) error {
+	if tracerProviderInstance == nil {
+		return nil
+	}
+
+	return tracerProviderInstance.Shutdown(ctx)
+}
+
+// AuthleteApi_Tracing returns the decorator which wraps the calls of
+// Authlete APIs in spans. The spans are children of the span of the request
+// to this server.
+func AuthleteApi_Tracing() AuthleteApiDecorator {
+	return func(ctx *gin.Context) AuthleteApiHook {
+		return (&tracingApi{context: ctx.Request.Context()}).hook
+	}
+}
+
+// tracingApi traces the calls of the APIs which this server uses.
+type tracingApi struct {
+	context context.Context
+}
+
+func (self *tracingApi) hook(call *AuthleteApiCall, next func() (interface{}, *api.AuthleteError)) (interface{}, *api.AuthleteError) {
+	span := self.start(call.Name)
+	if request, ok := call.Request.(*dto.AuthorizationFailRequest); ok {
+		span.SetAttributes(attribute.String(`authlete.reason`, string(request.Reason)))
+	}
+
+	response, err := next()
+	self.end(span, authleteApiAction(response), err)
+
+	return response, err
+}
+
+func (self *tracingApi) start(name string) trace.Span {
+	tracer := otel.Tracer(tracerName)
+
+	_, span := tracer.Start(self.context, `Authlete `+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String(`authlete.api`, name)))
+
+	return span
+}
+
+func (self *tracingApi) end(span trace.Span, action string, err *api.AuthleteError) {
+	if action != `` {
+		span.SetAttributes(attribute.String(`authlete.action`, action))
+	}
+
+	if err != nil {
+		span.SetAttributes(attribute.Int(`http.response.status_code`, err.StatusCode))
+		span.SetStatus(codes.Error, `Authlete API call failed with status `+strconv.Itoa(err.StatusCode))
+		if err.Cause != nil {
+			span.RecordError(err.Cause)
+		}
+	}
+
+	span.End()
+}
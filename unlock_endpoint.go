@@ -0,0 +1,120 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/authlete/authlete-go-gin/endpoint"
+	"github.com/authlete/authlete-go/dto"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// UnlockEndpoint lifts lockouts of accounts and IP addresses. Requests are
+// authorized by access tokens which cover the administrative scope.
+type UnlockEndpoint struct {
+	endpoint.BaseEndpoint
+
+	// Scope which access tokens must cover.
+	Scope string
+}
+
+func UnlockEndpoint_New() *UnlockEndpoint {
+	return &UnlockEndpoint{Scope: getConfiguration(`ADMIN_SCOPE`, `admin`)}
+}
+
+// Authenticate returns middleware which rejects requests whose access
+// tokens do not cover the administrative scope.
+func (self *UnlockEndpoint) Authenticate() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		api := self.GetAuthleteApi(ctx)
+		if api == nil {
+			ctx.Abort()
+			return
+		}
+
+		req := dto.IntrospectionRequest{
+			Token:  extractBearerToken(ctx),
+			Scopes: []string{self.Scope},
+		}
+
+		res, err := api.Introspection(&req)
+		if err != nil {
+			msg := fmt.Sprintf("unlock_endpoint: Introspection failed: %s", err)
+			log.Warn().Msg(msg)
+			ctx.AbortWithStatusJSON(500, gin.H{"error": "Failed to validate the access token."})
+			return
+		}
+
+		status := 500
+
+		switch res.Action {
+		case dto.IntrospectionAction_OK:
+			// The administrator, or the client if the token was issued
+			// by the client credentials flow.
+			admin := res.Subject
+			if admin == `` {
+				admin = `client:` + strconv.FormatUint(res.ClientId, 10)
+			}
+			ctx.Set(`admin`, admin)
+			ctx.Next()
+			return
+		case dto.IntrospectionAction_BAD_REQUEST:
+			status = 400
+		case dto.IntrospectionAction_UNAUTHORIZED:
+			status = 401
+		case dto.IntrospectionAction_FORBIDDEN:
+			status = 403
+		}
+
+		// The response content is the value for WWW-Authenticate.
+		ctx.Header(`WWW-Authenticate`, res.ResponseContent)
+		ctx.AbortWithStatusJSON(status, gin.H{"error": "The access token is not valid for this request."})
+	}
+}
+
+func (self *UnlockEndpoint) Unlock() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		// The account and/or the IP address to unlock.
+		loginId := ctx.PostForm(`loginId`)
+		ip := ctx.PostForm(`ip`)
+
+		if loginId == `` && ip == `` {
+			ctx.JSON(400, gin.H{"error": "Either 'loginId' or 'ip' is required."})
+			return
+		}
+
+		err := LoginThrottle_Of(ctx).Unlock(loginId, ip)
+		if err != nil {
+			msg := fmt.Sprintf("unlock_endpoint: Failed to unlock: %s", err)
+			log.Warn().Msg(msg)
+			ctx.JSON(500, gin.H{"error": "Failed to unlock."})
+			return
+		}
+
+		AuditLog_Get().Record(ctx, &AuditEvent{
+			Event:   AuditEvent_ACCOUNT_UNLOCKED,
+			Actor:   ctx.GetString(`admin`),
+			LoginId: loginId,
+			Details: map[string]string{`unlockedIp`: ip},
+		})
+
+		ctx.Status(204)
+	}
+}
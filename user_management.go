@@ -19,7 +19,15 @@ package main
 // NOTE: THIS IS A DUMMY IMPLEMENTATION JUST FOR DEMONSTRATION
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/authlete/authlete-go/dto"
 	"github.com/authlete/authlete-go/types"
@@ -27,34 +35,93 @@ import (
 
 var (
 	userDatabaseInstance *UserDatabase
+
+	ErrLoginIdAlreadyUsed = errors.New("the login ID is already used")
+	ErrUserNotFound       = errors.New("the user does not exist")
 )
 
 func init() {
 	db := UserDatabase{}
 	db.Users = []UserEntity{
 		UserEntity{
-			Subject:     `1001`,
-			LoginId:     `john`,
-			Password:    `john`,
-			GivenName:   `John`,
-			FamilyName:  `Smith`,
-			Email:       `john@example.com`,
-			PhoneNumber: `+1 (425) 555-1212`,
+			Subject:             `1001`,
+			LoginId:             `john`,
+			Password:            `john`,
+			GivenName:           `John`,
+			FamilyName:          `Smith`,
+			MiddleName:          `Edward`,
+			Nickname:            `Johnny`,
+			Gender:              `male`,
+			Birthdate:           `1974-05-06`,
+			Zoneinfo:            `America/Los_Angeles`,
+			Locale:              `en-US`,
+			Email:               `john@example.com`,
+			EmailVerified:       true,
+			PhoneNumber:         `+1 (425) 555-1212`,
+			PhoneNumberVerified: true,
 			Address: dto.Address{
 				Country: `USA`,
 			},
+			LocalizedClaims: LocalizedClaims{
+				types.CLAIM_NAME:        {`ja-Kana-JP`: `ジョン・スミス`},
+				types.CLAIM_GIVEN_NAME:  {`ja-Kana-JP`: `ジョン`},
+				types.CLAIM_FAMILY_NAME: {`ja-Kana-JP`: `スミス`},
+			},
+			Attributes: map[string]interface{}{
+				`tenant_id`: `acme`,
+				`roles`:     []string{`admin`, `user`},
+			},
+			VerifiedClaims: []VerifiedClaims{{
+				Verification: Verification{
+					TrustFramework: `nist_800_63A`,
+					AssuranceLevel: `ial2`,
+					Time:           `2020-01-01T10:00:00Z`,
+					Evidence: []Evidence{{
+						Type:   `document`,
+						Method: `pipp`,
+						Time:   `2020-01-01T09:30:00Z`,
+						DocumentDetails: &DocumentDetails{
+							Type:           `passport`,
+							DocumentNumber: `553554554`,
+							Issuer:         &DocumentIssuer{Name: `U.S. Department of State`, Country: `US`},
+							DateOfIssuance: `2015-03-23`,
+							DateOfExpiry:   `2025-03-22`,
+						},
+					}},
+				},
+				Claims: map[string]interface{}{
+					types.CLAIM_GIVEN_NAME:  `John`,
+					types.CLAIM_FAMILY_NAME: `Smith`,
+					types.CLAIM_BIRTHDATE:   `1974-05-06`,
+				},
+			}},
+			UpdatedAt: 1577836800,
 		},
 		UserEntity{
-			Subject:     `1002`,
-			LoginId:     `jane`,
-			Password:    `jane`,
-			GivenName:   `Jane`,
-			FamilyName:  `Smith`,
-			Email:       `jane@example.com`,
-			PhoneNumber: `+56 (2) 687 2400`,
+			Subject:       `1002`,
+			LoginId:       `jane`,
+			Password:      `jane`,
+			GivenName:     `Jane`,
+			FamilyName:    `Smith`,
+			Gender:        `female`,
+			Zoneinfo:      `America/Santiago`,
+			Locale:        `es-CL`,
+			Email:         `jane@example.com`,
+			EmailVerified: true,
+			PhoneNumber:   `+56 (2) 687 2400`,
 			Address: dto.Address{
 				Country: `Chile`,
 			},
+			LocalizedClaims: LocalizedClaims{
+				types.CLAIM_NAME:        {`ja-Kana-JP`: `ジェーン・スミス`},
+				types.CLAIM_GIVEN_NAME:  {`ja-Kana-JP`: `ジェーン`},
+				types.CLAIM_FAMILY_NAME: {`ja-Kana-JP`: `スミス`},
+			},
+			Attributes: map[string]interface{}{
+				`tenant_id`: `acme`,
+				`roles`:     []string{`user`},
+			},
+			UpdatedAt: 1577836800,
 		},
 	}
 
@@ -63,6 +130,12 @@ func init() {
 
 type UserDatabase struct {
 	Users []UserEntity
+	mutex sync.Mutex
+
+	// The largest subject ever assigned or deleted. Subjects are never
+	// reused because passkeys, linked accounts and grants at Authlete
+	// still refer to the subjects of deleted users.
+	lastSubject int
 }
 
 func UserDatabase_Get() *UserDatabase {
@@ -70,12 +143,17 @@ func UserDatabase_Get() *UserDatabase {
 }
 
 func (self *UserDatabase) GetByCredentials(loginId string, password string) *UserEntity {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
 	for _, entity := range self.Users {
 		if entity.LoginId != loginId {
 			continue
 		}
 
-		if entity.Password != password {
+		// Users provisioned from external identity providers don't have
+		// passwords.
+		if entity.Password == `` || entity.Password != password || entity.Disabled {
 			return nil
 		}
 
@@ -86,6 +164,9 @@ func (self *UserDatabase) GetByCredentials(loginId string, password string) *Use
 }
 
 func (self *UserDatabase) GetBySubject(subject string) *UserEntity {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
 	for _, entity := range self.Users {
 		if entity.Subject != subject {
 			continue
@@ -97,6 +178,306 @@ func (self *UserDatabase) GetBySubject(subject string) *UserEntity {
 	return nil
 }
 
+func (self *UserDatabase) GetByEmail(email string) *UserEntity {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for _, entity := range self.Users {
+		if strings.EqualFold(entity.Email, email) == false {
+			continue
+		}
+
+		return &entity
+	}
+
+	return nil
+}
+
+func (self *UserDatabase) GetByFederatedIdentity(provider string, subject string) *UserEntity {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for _, entity := range self.Users {
+		for _, identity := range entity.FederatedIdentities {
+			if identity.Provider == provider && identity.Subject == subject {
+				return &entity
+			}
+		}
+	}
+
+	return nil
+}
+
+func (self *UserDatabase) Create(user *UserEntity) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for _, entity := range self.Users {
+		if entity.LoginId == user.LoginId {
+			return ErrLoginIdAlreadyUsed
+		}
+
+		self.reserveSubject(entity.Subject)
+	}
+
+	// This implementation uses sequential numbers as subjects.
+	self.lastSubject++
+	user.Subject = strconv.Itoa(self.lastSubject)
+	user.UpdatedAt = time.Now().Unix()
+
+	self.Users = append(self.Users, *user)
+
+	return nil
+}
+
+// Update replaces the profile of the user who has the same subject. The
+// password is kept if it is empty.
+func (self *UserDatabase) Update(user *UserEntity) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	index := -1
+
+	for i, entity := range self.Users {
+		if entity.Subject == user.Subject {
+			index = i
+		} else if entity.LoginId == user.LoginId {
+			return ErrLoginIdAlreadyUsed
+		}
+	}
+
+	if index < 0 {
+		return ErrUserNotFound
+	}
+
+	entity := &self.Users[index]
+
+	// A new email address has not been verified.
+	if strings.EqualFold(entity.Email, user.Email) == false {
+		entity.EmailVerified = user.EmailVerified
+	}
+
+	// A new phone number has not been verified either.
+	if entity.PhoneNumber != user.PhoneNumber {
+		entity.PhoneNumberVerified = user.PhoneNumberVerified
+	}
+
+	entity.LoginId = user.LoginId
+	entity.ExternalId = user.ExternalId
+	entity.GivenName = user.GivenName
+	entity.FamilyName = user.FamilyName
+	entity.MiddleName = user.MiddleName
+	entity.Nickname = user.Nickname
+	entity.Profile = user.Profile
+	entity.Picture = user.Picture
+	entity.Zoneinfo = user.Zoneinfo
+	entity.Locale = user.Locale
+	entity.Email = user.Email
+	entity.PhoneNumber = user.PhoneNumber
+	entity.Address = user.Address
+	entity.Disabled = user.Disabled
+
+	// Claims which SCIM resources do not carry are kept unless given.
+	entity.PreferredUsername = keepUnlessGiven(entity.PreferredUsername, user.PreferredUsername)
+	entity.Website = keepUnlessGiven(entity.Website, user.Website)
+	entity.Gender = keepUnlessGiven(entity.Gender, user.Gender)
+	entity.Birthdate = keepUnlessGiven(entity.Birthdate, user.Birthdate)
+
+	// Localized values and custom attributes are kept unless given.
+	if user.LocalizedClaims != nil {
+		entity.LocalizedClaims = user.LocalizedClaims
+	}
+	if user.Attributes != nil {
+		entity.Attributes = user.Attributes
+	}
+
+	entity.UpdatedAt = time.Now().Unix()
+
+	if user.Password != `` {
+		entity.Password = user.Password
+	}
+
+	return nil
+}
+
+// reserveSubject prevents the subject from being assigned to a new user.
+func (self *UserDatabase) reserveSubject(subject string) {
+	if number, err := strconv.Atoi(subject); err == nil && number > self.lastSubject {
+		self.lastSubject = number
+	}
+}
+
+func keepUnlessGiven(current string, given string) string {
+	if given == `` {
+		return current
+	}
+
+	return given
+}
+
+func (self *UserDatabase) Delete(subject string) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i := range self.Users {
+		if self.Users[i].Subject != subject {
+			continue
+		}
+
+		self.reserveSubject(subject)
+		self.Users = append(self.Users[:i], self.Users[i+1:]...)
+
+		return true
+	}
+
+	return false
+}
+
+func (self *UserDatabase) List() []UserEntity {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	users := make([]UserEntity, len(self.Users))
+	copy(users, self.Users)
+
+	return users
+}
+
+func (self *UserDatabase) UpdatePassword(subject string, password string) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i := range self.Users {
+		if self.Users[i].Subject != subject {
+			continue
+		}
+
+		self.Users[i].Password = password
+
+		return true
+	}
+
+	return false
+}
+
+func (self *UserDatabase) UpdateEmailVerified(subject string, verified bool) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i := range self.Users {
+		if self.Users[i].Subject != subject {
+			continue
+		}
+
+		self.Users[i].EmailVerified = verified
+		self.Users[i].UpdatedAt = time.Now().Unix()
+
+		return true
+	}
+
+	return false
+}
+
+func (self *UserDatabase) AddFederatedIdentity(subject string, identity FederatedIdentity) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i := range self.Users {
+		if self.Users[i].Subject != subject {
+			continue
+		}
+
+		self.Users[i].FederatedIdentities = append(self.Users[i].FederatedIdentities, identity)
+
+		return true
+	}
+
+	return false
+}
+
+func (self *UserDatabase) UpdateTotp(subject string, secret string, recoveryCodes []string) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	// Only hashes of the recovery codes are kept.
+	hashes := make([]string, len(recoveryCodes))
+	for i, code := range recoveryCodes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+
+	for i := range self.Users {
+		if self.Users[i].Subject != subject {
+			continue
+		}
+
+		self.Users[i].TotpSecret = secret
+		self.Users[i].TotpLastStep = 0
+		self.Users[i].RecoveryCodes = hashes
+
+		return true
+	}
+
+	return false
+}
+
+func (self *UserDatabase) UseTotpStep(subject string, step uint64) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i := range self.Users {
+		if self.Users[i].Subject != subject {
+			continue
+		}
+
+		// A code must not be accepted twice (RFC 6238, 5.2).
+		if step <= self.Users[i].TotpLastStep {
+			return false
+		}
+
+		self.Users[i].TotpLastStep = step
+
+		return true
+	}
+
+	return false
+}
+
+func (self *UserDatabase) UseRecoveryCode(subject string, code string) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	hash := hashRecoveryCode(code)
+
+	for i := range self.Users {
+		if self.Users[i].Subject != subject {
+			continue
+		}
+
+		codes := self.Users[i].RecoveryCodes
+
+		for j, candidate := range codes {
+			if subtle.ConstantTimeCompare([]byte(candidate), []byte(hash)) != 1 {
+				continue
+			}
+
+			// A recovery code can be used only once.
+			self.Users[i].RecoveryCodes = append(codes[:j:j], codes[j+1:]...)
+
+			return true
+		}
+
+		return false
+	}
+
+	return false
+}
+
+func hashRecoveryCode(code string) string {
+	hash := sha256.Sum256([]byte(code))
+
+	return hex.EncodeToString(hash[:])
+}
+
 type UserEntity struct {
 	Subject     string
 	LoginId     string
@@ -106,6 +487,64 @@ type UserEntity struct {
 	Email       string
 	PhoneNumber string
 	Address     dto.Address
+
+	// Other standard claims (OpenID Connect Core 1.0, 5.1)
+	MiddleName        string
+	Nickname          string
+	PreferredUsername string
+	Profile           string
+	Picture           string
+	Website           string
+	Gender            string
+	Birthdate         string // YYYY-MM-DD, or YYYY if the year is only known
+	Zoneinfo          string // e.g. "Europe/Paris"
+	Locale            string // e.g. "en-US"
+
+	// Values of claims in other languages, e.g. names in Katakana.
+	LocalizedClaims LocalizedClaims
+
+	// Custom attributes, e.g. roles, which claims can be mapped to in
+	// `claims.toml`.
+	Attributes map[string]interface{}
+
+	// Claims verified by trust frameworks. These are not copied into the
+	// session.
+	VerifiedClaims []VerifiedClaims `json:"-"`
+
+	// True when the user has proved the control of the email address.
+	EmailVerified bool
+
+	// True when the user has proved the control of the phone number.
+	PhoneNumberVerified bool
+
+	// Time the profile was last updated, in seconds since the Unix epoch.
+	UpdatedAt int64
+
+	// Identifier of the user in the provisioning client, e.g. an HR system.
+	ExternalId string
+
+	// Disabled users cannot log in.
+	Disabled bool
+
+	// Accounts at external identity providers linked to this user.
+	FederatedIdentities []FederatedIdentity
+
+	// Second factor (RFC 6238 TOTP). These are not copied into the session.
+	TotpSecret    string   `json:"-"`
+	TotpLastStep  uint64   `json:"-"`
+	RecoveryCodes []string `json:"-"`
+}
+
+type FederatedIdentity struct {
+	// Name of the identity provider in `federation.toml`.
+	Provider string
+
+	// Value of the "sub" claim issued by the identity provider.
+	Subject string
+}
+
+func (self *UserEntity) IsTotpEnabled() bool {
+	return self.TotpSecret != ``
 }
 
 func (self *UserEntity) GetClaim(claimName string, languageTag string) interface{} {
@@ -113,25 +552,91 @@ func (self *UserEntity) GetClaim(claimName string, languageTag string) interface
 		return nil
 	}
 
+	// Claims defined in `claims.toml` take precedence.
+	mapping := ClaimMapping_Get()
+	if mapping.Has(claimName) {
+		// Custom claims don't have values in other languages.
+		if languageTag != `` {
+			return nil
+		}
+		return mapping.Get(self, claimName)
+	}
+
+	// A value in the specific language, e.g. for "name#ja-Kana-JP".
 	if languageTag != `` {
-		return nil
+		return self.LocalizedClaims.Get(claimName, languageTag)
 	}
 
-	// See "OpenID Connect Core 1.0, 5. Claims"
+	return self.standardClaim(claimName)
+}
+
+func (self *UserEntity) standardClaim(claimName string) interface{} {
+	// See "OpenID Connect Core 1.0, 5.1. Standard Claims"
 	switch claimName {
 	case types.CLAIM_NAME:
-		return fmt.Sprintf("%s %s", self.GivenName, self.FamilyName)
+		return optionalString(strings.TrimSpace(fmt.Sprintf("%s %s", self.GivenName, self.FamilyName)))
 	case types.CLAIM_GIVEN_NAME:
-		return self.GivenName
+		return optionalString(self.GivenName)
 	case types.CLAIM_FAMILY_NAME:
-		return self.FamilyName
+		return optionalString(self.FamilyName)
+	case types.CLAIM_MIDDLE_NAME:
+		return optionalString(self.MiddleName)
+	case types.CLAIM_NICKNAME:
+		return optionalString(self.Nickname)
+	case types.CLAIM_PREFERRED_USERNAME:
+		if self.PreferredUsername == `` {
+			return optionalString(self.LoginId)
+		}
+		return self.PreferredUsername
+	case types.CLAIM_PROFILE:
+		return optionalString(self.Profile)
+	case types.CLAIM_PICTURE:
+		return optionalString(self.Picture)
+	case types.CLAIM_WEBSITE:
+		return optionalString(self.Website)
 	case types.CLAIM_EMAIL:
-		return self.Email
+		return optionalString(self.Email)
+	case types.CLAIM_EMAIL_VERIFIED:
+		if self.Email == `` {
+			return nil
+		}
+		return self.EmailVerified
+	case types.CLAIM_GENDER:
+		return optionalString(self.Gender)
+	case types.CLAIM_BIRTHDATE:
+		return optionalString(self.Birthdate)
+	case types.CLAIM_ZONEINFO:
+		return optionalString(self.Zoneinfo)
+	case types.CLAIM_LOCALE:
+		return optionalString(self.Locale)
 	case types.CLAIM_PHONE_NUMBER:
-		return self.PhoneNumber
+		return optionalString(self.PhoneNumber)
+	case types.CLAIM_PHONE_NUMBER_VERIFIED:
+		if self.PhoneNumber == `` {
+			return nil
+		}
+		return self.PhoneNumberVerified
 	case types.CLAIM_ADDRESS:
+		if self.Address == (dto.Address{}) {
+			return nil
+		}
 		return &self.Address
+	case types.CLAIM_UPDATED_AT:
+		if self.UpdatedAt == 0 {
+			return nil
+		}
+		return self.UpdatedAt
 	default:
 		return nil
 	}
 }
+
+// optionalString returns nil for an empty string so that the claim is
+// omitted instead of being an empty string.
+func optionalString(value string) interface{} {
+	if value == `` {
+		return nil
+	}
+
+	return value
+}
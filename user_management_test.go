@@ -0,0 +1,104 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestUserDatabaseUpdateKeepsClaimsOutsideScim(t *testing.T) {
+	db := &UserDatabase{Users: []UserEntity{{
+		Subject:           `1`,
+		LoginId:           `alice`,
+		GivenName:         `Alice`,
+		PreferredUsername: `ally`,
+		Website:           `https://alice.example.com`,
+		Gender:            `female`,
+		Birthdate:         `1990-01-01`,
+	}}}
+
+	// A SCIM PATCH which changes only the given name.
+	resource := ScimUser_New(db.GetBySubject(`1`), ``)
+	err := resource.ApplyPatch([]ScimPatchOperation{{Op: `replace`, Path: `name.givenName`, Value: []byte(`"Alicia"`)}})
+	if err != nil {
+		t.Fatalf("The patch failed: %s", err)
+	}
+
+	if err := db.Update(resource.ToUserEntity(`1`)); err != nil {
+		t.Fatalf("The update failed: %s", err)
+	}
+
+	user := db.GetBySubject(`1`)
+	if user.GivenName != `Alicia` {
+		t.Errorf("The given name was not updated: %s", user.GivenName)
+	}
+
+	if user.PreferredUsername != `ally` || user.Website != `https://alice.example.com` ||
+		user.Gender != `female` || user.Birthdate != `1990-01-01` {
+		t.Errorf("Claims which SCIM does not carry were erased: %+v", user)
+	}
+}
+
+func TestUserDatabaseNeverReusesSubjects(t *testing.T) {
+	db := &UserDatabase{Users: []UserEntity{{Subject: `1`, LoginId: `alice`}, {Subject: `2`, LoginId: `bob`}}}
+
+	// The user who has the largest subject is deleted.
+	db.Delete(`2`)
+
+	user := &UserEntity{LoginId: `carol`}
+	if err := db.Create(user); err != nil {
+		t.Fatalf("The creation failed: %s", err)
+	}
+
+	if user.Subject != `3` {
+		t.Errorf("The new user got the subject '%s'", user.Subject)
+	}
+}
+
+func TestSessionOfDisabledUser(t *testing.T) {
+	db := testUserStore_Install(t, UserEntity{Subject: `1`, LoginId: `alice`, Password: `alice`, GivenName: `Alice`})
+
+	browser := testBrowser_New(t)
+	browser.login(`alice`, `alice`)
+
+	params := testAuthorizationParams(url.Values{`prompt`: {`none`}})
+	expectCode(t, browser.get(`/api/authorization`, params))
+
+	// The account is disabled after the user has logged in.
+	db.Users[0].Disabled = true
+
+	expectError(t, browser.get(`/api/authorization`, params), `login_required`)
+
+	form := browser.authorize(nil)
+	if form.LoginRequired == false {
+		t.Errorf("The session of the disabled user is still valid")
+	}
+}
+
+func TestSessionOfDeletedUser(t *testing.T) {
+	db := testUserStore_Install(t, UserEntity{Subject: `1`, LoginId: `alice`, Password: `alice`, GivenName: `Alice`})
+
+	browser := testBrowser_New(t)
+	browser.login(`alice`, `alice`)
+
+	// The page is rendered before the account is deleted.
+	form := browser.authorize(nil)
+	db.Delete(`1`)
+
+	expectError(t, browser.submit(form, testDecision(``, ``, true)), `login_required`)
+}
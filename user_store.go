@@ -0,0 +1,70 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	userStoreInstance UserStore
+
+	ErrUserStoreReadOnly = errors.New("the user store does not accept changes")
+)
+
+func init() {
+	// "memory" (default) or "ldap"
+	kind := getConfiguration(`USER_STORE`, `memory`)
+
+	switch kind {
+	case `ldap`:
+		userStoreInstance = LdapUserStore_New(LdapConfiguration_Load(
+			getConfiguration(`LDAP_CONFIG`, `ldap.toml`)))
+	default:
+		userStoreInstance = UserDatabase_Get()
+	}
+
+	msg := fmt.Sprintf("user_store: The user store is '%s'.", kind)
+	log.Debug().Msg(msg)
+}
+
+// UserStore is where users are looked up and authenticated. Stores which
+// are managed elsewhere, e.g. a directory server, may reject changes by
+// returning false or ErrUserStoreReadOnly.
+type UserStore interface {
+	GetByCredentials(loginId string, password string) *UserEntity
+	GetBySubject(subject string) *UserEntity
+	GetByEmail(email string) *UserEntity
+	GetByFederatedIdentity(provider string, subject string) *UserEntity
+	Create(user *UserEntity) error
+	Update(user *UserEntity) error
+	Delete(subject string) bool
+	List() []UserEntity
+	UpdatePassword(subject string, password string) bool
+	UpdateEmailVerified(subject string, verified bool) bool
+	AddFederatedIdentity(subject string, identity FederatedIdentity) bool
+	UpdateTotp(subject string, secret string, recoveryCodes []string) bool
+	UseTotpStep(subject string, step uint64) bool
+	UseRecoveryCode(subject string, code string) bool
+}
+
+func UserStore_Get() UserStore {
+	return userStoreInstance
+}
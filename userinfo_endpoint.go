@@ -0,0 +1,78 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"github.com/authlete/authlete-go-gin/endpoint"
+	"github.com/authlete/authlete-go-gin/handler"
+	"github.com/authlete/authlete-go/api"
+	"github.com/authlete/authlete-go/dto"
+	"github.com/gin-gonic/gin"
+)
+
+type UserInfoEndpoint struct {
+	endpoint.BaseEndpoint
+}
+
+func UserInfoEndpoint_Handler() gin.HandlerFunc {
+	// Instance of userinfo endpoint
+	endpoint := UserInfoEndpoint{}
+
+	return func(ctx *gin.Context) {
+		endpoint.Handle(ctx)
+	}
+}
+
+func (self *UserInfoEndpoint) Handle(ctx *gin.Context) {
+	api := self.GetAuthleteApi(ctx)
+	if api == nil {
+		return
+	}
+
+	// The access token is presented in the Authorization header or, for
+	// POST requests, as a form parameter (RFC 6750).
+	accessToken := extractBearerToken(ctx)
+	if accessToken == `` {
+		accessToken = ctx.PostForm(`access_token`)
+	}
+
+	// Let UserInfoReqHandler handle the request. A new SPI instance is
+	// created per request because it caches the user.
+	spi := UserInfoReqHandlerSpiImpl_New(ctx)
+	handler := handler.UserInfoReqHandler_New(&userInfoApi{AuthleteApi: api, spi: spi}, spi)
+	handler.Handle(ctx, accessToken)
+}
+
+// userInfoApi passes the "verified_claims" request in the response from
+// /api/auth/userinfo API to the SPI, which UserInfoReqHandler does not do.
+type userInfoApi struct {
+	api.AuthleteApi
+	spi *UserInfoReqHandlerSpiImpl
+}
+
+func (self *userInfoApi) UserInfo(request *dto.UserInfoRequest) (*dto.UserInfoResponse, *api.AuthleteError) {
+	res, err := self.AuthleteApi.UserInfo(request)
+	if err != nil {
+		return res, err
+	}
+
+	verifiedClaims := getVerifiedClaimsRequest(res.UserInfoClaims)
+	self.spi.VerifiedClaimsRequest = verifiedClaims
+	res.Claims = appendVerifiedClaims(res.Claims, verifiedClaims)
+
+	return res, nil
+}
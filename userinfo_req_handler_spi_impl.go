@@ -0,0 +1,61 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"github.com/authlete/authlete-go-gin/handler/spi"
+	"github.com/gin-gonic/gin"
+)
+
+type UserInfoReqHandlerSpiImpl struct {
+	spi.UserInfoReqHandlerSpiAdapter
+	Context *gin.Context
+	user    *UserEntity
+	tried   bool
+
+	// The "verified_claims" element of the 'claims' request parameter.
+	VerifiedClaimsRequest interface{}
+}
+
+func UserInfoReqHandlerSpiImpl_New(ctx *gin.Context) *UserInfoReqHandlerSpiImpl {
+	return &UserInfoReqHandlerSpiImpl{Context: ctx}
+}
+
+func (self *UserInfoReqHandlerSpiImpl) GetUserClaimValue(
+	subject string, claimName string, languageTag string) interface{} {
+	user := self.getUserBySubject(subject)
+
+	if user == nil {
+		return nil
+	}
+
+	// OpenID Connect for Identity Assurance 1.0
+	if claimName == Claim_VERIFIED_CLAIMS {
+		return user.FilterVerifiedClaims(self.VerifiedClaimsRequest)
+	}
+
+	return user.GetClaim(claimName, languageTag)
+}
+
+func (self *UserInfoReqHandlerSpiImpl) getUserBySubject(subject string) *UserEntity {
+	if self.tried == false {
+		self.user = UserStore_Of(self.Context).GetBySubject(subject)
+		self.tried = true
+	}
+
+	return self.user
+}
@@ -0,0 +1,307 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Claim name defined in OpenID Connect for Identity Assurance 1.0.
+const Claim_VERIFIED_CLAIMS = `verified_claims`
+
+// VerifiedClaims is a set of claims verified by a trust framework, e.g. by
+// an identity document.
+type VerifiedClaims struct {
+	Verification Verification           `json:"verification"`
+	Claims       map[string]interface{} `json:"claims"`
+}
+
+type Verification struct {
+	// e.g. "de_aml", "nist_800_63A"
+	TrustFramework      string     `json:"trust_framework"`
+	AssuranceLevel      string     `json:"assurance_level,omitempty"`
+	Time                string     `json:"time,omitempty"` // RFC 3339
+	VerificationProcess string     `json:"verification_process,omitempty"`
+	Evidence            []Evidence `json:"evidence,omitempty"`
+}
+
+type Evidence struct {
+	// e.g. "document", "electronic_record"
+	Type            string           `json:"type"`
+	Method          string           `json:"method,omitempty"`
+	Time            string           `json:"time,omitempty"`
+	DocumentDetails *DocumentDetails `json:"document_details,omitempty"`
+}
+
+type DocumentDetails struct {
+	// e.g. "idcard", "passport"
+	Type           string          `json:"type"`
+	DocumentNumber string          `json:"document_number,omitempty"`
+	Issuer         *DocumentIssuer `json:"issuer,omitempty"`
+	DateOfIssuance string          `json:"date_of_issuance,omitempty"`
+	DateOfExpiry   string          `json:"date_of_expiry,omitempty"`
+}
+
+type DocumentIssuer struct {
+	Name    string `json:"name,omitempty"`
+	Country string `json:"country,omitempty"`
+}
+
+// getVerifiedClaimsRequest extracts the "verified_claims" element from the
+// "id_token" or "userinfo" part of a 'claims' request parameter.
+func getVerifiedClaimsRequest(claims string) interface{} {
+	if claims == `` {
+		return nil
+	}
+
+	parsed := map[string]interface{}{}
+	if json.Unmarshal([]byte(claims), &parsed) != nil {
+		return nil
+	}
+
+	return parsed[Claim_VERIFIED_CLAIMS]
+}
+
+// appendVerifiedClaims adds "verified_claims" to the claim names if they are
+// requested so that GetUserClaimValue is asked for them.
+func appendVerifiedClaims(claimNames []string, request interface{}) []string {
+	if request == nil || containsString(claimNames, Claim_VERIFIED_CLAIMS) {
+		return claimNames
+	}
+
+	names := make([]string, len(claimNames), len(claimNames)+1)
+	copy(names, claimNames)
+
+	return append(names, Claim_VERIFIED_CLAIMS)
+}
+
+// FilterVerifiedClaims returns the verified claims of the user which satisfy
+// the request, limited to the requested elements. The request is either an
+// object or an array of objects. nil is returned if nothing satisfies it.
+func (self *UserEntity) FilterVerifiedClaims(request interface{}) interface{} {
+	requests := []interface{}{request}
+	if list, ok := request.([]interface{}); ok {
+		requests = list
+	}
+
+	results := []interface{}{}
+
+	for _, record := range self.VerifiedClaims {
+		// Convert the record into a generic form.
+		bytes, _ := json.Marshal(record)
+		data := map[string]interface{}{}
+		json.Unmarshal(bytes, &data)
+
+		for _, r := range requests {
+			if result := filterVerifiedClaimsRecord(r, data); result != nil {
+				results = append(results, result)
+				break
+			}
+		}
+	}
+
+	switch len(results) {
+	case 0:
+		return nil
+	case 1:
+		return results[0]
+	default:
+		return results
+	}
+}
+
+func filterVerifiedClaimsRecord(request interface{}, data map[string]interface{}) map[string]interface{} {
+	r, ok := request.(map[string]interface{})
+	if ok == false {
+		return nil
+	}
+
+	// Verification
+	verification, ok := filterElement(r[`verification`], data[`verification`])
+	if ok == false {
+		return nil
+	}
+
+	// 'trust_framework' is always returned.
+	v, _ := verification.(map[string]interface{})
+	if v == nil {
+		v = map[string]interface{}{}
+	}
+	v[`trust_framework`] = data[`verification`].(map[string]interface{})[`trust_framework`]
+
+	// Only the requested claims which have been verified are returned.
+	requested, _ := r[`claims`].(map[string]interface{})
+	verified, _ := data[`claims`].(map[string]interface{})
+	claims := map[string]interface{}{}
+
+	for name, spec := range requested {
+		value, exists := verified[name]
+		if exists == false {
+			continue
+		}
+
+		if filtered, ok := filterElement(spec, value); ok {
+			claims[name] = filtered
+		}
+	}
+
+	// The verified claims are omitted if none of the claims is available.
+	if len(claims) == 0 {
+		return nil
+	}
+
+	return map[string]interface{}{`verification`: v, `claims`: claims}
+}
+
+// Keys which make an element of the request a constraint on a value rather
+// than a structure of sub-elements.
+var constraintKeys = map[string]bool{
+	`essential`: true, `purpose`: true, `value`: true, `values`: true, `max_age`: true,
+}
+
+func isConstraint(request map[string]interface{}) bool {
+	for key := range request {
+		if constraintKeys[key] == false {
+			return false
+		}
+	}
+
+	return true
+}
+
+// filterElement returns the part of the data which the request asks for.
+// false is returned if the data does not satisfy a constraint.
+func filterElement(request interface{}, data interface{}) (interface{}, bool) {
+	switch r := request.(type) {
+	case nil:
+		// The whole element is requested.
+		return data, true
+
+	case map[string]interface{}:
+		if isConstraint(r) {
+			return data, satisfiesConstraint(r, data)
+		}
+
+		// Sub-elements are requested.
+		object, ok := data.(map[string]interface{})
+		if ok == false {
+			return nil, false
+		}
+
+		result := map[string]interface{}{}
+		for key, sub := range r {
+			value, exists := object[key]
+			if exists == false {
+				// A value constraint on a missing element is not satisfied.
+				if s, ok := sub.(map[string]interface{}); ok && hasValueConstraint(s) {
+					return nil, false
+				}
+				continue
+			}
+
+			filtered, ok := filterElement(sub, value)
+			if ok == false {
+				return nil, false
+			}
+			result[key] = filtered
+		}
+		return result, true
+
+	case []interface{}:
+		// e.g. "evidence". Each item of the data is returned if it matches
+		// any item of the request.
+		items, ok := data.([]interface{})
+		if ok == false {
+			return nil, false
+		}
+
+		result := []interface{}{}
+		for _, item := range items {
+			for _, sub := range r {
+				if filtered, ok := filterElement(sub, item); ok {
+					result = append(result, filtered)
+					break
+				}
+			}
+		}
+		return result, len(result) > 0
+	}
+
+	return nil, false
+}
+
+func hasValueConstraint(request map[string]interface{}) bool {
+	_, value := request[`value`]
+	_, values := request[`values`]
+	_, maxAge := request[`max_age`]
+
+	return value || values || maxAge
+}
+
+func satisfiesConstraint(request map[string]interface{}, data interface{}) bool {
+	if value, ok := request[`value`]; ok && equalsScalar(value, data) == false {
+		return false
+	}
+
+	if values, ok := request[`values`].([]interface{}); ok {
+		found := false
+		for _, value := range values {
+			if equalsScalar(value, data) {
+				found = true
+				break
+			}
+		}
+		if found == false {
+			return false
+		}
+	} else if _, ok := request[`values`]; ok {
+		// 'values' must be an array.
+		return false
+	}
+
+	// The time must be within the maximum age in seconds.
+	if maxAge, ok := request[`max_age`].(float64); ok {
+		s, _ := data.(string)
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil || time.Since(t) > time.Duration(maxAge)*time.Second {
+			return false
+		}
+	}
+
+	return true
+}
+
+// equalsScalar tells whether the two values are the same string, number or
+// boolean. Objects and arrays in the request, which is controlled by the
+// client, never match because they cannot be compared with ==.
+func equalsScalar(a interface{}, b interface{}) bool {
+	if isScalar(a) == false || isScalar(b) == false {
+		return false
+	}
+
+	return a == b
+}
+
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case string, float64, bool:
+		return true
+	default:
+		return false
+	}
+}
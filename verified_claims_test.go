@@ -0,0 +1,108 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFilterVerifiedClaims(t *testing.T) {
+	user := UserEntity{VerifiedClaims: []VerifiedClaims{{
+		Verification: Verification{
+			TrustFramework: `nist_800_63A`,
+			AssuranceLevel: `ial2`,
+			Evidence: []Evidence{{
+				Type:   `document`,
+				Method: `pipp`,
+			}},
+		},
+		Claims: map[string]interface{}{
+			`given_name`: `John`,
+			`birthdate`:  `1974-05-06`,
+		},
+	}}}
+
+	tests := []struct {
+		name     string
+		request  string
+		expected string
+	}{
+		{
+			`whole claims`,
+			`{"verification":{"trust_framework":null},"claims":{"given_name":null}}`,
+			`{"claims":{"given_name":"John"},"verification":{"trust_framework":"nist_800_63A"}}`,
+		},
+		{
+			`matching value`,
+			`{"verification":{"trust_framework":{"value":"nist_800_63A"}},"claims":{"birthdate":null}}`,
+			`{"claims":{"birthdate":"1974-05-06"},"verification":{"trust_framework":"nist_800_63A"}}`,
+		},
+		{
+			`unmatched value`,
+			`{"verification":{"trust_framework":{"value":"de_aml"}},"claims":{"given_name":null}}`,
+			`null`,
+		},
+		{
+			`matching values`,
+			`{"verification":{"assurance_level":{"values":["ial1","ial2"]}},"claims":{"given_name":null}}`,
+			`{"claims":{"given_name":"John"},"verification":{"assurance_level":"ial2","trust_framework":"nist_800_63A"}}`,
+		},
+		{
+			`unknown claim`,
+			`{"verification":{"trust_framework":null},"claims":{"email":null}}`,
+			`null`,
+		},
+		{
+			`evidence`,
+			`{"verification":{"evidence":[{"type":{"value":"document"},"method":null}]},"claims":{"given_name":null}}`,
+			`{"claims":{"given_name":"John"},"verification":{"evidence":[{"method":"pipp","type":"document"}],"trust_framework":"nist_800_63A"}}`,
+		},
+		{
+			`object value`,
+			`{"verification":{"evidence":{"value":[{"type":"document"}]}},"claims":{"given_name":null}}`,
+			`null`,
+		},
+		{
+			`object in values`,
+			`{"verification":{"trust_framework":{"values":[{"a":1},["b"]]}},"claims":{"given_name":null}}`,
+			`null`,
+		},
+		{
+			`values not an array`,
+			`{"verification":{"trust_framework":{"values":{"a":1}}},"claims":{"given_name":null}}`,
+			`null`,
+		},
+		{
+			`value against an object`,
+			`{"verification":{"evidence":[{"type":null}]},"claims":{"given_name":{"value":{"a":1}}}}`,
+			`null`,
+		},
+	}
+
+	for _, test := range tests {
+		var request interface{}
+		if err := json.Unmarshal([]byte(test.request), &request); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		bytes, _ := json.Marshal(user.FilterVerifiedClaims(request))
+		if string(bytes) != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.name, bytes, test.expected)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+//
+// Copyright (C) 2019 Authlete, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific
+// language governing permissions and limitations under the
+// License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/rs/zerolog/log"
+)
+
+type WebAuthnEndpoint struct {
+	WebAuthn *webauthn.WebAuthn
+}
+
+// WebAuthnEndpoint_New creates the endpoint of the default server when
+// 'tenant' is nil, or of the tenant.
+func WebAuthnEndpoint_New(tenant *Tenant) *WebAuthnEndpoint {
+	// The relying party is this authorization server. Change the settings
+	// when the server is not accessed as http://localhost:8080.
+	rpId := getConfiguration(`WEBAUTHN_RP_ID`, `localhost`)
+	rpOrigins := getConfigurationList(`WEBAUTHN_RP_ORIGINS`, `http://localhost:8080`)
+
+	// A tenant on a host of its own is a relying party of its own.
+	if tenant != nil && tenant.WebAuthnRpId != `` {
+		rpId = tenant.WebAuthnRpId
+	}
+	if tenant != nil && len(tenant.WebAuthnRpOrigins) != 0 {
+		rpOrigins = tenant.WebAuthnRpOrigins
+	}
+
+	config := webauthn.Config{
+		RPID:          rpId,
+		RPDisplayName: getConfiguration(`WEBAUTHN_RP_NAME`, `gin-oauth-server`),
+		RPOrigins:     rpOrigins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			// Discoverable credentials enable usernameless login.
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationRequired,
+		},
+	}
+
+	wa, err := webauthn.New(&config)
+	if err != nil {
+		panic(fmt.Sprintf("webauthn_endpoint: Invalid WebAuthn settings: %s", err))
+	}
+
+	endpoint := WebAuthnEndpoint{}
+	endpoint.WebAuthn = wa
+
+	return &endpoint
+}
+
+func PasskeyPage_Handler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		// Only a user who has logged in can register a passkey.
+		user := getUserFromSession(sessions.Default(ctx))
+		if user == nil {
+			ctx.String(401, "Login is required to register a passkey.")
+			return
+		}
+
+		ctx.HTML(200, `passkeys.html`, gin.H{"userName": user.GivenName})
+	}
+}
+
+func (self *WebAuthnEndpoint) RegistrationOptionsHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		// Only a user who has logged in can register a passkey.
+		user := self.getLoggedInUser(ctx, session)
+		if user == nil {
+			ctx.JSON(401, gin.H{"error": "login_required"})
+			return
+		}
+
+		// Exclude the passkeys which have already been registered.
+		exclusions := []protocol.CredentialDescriptor{}
+		for _, credential := range user.WebAuthnCredentials() {
+			exclusions = append(exclusions, credential.Descriptor())
+		}
+
+		// Start the registration ceremony.
+		options, data, err := self.WebAuthn.BeginRegistration(user,
+			webauthn.WithExclusions(exclusions),
+			webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired))
+		if err != nil {
+			self.fail(ctx, 500, `Failed to start registration`, err)
+			return
+		}
+
+		saveCeremony(session, `webauthnRegistration`, data)
+
+		ctx.JSON(200, options)
+	}
+}
+
+func (self *WebAuthnEndpoint) RegistrationHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		user := self.getLoggedInUser(ctx, session)
+		if user == nil {
+			ctx.JSON(401, gin.H{"error": "login_required"})
+			return
+		}
+
+		data := takeCeremony(session, `webauthnRegistration`)
+		if data == nil {
+			ctx.JSON(400, gin.H{"error": "registration_not_started"})
+			return
+		}
+
+		// Verify the attestation presented by the browser.
+		credential, err := self.WebAuthn.FinishRegistration(user, *data, ctx.Request)
+		if err != nil {
+			self.fail(ctx, 400, `Registration failed`, err)
+			return
+		}
+
+		CredentialDatabase_Of(ctx).Add(user.Entity.Subject, credential)
+
+		msg := fmt.Sprintf("webauthn_endpoint: A passkey was registered. The subject is '%s'.", user.Entity.Subject)
+		log.Debug().Msg(msg)
+
+		ctx.JSON(200, gin.H{"registered": true})
+	}
+}
+
+func (self *WebAuthnEndpoint) LoginOptionsHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		// Start the authentication ceremony without identifying the user
+		// in advance so that the authenticator can choose a passkey.
+		options, data, err := self.WebAuthn.BeginDiscoverableLogin(
+			webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			self.fail(ctx, 500, `Failed to start login`, err)
+			return
+		}
+
+		saveCeremony(session, `webauthnLogin`, data)
+
+		ctx.JSON(200, options)
+	}
+}
+
+func (self *WebAuthnEndpoint) LoginHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		data := takeCeremony(session, `webauthnLogin`)
+		if data == nil {
+			ctx.JSON(400, gin.H{"error": "login_not_started"})
+			return
+		}
+
+		// The user is identified by the user handle in the assertion.
+		var user *WebAuthnUser
+		findUser := func(rawId []byte, userHandle []byte) (webauthn.User, error) {
+			entity := UserStore_Of(ctx).GetBySubject(string(userHandle))
+			if entity == nil {
+				return nil, fmt.Errorf("no user has the user handle")
+			}
+
+			if entity.Disabled {
+				return nil, fmt.Errorf("the user is disabled")
+			}
+
+			user = WebAuthnUser_New(entity, CredentialDatabase_Of(ctx))
+
+			return user, nil
+		}
+
+		// Verify the assertion presented by the browser.
+		credential, err := self.WebAuthn.FinishDiscoverableLogin(findUser, *data, ctx.Request)
+		if err != nil {
+			Metrics_Get().LoginAttempted(Amr_HWK, LoginResult_FAILURE)
+			auditLoginFailure(ctx, session, Amr_HWK, ``, LoginResult_FAILURE, `invalid_assertion`)
+			self.fail(ctx, 401, `User authentication failed`, err)
+			return
+		}
+
+		// If the authorization request requires a specific subject.
+		value := session.Get(`requiredSubject`)
+		if required, _ := value.(string); required != `` && required != user.Entity.Subject {
+			msg := "webauthn_endpoint: The passkey does not belong to the required subject."
+			log.Debug().Msg(msg)
+			auditLoginFailure(ctx, session, Amr_HWK, user.Entity.LoginId, LoginResult_FAILURE, `subject_mismatch`)
+			ctx.JSON(403, gin.H{"error": "different_subject"})
+			return
+		}
+
+		// The user has to verify the email address before logging in.
+		if isEmailVerificationPending(user.Entity) {
+			msg := "webauthn_endpoint: The email address has not been verified."
+			log.Debug().Msg(msg)
+			auditLoginFailure(ctx, session, Amr_HWK, user.Entity.LoginId, LoginResult_FAILURE, `email_not_verified`)
+			ctx.JSON(403, gin.H{"error": "email_not_verified"})
+			return
+		}
+
+		// Keep the signature counter up to date to detect cloned authenticators.
+		CredentialDatabase_Of(ctx).Update(user.Entity.Subject, credential)
+
+		msg := fmt.Sprintf("webauthn_endpoint: User authentication succeeded. The subject is '%s'.", user.Entity.Subject)
+		log.Debug().Msg(msg)
+
+		// Let the user log in. The authorization page then submits the
+		// decision of the user to the authorization decision endpoint.
+		loginUser(ctx, session, user.Entity, []string{Amr_HWK})
+
+		ctx.JSON(200, gin.H{"authenticated": true})
+	}
+}
+
+func (self *WebAuthnEndpoint) getLoggedInUser(ctx *gin.Context, session sessions.Session) *WebAuthnUser {
+	entity := getUserFromSession(session)
+	if entity == nil {
+		return nil
+	}
+
+	return WebAuthnUser_New(entity, CredentialDatabase_Of(ctx))
+}
+
+func (self *WebAuthnEndpoint) fail(ctx *gin.Context, status int, message string, err error) {
+	msg := fmt.Sprintf("webauthn_endpoint: %s: %s", message, err)
+	log.Debug().Msg(msg)
+
+	ctx.JSON(status, gin.H{"error": message})
+}
+
+func saveCeremony(session sessions.Session, key string, data *webauthn.SessionData) {
+	bytes, _ := json.Marshal(data)
+
+	session.Set(key, bytes)
+	session.Save()
+}
+
+func takeCeremony(session sessions.Session, key string) *webauthn.SessionData {
+	value := session.Get(key)
+	if value == nil {
+		return nil
+	}
+
+	// The challenge can be used only once.
+	session.Delete(key)
+	session.Save()
+
+	bytes, _ := value.([]byte)
+
+	data := webauthn.SessionData{}
+	if json.Unmarshal(bytes, &data) != nil {
+		return nil
+	}
+
+	return &data
+}